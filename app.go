@@ -1,104 +1,2023 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"mime"
 	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/cyverse-de/async-tasks/database"
 	"github.com/cyverse-de/async-tasks/model"
+	"github.com/google/uuid"
 	"github.com/gorilla/mux"
+	"github.com/santhosh-tekuri/jsonschema/v5"
+	"github.com/sirupsen/logrus"
 )
 
-const hundredMiB = 104857600
+const defaultFilterLimit = 100
+
+const healthCheckTimeout = 5 * time.Second
+
+const ndjsonContentType = "application/x-ndjson"
+
+const jsonContentType = "application/json"
+
+// uuidPattern is what the task and status IDs in routes must look like
+const uuidPattern = "[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}"
+
+var uuidRegexp = regexp.MustCompile("^" + uuidPattern + "$")
+
+// taskTypesCacheTTL is how long GET /tasks/types reuses a result before querying the database again
+const taskTypesCacheTTL = 10 * time.Second
+
+// sortFields maps the values accepted by GET /tasks's sort parameter to the columns they order by
+var sortFields = map[string]string{
+	"start_date": "start_date",
+	"end_date":   "end_date",
+	"type":       "type",
+	"username":   "username",
+}
+
+type contextKey string
+
+const requestIDKey contextKey = "request_id"
+const requestLogKey contextKey = "request_log"
+
+const requestIDHeader = "X-Request-ID"
+
+// clientNameHeader names the service making a request, and is recorded as the source of the tasks it creates
+const clientNameHeader = "X-Client-Name"
+
+// requestIDMiddleware tags each request with the client's X-Request-ID, or a new one if it didn't send one, and
+// stores it and a logger that includes it in the request context
+func requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if id == "" {
+			id = uuid.New().String()
+		}
+
+		w.Header().Set(requestIDHeader, id)
+
+		ctx := context.WithValue(r.Context(), requestIDKey, id)
+		ctx = context.WithValue(ctx, requestLogKey, log.WithFields(logrus.Fields{"request_id": id}))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// requestID returns the ID assigned to a request by requestIDMiddleware, if any
+func requestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey).(string)
+	return id
+}
+
+// requestLog returns the logger for a request, falling back to the service logger
+func requestLog(r *http.Request) *logrus.Entry {
+	if entry, ok := r.Context().Value(requestLogKey).(*logrus.Entry); ok {
+		return entry
+	}
+	return log
+}
 
 func loggingMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// vaguely like apache common log format
-		log.Infof("%s %s %s %s", r.RemoteAddr, r.Method, r.URL.Path, r.Proto)
+		requestLog(r).Infof("%s %s %s %s", r.RemoteAddr, r.Method, r.URL.Path, r.Proto)
 		next.ServeHTTP(w, r)
 	})
 }
 
+// AppConfig contains the configurable settings for the HTTP handlers
+type AppConfig struct {
+	// MaxFilterLimit is the largest page size a client may request from GET /tasks
+	MaxFilterLimit uint64
+
+	// ExportTimeout takes the place of RequestTimeout for task listings streamed as CSV or NDJSON, which are expected to
+	// be large. Zero or less means no limit.
+	ExportTimeout time.Duration
+
+	// RequestTimeout bounds how long a handler's database work may run, so a stuck query or slow client can't hold a
+	// connection open forever
+	RequestTimeout time.Duration
+
+	// MaxBodyBytes is the largest request body the handlers will read. Zero or less means no limit.
+	MaxBodyBytes int64
+
+	// MaxStatusSkew is how far in the future a client-provided status created_date may be, to allow for clock skew.
+	// Zero turns the check off.
+	MaxStatusSkew time.Duration
+
+	// StrictParams rejects unknown query parameters on the task listing endpoints even when requests don't ask for it
+	// with strict=true
+	StrictParams bool
+
+	// BasePath is the path prefix the routes are registered under, or empty if they're at the root
+	BasePath string
+
+	// Authenticator checks the credentials on requests, or is nil to let everyone in
+	Authenticator *authenticator
+}
+
+// BehaviorValidator checks that the data for a behavior of a particular type is usable by its processor
+type BehaviorValidator func(data map[string]interface{}) error
+
+// cachedTaskTypes is a GET /tasks/types result and when it stops being usable
+type cachedTaskTypes struct {
+	types   []string
+	expires time.Time
+}
+
 type AsyncTasksApp struct {
-	db     *database.DBConnection
-	router *mux.Router
+	db                 *database.DBConnection
+	readDB             *database.DBConnection // the read replica, if one is configured
+	router             *mux.Router
+	config             AppConfig
+	behaviorValidators map[string]BehaviorValidator
+	taskSchemas        map[string]*jsonschema.Schema
+	taskTemplates      map[string]model.AsyncTask
+
+	taskTypesMu sync.Mutex
+	taskTypes   map[string]cachedTaskTypes // keyed by username, with "" for all users
 }
 
-func NewAsyncTasksApp(db *database.DBConnection, router *mux.Router) *AsyncTasksApp {
+func NewAsyncTasksApp(db *database.DBConnection, router *mux.Router, config AppConfig) *AsyncTasksApp {
 	app := &AsyncTasksApp{
-		db:     db,
-		router: router,
+		db:                 db,
+		router:             router,
+		config:             config,
+		behaviorValidators: make(map[string]BehaviorValidator),
+		taskSchemas:        make(map[string]*jsonschema.Schema),
+		taskTemplates:      make(map[string]model.AsyncTask),
+		taskTypes:          make(map[string]cachedTaskTypes),
 	}
 
 	app.InitRoutes()
 
-	return app
+	return app
+}
+
+func (a *AsyncTasksApp) InitRoutes() {
+	// mux middleware only wraps matched routes, so the not-found handler needs its own request ID
+	a.router.NotFoundHandler = requestIDMiddleware(http.HandlerFunc(a.NotFound))
+	a.router.HandleFunc("/healthz", a.HealthzRequest).Methods("GET").Name("healthz")
+	a.router.HandleFunc("/debug/schema-version", a.SchemaVersionRequest).Methods("GET").Name("schemaVersion")
+	a.router.HandleFunc("/tasks/{id:"+uuidPattern+"}", a.GetByIdRequest).Methods("GET", "HEAD").Name("getById")
+	a.router.HandleFunc("/tasks/{id:"+uuidPattern+"}", a.DeleteByIdRequest).Methods("DELETE").Name("deleteById")
+	a.router.HandleFunc("/tasks/{id:"+uuidPattern+"}", a.UpdateTaskRequest).Methods("PATCH").Name("updateTask")
+	a.router.HandleFunc("/tasks/{id:"+uuidPattern+"}/reopen", a.ReopenTaskRequest).Methods("POST").Name("reopenTask")
+	a.router.HandleFunc("/tasks/{id:"+uuidPattern+"}/claim", a.ClaimTaskRequest).Methods("POST").Name("claimTask")
+	a.router.HandleFunc("/tasks/{id:"+uuidPattern+"}/release", a.ReleaseTaskRequest).Methods("POST").Name("releaseTask")
+	a.router.HandleFunc("/tasks/{id:"+uuidPattern+"}/status", a.AddStatusRequest).Methods("POST").Name("addStatus")
+	a.router.HandleFunc("/tasks/{id:"+uuidPattern+"}/status", a.GetStatusesRequest).Methods("GET").Name("getStatuses")
+	a.router.HandleFunc("/tasks/{id:"+uuidPattern+"}/status", a.DeleteAllStatusesRequest).Methods("DELETE").Name("deleteAllStatuses")
+	a.router.HandleFunc("/tasks/{id:"+uuidPattern+"}/status/{status_id:"+uuidPattern+"}", a.DeleteStatusRequest).Methods("DELETE").Name("deleteStatus")
+	a.router.HandleFunc("/tasks/{id:"+uuidPattern+"}/behaviors", a.AddBehaviorRequest).Methods("POST").Name("addBehavior")
+	a.router.HandleFunc("/tasks/{id:"+uuidPattern+"}/behaviors", a.GetBehaviorsRequest).Methods("GET").Name("getBehaviors")
+	a.router.HandleFunc("/tasks/{id:"+uuidPattern+"}/behaviors", a.UpsertBehaviorRequest).Methods("PUT").Name("upsertBehavior")
+	a.router.HandleFunc("/tasks/{id:"+uuidPattern+"}/behaviors/{behavior_type}", a.DeleteBehaviorRequest).Methods("DELETE").Name("deleteBehavior")
+
+	a.router.HandleFunc("/tasks/count", a.CountByFilterRequest).Methods("GET").Name("countByFilter")
+	a.router.HandleFunc("/tasks/types", a.GetTaskTypesRequest).Methods("GET").Name("getTaskTypes")
+	a.router.HandleFunc("/tasks/stats", a.StatsByFilterRequest).Methods("GET").Name("statsByFilter")
+	a.router.HandleFunc("/tasks/batch-get", a.BatchGetRequest).Methods("POST").Name("batchGet")
+	a.router.HandleFunc("/tasks/purge", a.PurgeTasksRequest).Methods("POST").Name("purgeTasks")
+	a.router.HandleFunc("/tasks/bulk-delete", a.BulkDeleteRequest).Methods("POST").Name("bulkDelete")
+	a.router.HandleFunc("/statuses", a.GetStatusesSinceRequest).Methods("GET").Name("getStatusesSince")
+	a.router.HandleFunc("/tasks", a.GetByFilterRequest).Methods("GET").Name("getByFilter")
+	a.router.HandleFunc("/tasks", a.CreateTaskRequest).Methods("POST").Name("createTask")
+
+	a.router.Use(requestIDMiddleware)
+	a.router.Use(loggingMiddleware)
+	a.router.Use(a.authMiddleware)
+	a.router.Use(a.timeoutMiddleware)
+}
+
+// timeoutMiddleware gives each request's context the configured deadline, or the export deadline for a streamed
+// listing. Transactions begun with that context are rolled back when it expires, which returns their connections to
+// the pool.
+func (a *AsyncTasksApp) timeoutMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		timeout := a.config.RequestTimeout
+		if isStreamedListing(r) {
+			timeout = a.config.ExportTimeout
+		}
+
+		if timeout <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// UseReadReplica sends the read-only listing and lookup endpoints to a read replica instead of the primary database.
+// Replicas lag the primary a little, so those endpoints may briefly miss the latest changes.
+func (a *AsyncTasksApp) UseReadReplica(readDB *database.DBConnection) {
+	a.readDB = readDB
+}
+
+// readInTx runs fn in a read-only transaction on the read replica if there is one, or the primary otherwise, running it
+// again on transient errors as database.InTx does
+func (a *AsyncTasksApp) readInTx(ctx context.Context, fn func(tx *database.DBTx) error) error {
+	if a.readDB == nil {
+		return a.db.InTx(ctx, nil, fn)
+	}
+	return a.readDB.InTx(ctx, &sql.TxOptions{ReadOnly: true}, fn)
+}
+
+// AddBehaviorValidator registers a validator for the data of behaviors of the given type. Behaviors of types without a
+// validator are accepted as-is.
+func (a *AsyncTasksApp) AddBehaviorValidator(behaviorType string, validator BehaviorValidator) {
+	a.behaviorValidators[behaviorType] = validator
+}
+
+// AddTaskSchema registers a JSON Schema that the data of new tasks of the given type must match. Tasks of types without
+// a schema are accepted as-is.
+func (a *AsyncTasksApp) AddTaskSchema(taskType string, schema *jsonschema.Schema) {
+	a.taskSchemas[taskType] = schema
+}
+
+// AddTaskTemplate registers a template that POST /tasks can start new tasks from. The template's behaviors are checked
+// against the registered behavior validators, so those should be added first.
+func (a *AsyncTasksApp) AddTaskTemplate(name string, template model.AsyncTask) error {
+	for _, behavior := range template.Behaviors {
+		if behavior.BehaviorType == "" {
+			return fmt.Errorf("template %s has a behavior without a type", name)
+		}
+		if err := a.validateBehavior(behavior); err != nil {
+			return fmt.Errorf("template %s: %w", name, err)
+		}
+	}
+
+	a.taskTemplates[name] = template
+	return nil
+}
+
+// validateTaskData checks a task's data against the schema registered for its type, if any
+func (a *AsyncTasksApp) validateTaskData(task model.AsyncTask) error {
+	schema, ok := a.taskSchemas[task.Type]
+	if !ok {
+		return nil
+	}
+
+	if err := schema.Validate(task.Data); err != nil {
+		return fmt.Errorf("data does not match the schema for %s tasks: %s", task.Type, strings.Join(schemaErrorMessages(err), "; "))
+	}
+
+	return nil
+}
+
+// unsupportedMediaTypeError is returned by readBody for a body whose Content-Type the handler doesn't accept
+type unsupportedMediaTypeError struct {
+	contentType string
+	allowed     []string
+}
+
+func (e *unsupportedMediaTypeError) Error() string {
+	return fmt.Sprintf("Content-Type must be %s, got '%s'", strings.Join(e.allowed, " or "), e.contentType)
+}
+
+// readBody reads a request body of one of the allowed media types, which default to JSON. Bodies without a
+// Content-Type are taken as JSON, as they always have been, and empty bodies aren't checked at all. A body longer than
+// the configured limit fails with an *http.MaxBytesError instead of being quietly truncated.
+func (a *AsyncTasksApp) readBody(writer http.ResponseWriter, r *http.Request, allowed ...string) ([]byte, error) {
+	if len(allowed) == 0 {
+		allowed = []string{jsonContentType}
+	}
+
+	if contentType := r.Header.Get("Content-Type"); contentType != "" && r.ContentLength != 0 {
+		mediaType, _, err := mime.ParseMediaType(contentType)
+		if err != nil || !slices.Contains(allowed, mediaType) {
+			return nil, &unsupportedMediaTypeError{contentType: contentType, allowed: allowed}
+		}
+	}
+
+	body := r.Body
+	if a.config.MaxBodyBytes > 0 {
+		body = http.MaxBytesReader(writer, r.Body, a.config.MaxBodyBytes)
+	}
+
+	read, err := io.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	if err = body.Close(); err != nil {
+		return nil, err
+	}
+
+	return read, nil
+}
+
+// validateStatus checks that a status isn't blank and, if the client provided a created date, that it isn't further in
+// the future than clock skew allows. Statuses without a created date get the database's current time.
+func (a *AsyncTasksApp) validateStatus(status model.AsyncTaskStatus) error {
+	if status.Status == "" {
+		return errors.New("A blank status is not allowed")
+	}
+
+	if a.config.MaxStatusSkew > 0 && status.CreatedDate.After(time.Now().Add(a.config.MaxStatusSkew)) {
+		return fmt.Errorf("created_date %s for status '%s' is too far in the future", status.CreatedDate.Format(time.RFC3339), status.Status)
+	}
+
+	return nil
+}
+
+// validateNewTask checks everything about a task being created, returning every problem it finds rather than stopping
+// at the first, so a client can fix them all before trying again. An imported task may bring its whole status history,
+// but each of its statuses has to say when it happened.
+func (a *AsyncTasksApp) validateNewTask(task model.AsyncTask, importing bool) []FieldError {
+	var problems []FieldError
+
+	if task.Type == "" {
+		problems = append(problems, FieldError{Field: "type", Message: "Task type must be provided"})
+	} else if err := a.validateTaskData(task); err != nil {
+		problems = append(problems, FieldError{Field: "data", Message: err.Error()})
+	}
+
+	// keys can't hold a colon, or they couldn't be filtered on with ?tag=key:value
+	tagKeys := make([]string, 0, len(task.Tags))
+	for key := range task.Tags {
+		tagKeys = append(tagKeys, key)
+	}
+	sort.Strings(tagKeys)
+	for _, key := range tagKeys {
+		if key == "" || strings.Contains(key, ":") {
+			problems = append(problems, FieldError{Field: "tags", Message: fmt.Sprintf("Tag keys must be non-empty and may not contain ':', got '%s'", key)})
+		}
+	}
+
+	for i, behavior := range task.Behaviors {
+		if behavior.BehaviorType == "" {
+			problems = append(problems, FieldError{Field: fmt.Sprintf("behaviors[%d].type", i), Message: "All behaviors must have a type"})
+			continue
+		}
+		if err := a.validateBehavior(behavior); err != nil {
+			problems = append(problems, FieldError{Field: fmt.Sprintf("behaviors[%d].data", i), Message: err.Error()})
+		}
+	}
+
+	if len(task.Statuses) > 1 && !importing {
+		problems = append(problems, FieldError{Field: "statuses", Message: "A new task may only include one initial status unless it's imported with import=true"})
+	}
+
+	for i, status := range task.Statuses {
+		if err := a.validateStatus(status); err != nil {
+			problems = append(problems, FieldError{Field: fmt.Sprintf("statuses[%d]", i), Message: err.Error()})
+		}
+		if importing && status.CreatedDate.IsZero() {
+			problems = append(problems, FieldError{Field: fmt.Sprintf("statuses[%d].created_date", i), Message: "Imported statuses must have a created_date"})
+		}
+	}
+
+	return problems
+}
+
+// validateBehavior runs the registered validator, if any, for a behavior
+func (a *AsyncTasksApp) validateBehavior(behavior model.AsyncTaskBehavior) error {
+	validator, ok := a.behaviorValidators[behavior.BehaviorType]
+	if !ok {
+		return nil
+	}
+
+	if err := validator(behavior.Data); err != nil {
+		return fmt.Errorf("invalid data for %s behavior: %s", behavior.BehaviorType, err.Error())
+	}
+
+	return nil
+}
+
+func (a *AsyncTasksApp) NotFound(writer http.ResponseWriter, r *http.Request) {
+	// the task routes only match well-formed IDs, so tell callers when that's why nothing matched
+	if rest, ok := strings.CutPrefix(strings.TrimPrefix(r.URL.Path, a.config.BasePath), "/tasks/"); ok && rest != "" {
+		segments := strings.Split(rest, "/")
+		if !uuidRegexp.MatchString(segments[0]) {
+			badRequest(writer, r, fmt.Sprintf("invalid task ID format: %s", segments[0]))
+			return
+		}
+		if len(segments) == 3 && segments[1] == "status" && segments[2] != "" && !uuidRegexp.MatchString(segments[2]) {
+			badRequest(writer, r, fmt.Sprintf("invalid status ID format: %s", segments[2]))
+			return
+		}
+	}
+
+	notFound(writer, r, fmt.Sprintf("no endpoint found at %s %s", r.Method, r.URL.Path))
+}
+
+func (a *AsyncTasksApp) HealthzRequest(writer http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), healthCheckTimeout)
+	defer cancel()
+
+	if err := a.db.Ping(ctx); err != nil {
+		unavailable(writer, r, fmt.Sprintf("database is unreachable: %s", err.Error()))
+		return
+	}
+
+	if a.readDB != nil {
+		if err := a.readDB.Ping(ctx); err != nil {
+			unavailable(writer, r, fmt.Sprintf("read replica is unreachable: %s", err.Error()))
+			return
+		}
+	}
+
+	_, err := fmt.Fprintf(writer, "{\"status\":\"ok\"}")
+	if err != nil {
+		requestLog(r).Error(err.Error())
+	}
+}
+
+// SchemaVersionRequest reports the database's migration version and any migrations this build has that it's missing
+func (a *AsyncTasksApp) SchemaVersionRequest(writer http.ResponseWriter, r *http.Request) {
+	version, err := a.db.GetSchemaVersion(r.Context())
+	if err != nil {
+		errored(writer, r, err.Error())
+		return
+	}
+
+	jsoned, err := json.Marshal(version)
+	if err != nil {
+		errored(writer, r, err.Error())
+		return
+	}
+
+	_, err = writer.Write(jsoned)
+	if err != nil {
+		requestLog(r).Error(err.Error())
+	}
+}
+
+func (a *AsyncTasksApp) GetByIdRequest(writer http.ResponseWriter, r *http.Request) {
+	var (
+		id  string
+		ok  bool
+		v   = mux.Vars(r)
+		ctx = r.Context()
+	)
+
+	if id, ok = v["id"]; !ok {
+		badRequest(writer, r, "No ID in URL")
+		return
+	}
+
+	fields, err := parseFields(r.URL.Query())
+	if err != nil {
+		badRequest(writer, r, err.Error())
+		return
+	}
+
+	var (
+		updatedAt time.Time
+		etag      string
+		task      *model.AsyncTask
+	)
+	err = a.readInTx(ctx, func(tx *database.DBTx) error {
+		var err error
+		if updatedAt, err = tx.GetTaskUpdatedAt(ctx, id); err != nil {
+			return err
+		}
+
+		// a HEAD gets the same headers as a GET, so clients can check for changes without the body
+		etag = makeETag(updatedAt)
+		if notModified(r, etag, updatedAt) || r.Method == http.MethodHead {
+			return nil
+		}
+
+		task, err = tx.GetTask(ctx, id, false)
+		return err
+	})
+	if err != nil {
+		txErrored(writer, r, err)
+		return
+	}
+
+	writer.Header().Set("ETag", etag)
+	writer.Header().Set("Last-Modified", updatedAt.UTC().Format(http.TimeFormat))
+
+	if notModified(r, etag, updatedAt) {
+		writer.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	selected, err := selectTaskFields(task, fields)
+	if err != nil {
+		errored(writer, r, err.Error())
+		return
+	}
+
+	jsoned, err := json.Marshal(selected)
+	if err != nil {
+		errored(writer, r, err.Error())
+		return
+	}
+
+	_, err = writer.Write(jsoned)
+	if err != nil {
+		requestLog(r).Error(err.Error())
+	}
+}
+
+// BatchGetReq is the request body for POST /tasks/batch-get
+type BatchGetReq struct {
+	IDs []string `json:"ids"`
+}
+
+// BatchGetResp is the response body for POST /tasks/batch-get
+type BatchGetResp struct {
+	Tasks    []model.AsyncTask `json:"tasks"`
+	NotFound []string          `json:"not_found"`
+}
+
+// BatchGetRequest fetches several tasks by ID at once, in the order they were requested, and lists the IDs that
+// don't exist
+func (a *AsyncTasksApp) BatchGetRequest(writer http.ResponseWriter, r *http.Request) {
+	var (
+		req BatchGetReq
+		ctx = r.Context()
+	)
+
+	body, err := a.readBody(writer, r)
+	if err != nil {
+		bodyErrored(writer, r, err)
+		return
+	}
+	if err = json.Unmarshal(body, &req); err != nil {
+		badRequest(writer, r, err.Error())
+		return
+	}
+
+	if len(req.IDs) == 0 {
+		badRequest(writer, r, "ids must list at least one task ID")
+		return
+	}
+	if a.config.MaxFilterLimit > 0 && uint64(len(req.IDs)) > a.config.MaxFilterLimit {
+		badRequest(writer, r, fmt.Sprintf("at most %d task IDs may be requested at once, got %d", a.config.MaxFilterLimit, len(req.IDs)))
+		return
+	}
+
+	ids := make([]string, 0, len(req.IDs))
+	seen := make(map[string]bool)
+	for _, id := range req.IDs {
+		if !uuidRegexp.MatchString(id) {
+			badRequest(writer, r, fmt.Sprintf("invalid task ID format: %s", id))
+			return
+		}
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+
+	filters := database.TaskFilter{
+		IDs:              ids,
+		IncludeStatuses:  true,
+		IncludeBehaviors: true,
+	}
+
+	var tasks []model.AsyncTask
+	err = a.db.InTx(ctx, nil, func(tx *database.DBTx) error {
+		var err error
+		tasks, err = tx.GetTasksByFilter(ctx, filters, "")
+		return err
+	})
+	if err != nil {
+		errored(writer, r, err.Error())
+		return
+	}
+
+	found := make(map[string]model.AsyncTask, len(tasks))
+	for _, task := range tasks {
+		found[task.ID] = task
+	}
+
+	resp := BatchGetResp{
+		Tasks:    make([]model.AsyncTask, 0, len(found)),
+		NotFound: make([]string, 0),
+	}
+	for _, id := range ids {
+		if task, ok := found[id]; ok {
+			resp.Tasks = append(resp.Tasks, task)
+		} else {
+			resp.NotFound = append(resp.NotFound, id)
+		}
+	}
+
+	jsoned, err := json.Marshal(resp)
+	if err != nil {
+		errored(writer, r, err.Error())
+		return
+	}
+
+	_, err = writer.Write(jsoned)
+	if err != nil {
+		requestLog(r).Error(err.Error())
+	}
+}
+
+// makeETag builds a strong entity tag for a task from the last time it changed. updated_at moves forward on every
+// change to the task, so two versions of a task never share one.
+func makeETag(updatedAt time.Time) string {
+	return fmt.Sprintf(`"%d"`, updatedAt.UnixMicro())
+}
+
+// notModified reports whether a conditional GET's validators show the client already has the current task. As HTTP
+// requires, If-Modified-Since is ignored when If-None-Match is sent. Last-Modified only has whole seconds, so the
+// comparison drops the fraction.
+func notModified(r *http.Request, etag string, updatedAt time.Time) bool {
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		return etagMatches(ifNoneMatch, etag, false)
+	}
+
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+
+	return !updatedAt.Truncate(time.Second).After(since)
+}
+
+// etagMatches reports whether an If-None-Match/If-Match header value matches an entity tag. If-None-Match uses weak
+// comparison, but If-Match has to use strong comparison, under which a weak tag never matches.
+func etagMatches(header string, etag string, strong bool) bool {
+	if header == "" {
+		return false
+	}
+
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" {
+			return true
+		}
+		if strong {
+			if candidate == etag && !strings.HasPrefix(etag, "W/") {
+				return true
+			}
+		} else if strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (a *AsyncTasksApp) DeleteByIdRequest(writer http.ResponseWriter, r *http.Request) {
+	var (
+		id  string
+		ok  bool
+		v   = mux.Vars(r)
+		ctx = r.Context()
+	)
+
+	if id, ok = v["id"]; !ok {
+		badRequest(writer, r, "No ID in URL")
+		return
+	}
+
+	err := a.db.InTx(ctx, nil, func(tx *database.DBTx) error {
+		if _, err := tx.GetTask(ctx, id, true); err != nil {
+			return err
+		}
+
+		// the task is locked now, so it can't change between checking If-Match and deleting it
+		if ifMatch := r.Header.Get("If-Match"); ifMatch != "" {
+			updatedAt, err := tx.GetTaskUpdatedAt(ctx, id)
+			if err != nil {
+				return err
+			}
+
+			if !etagMatches(ifMatch, makeETag(updatedAt), true) {
+				return respondWith(preconditionFailed, fmt.Sprintf("task %s has changed since %s", id, ifMatch))
+			}
+		}
+
+		return tx.DeleteTask(ctx, id)
+	})
+	if err != nil {
+		txErrored(writer, r, err)
+		return
+	}
+	taskEvents.WithLabelValues("deleted").Inc()
+}
+
+func (a *AsyncTasksApp) UpdateTaskRequest(writer http.ResponseWriter, r *http.Request) {
+	var (
+		id      string
+		ok      bool
+		replace bool
+		rawtask model.AsyncTask
+		v       = mux.Vars(r)
+		q       = r.URL.Query()
+		ctx     = r.Context()
+	)
+
+	if id, ok = v["id"]; !ok {
+		badRequest(writer, r, "No ID in URL")
+		return
+	}
+
+	if q.Get("replace") != "" {
+		var err error
+		if replace, err = strconv.ParseBool(q.Get("replace")); err != nil {
+			badRequest(writer, r, fmt.Sprintf("replace must be a boolean, got '%s'", q.Get("replace")))
+			return
+		}
+	}
+
+	if replace && isMergePatch(r) {
+		badRequest(writer, r, fmt.Sprintf("replace can't be used with %s bodies", mergePatchContentType))
+		return
+	}
+
+	body, err := a.readBody(writer, r, jsonContentType, mergePatchContentType)
+	if err != nil {
+		bodyErrored(writer, r, err)
+		return
+	}
+	if err := json.Unmarshal(body, &rawtask); err != nil {
+		badRequest(writer, r, err.Error())
+		return
+	}
+
+	// the type is only changed when the body has one, but an explicitly blank one is a mistake
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		badRequest(writer, r, err.Error())
+		return
+	}
+	_, changeType := fields["type"]
+	if changeType && rawtask.Type == "" {
+		badRequest(writer, r, "type must not be blank")
+		return
+	}
+
+	var patch interface{}
+	rawData, hasData := fields["data"]
+	if isMergePatch(r) && hasData {
+		if err := json.Unmarshal(rawData, &patch); err != nil {
+			badRequest(writer, r, err.Error())
+			return
+		}
+	}
+
+	var task *model.AsyncTask
+	err = a.db.InTx(ctx, nil, func(tx *database.DBTx) error {
+		current, err := tx.GetTask(ctx, id, true)
+		if err != nil {
+			return err
+		}
+
+		// behavior processors find their lock tasks by type, so those can't be moved in or out of it
+		if changeType && (strings.HasPrefix(current.Type, database.BehaviorProcessorTypePrefix) || strings.HasPrefix(rawtask.Type, database.BehaviorProcessorTypePrefix)) {
+			return respondWith(badRequest, fmt.Sprintf("the type of %s* tasks is managed internally and can't be changed", database.BehaviorProcessorTypePrefix))
+		}
+
+		// a merge patch merges nested objects too and removes keys set to null; otherwise the data is shallowly
+		// merged unless asked to replace the whole thing. A body without data, such as one that only changes the
+		// type, leaves the data as it is even with replace.
+		data := rawtask.Data
+		if isMergePatch(r) {
+			data = current.Data
+			if hasData {
+				switch patched := mergePatch(current.Data, patch).(type) {
+				case map[string]interface{}:
+					data = patched
+				case nil:
+					data = make(map[string]interface{})
+				default:
+					return respondWith(badRequest, "data must be an object or null")
+				}
+			}
+		} else if !replace || !hasData {
+			data = make(map[string]interface{})
+			for key, value := range current.Data {
+				data[key] = value
+			}
+			for key, value := range rawtask.Data {
+				data[key] = value
+			}
+		}
+
+		if changeType && rawtask.Type != current.Type {
+			// the data has to suit the schema of the type it ends up with
+			if err := a.validateTaskData(model.AsyncTask{Type: rawtask.Type, Data: data}); err != nil {
+				return respondWith(badRequest, err.Error())
+			}
+
+			if err = tx.UpdateTaskType(ctx, id, rawtask.Type); err != nil {
+				return err
+			}
+		}
+
+		if err = tx.UpdateTaskData(ctx, id, data); err != nil {
+			return err
+		}
+
+		task, err = tx.GetTask(ctx, id, false)
+		return err
+	})
+	if err != nil {
+		txErrored(writer, r, err)
+		return
+	}
+
+	jsoned, err := json.Marshal(task)
+	if err != nil {
+		errored(writer, r, err.Error())
+		return
+	}
+
+	_, err = writer.Write(jsoned)
+	if err != nil {
+		requestLog(r).Error(err.Error())
+	}
+}
+
+// filterDateLayouts are the formats accepted for date filters, tried in order. RFC3339Nano also accepts RFC3339 dates
+// without fractional seconds.
+var filterDateLayouts = []string{time.RFC3339Nano, time.DateOnly}
+
+// parseFilterDate parses the value of a date filter parameter. Date-only values are taken as midnight UTC.
+func parseFilterDate(param string, value string) (time.Time, error) {
+	// an unescaped + in a query string decodes to a space, which turns an offset like +02:00 into " 02:00"
+	value = strings.Replace(value, " ", "+", 1)
+
+	for _, layout := range filterDateLayouts {
+		if parsed, err := time.Parse(layout, value); err == nil {
+			return parsed, nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("%s must be a date such as 2006-01-02 or 2006-01-02T15:04:05Z (RFC 3339), got '%s'", param, value)
+}
+
+// parseFilterRange parses the value of a date range parameter, two dates separated by a comma, checking that the range
+// doesn't end before it starts
+func parseFilterRange(param string, value string) (time.Time, time.Time, error) {
+	fromValue, toValue, ok := strings.Cut(value, ",")
+	if !ok || strings.Contains(toValue, ",") {
+		return time.Time{}, time.Time{}, fmt.Errorf("%s must be two dates separated by a comma, such as 2006-01-02,2006-02-01, got '%s'", param, value)
+	}
+
+	from, err := parseFilterDate(param, fromValue)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+
+	to, err := parseFilterDate(param, toValue)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+
+	if to.Before(from) {
+		return time.Time{}, time.Time{}, fmt.Errorf("%s must not end before it starts, got '%s'", param, value)
+	}
+
+	return from, to, nil
+}
+
+// parseTaskFilter builds a TaskFilter from the filtering query parameters shared by the task listing endpoints. Any
+// error returned is the client's fault.
+func parseTaskFilter(v url.Values) (database.TaskFilter, error) {
+	var (
+		filters = database.TaskFilter{
+			IDs:              v["id"],
+			Types:            v["type"],
+			Statuses:         v["status"],
+			EverStatuses:     v["ever_status"],
+			BehaviorTypes:    v["behavior_types"],
+			Usernames:        v["username"],
+			ExcludeUsernames: v["exclude_username"],
+			Sources:          v["source"],
+		}
+		start_date_since  = v["start_date_since"]
+		start_date_before = v["start_date_before"]
+		end_date_since    = v["end_date_since"]
+		end_date_before   = v["end_date_before"]
+		started_between   = v.Get("started_between")
+		ended_between     = v.Get("ended_between")
+		null_end          = v["include_null_end"]
+		completed         = v.Get("completed")
+		claimed           = v.Get("claimed")
+		exclude_internal  = v.Get("exclude_internal")
+	)
+
+	if len(null_end) > 0 {
+		filters.IncludeNullEnd = true
+	}
+
+	// IDs are compared as UUIDs so the primary key can be used, which the database refuses to do for malformed ones
+	for _, id := range filters.IDs {
+		if !uuidRegexp.MatchString(id) {
+			return filters, fmt.Errorf("invalid task ID format: %s", id)
+		}
+	}
+
+	// tags are given as key:value, and a task has to have all of them to match
+	for _, tag := range v["tag"] {
+		key, value, ok := strings.Cut(tag, ":")
+		if !ok || key == "" {
+			return filters, fmt.Errorf("tag must be given as key:value, got '%s'", tag)
+		}
+		if existing, ok := filters.Tags[key]; ok && existing != value {
+			return filters, fmt.Errorf("tag '%s' can't be required to have more than one value", key)
+		}
+		if filters.Tags == nil {
+			filters.Tags = make(map[string]string)
+		}
+		filters.Tags[key] = value
+	}
+
+	for param := range v {
+		if key, ok := strings.CutPrefix(param, "data."); ok && key != "" {
+			if filters.DataFilters == nil {
+				filters.DataFilters = make(map[string]string)
+			}
+			filters.DataFilters[key] = v.Get(param)
+		}
+	}
+
+	if completed != "" {
+		parsed, err := strconv.ParseBool(completed)
+		if err != nil {
+			return filters, fmt.Errorf("completed must be a boolean, got '%s'", completed)
+		}
+		filters.Completed = &parsed
+	}
+
+	if claimed != "" {
+		parsed, err := strconv.ParseBool(claimed)
+		if err != nil {
+			return filters, fmt.Errorf("claimed must be a boolean, got '%s'", claimed)
+		}
+		filters.Claimed = &parsed
+	}
+
+	// the updater's lock tasks are noise in listings and counts, unless they're asked for by type
+	filters.ExcludeInternal = true
+	for _, taskType := range filters.Types {
+		if strings.HasPrefix(taskType, database.BehaviorProcessorTypePrefix) {
+			filters.ExcludeInternal = false
+		}
+	}
+	if exclude_internal != "" {
+		parsed, err := strconv.ParseBool(exclude_internal)
+		if err != nil {
+			return filters, fmt.Errorf("exclude_internal must be a boolean, got '%s'", exclude_internal)
+		}
+		filters.ExcludeInternal = parsed
+	}
+
+	for _, startdate := range start_date_since {
+		parsed, err := parseFilterDate("start_date_since", startdate)
+		if err != nil {
+			return filters, err
+		}
+		filters.StartDateSince = append(filters.StartDateSince, parsed)
+	}
+
+	for _, startdate := range start_date_before {
+		parsed, err := parseFilterDate("start_date_before", startdate)
+		if err != nil {
+			return filters, err
+		}
+		filters.StartDateBefore = append(filters.StartDateBefore, parsed)
+	}
+
+	for _, enddate := range end_date_since {
+		parsed, err := parseFilterDate("end_date_since", enddate)
+		if err != nil {
+			return filters, err
+		}
+		filters.EndDateSince = append(filters.EndDateSince, parsed)
+	}
+
+	for _, enddate := range end_date_before {
+		parsed, err := parseFilterDate("end_date_before", enddate)
+		if err != nil {
+			return filters, err
+		}
+		filters.EndDateBefore = append(filters.EndDateBefore, parsed)
+	}
+
+	// the ranges are shorthand for a pair of the individual date filters, which only support one value each
+	if started_between != "" {
+		if len(filters.StartDateSince) > 0 || len(filters.StartDateBefore) > 0 {
+			return filters, errors.New("started_between can't be combined with start_date_since or start_date_before")
+		}
+		from, to, err := parseFilterRange("started_between", started_between)
+		if err != nil {
+			return filters, err
+		}
+		filters.StartDateSince = []time.Time{from}
+		filters.StartDateBefore = []time.Time{to}
+	}
+
+	if ended_between != "" {
+		if len(filters.EndDateSince) > 0 || len(filters.EndDateBefore) > 0 {
+			return filters, errors.New("ended_between can't be combined with end_date_since or end_date_before")
+		}
+		from, to, err := parseFilterRange("ended_between", ended_between)
+		if err != nil {
+			return filters, err
+		}
+		filters.EndDateSince = []time.Time{from}
+		filters.EndDateBefore = []time.Time{to}
+	}
+
+	return filters, nil
+}
+
+// ListMeta describes a page of tasks in an enveloped GET /tasks response
+type ListMeta struct {
+	Total      int64      `json:"total"`
+	Limit      uint64     `json:"limit"`
+	Offset     uint64     `json:"offset"`
+	Sort       string     `json:"sort"`
+	Order      string     `json:"order"`
+	Filters    url.Values `json:"filters"`
+	NextCursor string     `json:"next_cursor,omitempty"`
+}
+
+// ListEnvelope is the GET /tasks response body with ?envelope=true
+type ListEnvelope struct {
+	Meta ListMeta    `json:"meta"`
+	Data interface{} `json:"data"`
+}
+
+// appliedFilters picks out the filtering query parameters of a listing, to echo them back to the client
+func appliedFilters(v url.Values) url.Values {
+	known := make(map[string]bool, len(taskFilterParams))
+	for _, param := range taskFilterParams {
+		known[param] = true
+	}
+
+	applied := url.Values{}
+	for param, values := range v {
+		if known[param] || strings.HasPrefix(param, "data.") {
+			applied[param] = values
+		}
+	}
+	return applied
+}
+
+func (a *AsyncTasksApp) GetByFilterRequest(writer http.ResponseWriter, r *http.Request) {
+	var (
+		v = r.URL.Query()
+
+		sort   = v.Get("sort")
+		order  = v.Get("order")
+		limit  = v.Get("limit")
+		offset = v.Get("offset")
+
+		after   = v.Get("after")
+		afterID = v.Get("after_id")
+
+		envelope bool
+
+		ctx = r.Context()
+	)
+
+	if err := a.checkParams(v, listingParams...); err != nil {
+		badRequest(writer, r, err.Error())
+		return
+	}
+
+	if v.Get("envelope") != "" {
+		var err error
+		if envelope, err = strconv.ParseBool(v.Get("envelope")); err != nil {
+			badRequest(writer, r, fmt.Sprintf("envelope must be a boolean, got '%s'", v.Get("envelope")))
+			return
+		}
+	}
+
+	filters, err := parseTaskFilter(v)
+	if err != nil {
+		badRequest(writer, r, err.Error())
+		return
+	}
+
+	fields, err := parseFields(v)
+	if err != nil {
+		badRequest(writer, r, err.Error())
+		return
+	}
+
+	if sort == "" {
+		sort = "start_date"
+	}
+	sortColumn, ok := sortFields[sort]
+	if !ok {
+		badRequest(writer, r, fmt.Sprintf("sort must be one of start_date, end_date, type, or username, got '%s'", sort))
+		return
+	}
+
+	// a cursor only makes sense in the order it pages through, so it's also the default order when one is given
+	keyset := after != "" || afterID != ""
+	if keyset && order == "" {
+		order = "asc"
+	}
+
+	var sortDirection string
+	switch strings.ToLower(order) {
+	case "", "desc":
+		sortDirection = "DESC"
+	case "asc":
+		sortDirection = "ASC"
+	default:
+		badRequest(writer, r, fmt.Sprintf("order must be 'asc' or 'desc', got '%s'", order))
+		return
+	}
+
+	filters.Limit = defaultFilterLimit
+	if limit != "" {
+		parsed, err := strconv.ParseUint(limit, 10, 64)
+		if err != nil || parsed == 0 {
+			badRequest(writer, r, fmt.Sprintf("limit must be a positive integer, got '%s'", limit))
+			return
+		}
+		filters.Limit = parsed
+	}
+	if a.config.MaxFilterLimit > 0 && filters.Limit > a.config.MaxFilterLimit {
+		filters.Limit = a.config.MaxFilterLimit
+	}
+
+	if offset != "" {
+		parsed, err := strconv.ParseUint(offset, 10, 64)
+		if err != nil {
+			badRequest(writer, r, fmt.Sprintf("offset must be a non-negative integer, got '%s'", offset))
+			return
+		}
+		filters.Offset = parsed
+	}
+
+	if keyset {
+		if after == "" {
+			badRequest(writer, r, "after_id may only be used along with after")
+			return
+		}
+		if sortColumn != "start_date" || sortDirection != "ASC" {
+			badRequest(writer, r, "after and after_id may only be used with sort=start_date and order=asc")
+			return
+		}
+		if filters.Offset > 0 {
+			badRequest(writer, r, "offset may not be combined with after and after_id")
+			return
+		}
+
+		parsed, err := parseFilterDate("after", after)
+		if err != nil {
+			badRequest(writer, r, err.Error())
+			return
+		}
+		filters.AfterStartDate = &parsed
+
+		if afterID != "" {
+			if _, err := uuid.Parse(afterID); err != nil {
+				badRequest(writer, r, fmt.Sprintf("after_id must be a task ID, got '%s'", afterID))
+				return
+			}
+			filters.AfterID = afterID
+		}
+	}
+
+	// statuses and behaviors are left out unless asked for, since list views rarely need them
+	for _, include := range v["include"] {
+		for _, field := range strings.Split(include, ",") {
+			switch strings.TrimSpace(field) {
+			case "statuses":
+				filters.IncludeStatuses = true
+			case "behaviors":
+				filters.IncludeBehaviors = true
+			case "":
+			default:
+				badRequest(writer, r, fmt.Sprintf("include may only list statuses and behaviors, got '%s'", field))
+				return
+			}
+		}
+	}
+
+	// order by ID as well so paging is stable when the sort column has duplicates
+	orderBy := fmt.Sprintf("%s %s, async_tasks.id ASC", sortColumn, sortDirection)
+
+	wantCSV := wantsCSV(r)
+	wantNDJSON := !wantCSV && wantsNDJSON(r)
+	if wantCSV {
+		// the latest status column needs each task's statuses
+		filters.IncludeStatuses = true
+	}
+
+	var (
+		total  int64
+		tasks  []model.AsyncTask
+		stream *streamWriter
+	)
+	err = a.readInTx(ctx, func(tx *database.DBTx) error {
+		var err error
+		if total, err = tx.CountTasksByFilter(ctx, filters); err != nil {
+			return err
+		}
+		writer.Header().Set("X-Total-Count", strconv.FormatInt(total, 10))
+
+		if !wantCSV && !wantNDJSON {
+			tasks, err = tx.GetTasksByFilter(ctx, filters, orderBy)
+			return err
+		}
+
+		if wantCSV {
+			stream = newStreamWriter(writer, csvContentType+"; charset=utf-8")
+			stream.header.Set("Content-Disposition", `attachment; filename="tasks.csv"`)
+			csvWriter := csv.NewWriter(stream)
+
+			// the header row stays buffered in the CSV writer, so a query that fails at once can still get a 500
+			err = csvWriter.Write(csvColumns)
+			if err == nil {
+				err = tx.EachTaskByFilter(ctx, filters, orderBy, func(task *model.AsyncTask) error {
+					record, err := taskCSVRecord(task)
+					if err != nil {
+						return err
+					}
+					return csvWriter.Write(record)
+				})
+			}
+			if err == nil {
+				csvWriter.Flush()
+				err = csvWriter.Error()
+			}
+		} else {
+			stream = newStreamWriter(writer, ndjsonContentType)
+			encoder := json.NewEncoder(stream)
+
+			err = tx.EachTaskByFilter(ctx, filters, orderBy, func(task *model.AsyncTask) error {
+				selected, err := selectTaskFields(task, fields)
+				if err != nil {
+					return err
+				}
+				return encoder.Encode(selected)
+			})
+		}
+		if stream.started {
+			// the rows already sent can't be taken back, so the transaction can't be run again
+			return database.NotRetryable(err)
+		}
+		return err
+	})
+	if stream != nil && stream.started {
+		if err != nil {
+			// the status has already gone out, so aborting the connection is the only way left to tell the client the
+			// response is incomplete
+			requestLog(r).Errorf("failed partway through a streamed listing: %s", err)
+			panic(http.ErrAbortHandler)
+		}
+		return
+	}
+	if err != nil {
+		errored(writer, r, err.Error())
+		return
+	}
+	if stream != nil {
+		// nothing matched, so the stream has no rows to start it
+		stream.start()
+		return
+	}
+
+	// a full page in cursor order may have more after it, so hand back the cursor for the next one
+	var nextCursor string
+	if sortColumn == "start_date" && sortDirection == "ASC" && len(tasks) > 0 && uint64(len(tasks)) == filters.Limit {
+		last := tasks[len(tasks)-1]
+		if last.StartDate != nil {
+			cursor := url.Values{
+				"after":    []string{last.StartDate.Format(time.RFC3339Nano)},
+				"after_id": []string{last.ID},
+			}
+			nextCursor = cursor.Encode()
+			writer.Header().Set("X-Next-Cursor", nextCursor)
+		}
+	}
+
+	var selected interface{} = tasks
+	if fields != nil {
+		narrowed := make([]interface{}, 0, len(tasks))
+		for i := range tasks {
+			task, err := selectTaskFields(&tasks[i], fields)
+			if err != nil {
+				errored(writer, r, err.Error())
+				return
+			}
+			narrowed = append(narrowed, task)
+		}
+		selected = narrowed
+	}
+
+	if envelope {
+		if tasks == nil {
+			selected = []model.AsyncTask{}
+		}
+		selected = ListEnvelope{
+			Meta: ListMeta{
+				Total:      total,
+				Limit:      filters.Limit,
+				Offset:     filters.Offset,
+				Sort:       sort,
+				Order:      strings.ToLower(sortDirection),
+				Filters:    appliedFilters(v),
+				NextCursor: nextCursor,
+			},
+			Data: selected,
+		}
+	}
+
+	jsoned, err := json.Marshal(selected)
+	if err != nil {
+		errored(writer, r, err.Error())
+		return
+	}
+
+	_, err = writer.Write(jsoned)
+	if err != nil {
+		requestLog(r).Error(err.Error())
+	}
+}
+
+// CountResp is the response body for GET /tasks/count
+type CountResp struct {
+	Count int64 `json:"count"`
+}
+
+func (a *AsyncTasksApp) CountByFilterRequest(writer http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	if err := a.checkParams(r.URL.Query()); err != nil {
+		badRequest(writer, r, err.Error())
+		return
+	}
+
+	filters, err := parseTaskFilter(r.URL.Query())
+	if err != nil {
+		badRequest(writer, r, err.Error())
+		return
+	}
+
+	var count int64
+	err = a.readInTx(ctx, func(tx *database.DBTx) error {
+		var err error
+		count, err = tx.CountTasksByFilter(ctx, filters)
+		return err
+	})
+	if err != nil {
+		errored(writer, r, err.Error())
+		return
+	}
+
+	jsoned, err := json.Marshal(CountResp{Count: count})
+	if err != nil {
+		errored(writer, r, err.Error())
+		return
+	}
+
+	_, err = writer.Write(jsoned)
+	if err != nil {
+		requestLog(r).Error(err.Error())
+	}
+}
+
+func (a *AsyncTasksApp) StatsByFilterRequest(writer http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	if err := a.checkParams(r.URL.Query()); err != nil {
+		badRequest(writer, r, err.Error())
+		return
+	}
+
+	filters, err := parseTaskFilter(r.URL.Query())
+	if err != nil {
+		badRequest(writer, r, err.Error())
+		return
+	}
+
+	var counts map[string]int64
+	err = a.readInTx(ctx, func(tx *database.DBTx) error {
+		var err error
+		counts, err = tx.CountTasksByLatestStatus(ctx, filters)
+		return err
+	})
+	if err != nil {
+		errored(writer, r, err.Error())
+		return
+	}
+
+	jsoned, err := json.Marshal(counts)
+	if err != nil {
+		errored(writer, r, err.Error())
+		return
+	}
+
+	_, err = writer.Write(jsoned)
+	if err != nil {
+		requestLog(r).Error(err.Error())
+	}
+}
+
+// BulkDeleteResp is the response body for POST /tasks/bulk-delete
+type BulkDeleteResp struct {
+	Deleted  int      `json:"deleted"`
+	NotFound []string `json:"not_found"`
+}
+
+// BulkDeleteRequest deletes the tasks whose IDs are posted as a JSON array, all in one transaction, and lists the IDs
+// that don't exist. It takes at most as many IDs as a listing may return, to keep the statement a reasonable size.
+func (a *AsyncTasksApp) BulkDeleteRequest(writer http.ResponseWriter, r *http.Request) {
+	var (
+		requested []string
+		ctx       = r.Context()
+	)
+
+	body, err := a.readBody(writer, r)
+	if err != nil {
+		bodyErrored(writer, r, err)
+		return
+	}
+	if err = json.Unmarshal(body, &requested); err != nil {
+		badRequest(writer, r, err.Error())
+		return
+	}
+
+	if len(requested) == 0 {
+		badRequest(writer, r, "the body must list at least one task ID")
+		return
+	}
+	if a.config.MaxFilterLimit > 0 && uint64(len(requested)) > a.config.MaxFilterLimit {
+		badRequest(writer, r, fmt.Sprintf("at most %d tasks may be deleted at once, got %d", a.config.MaxFilterLimit, len(requested)))
+		return
+	}
+
+	ids := make([]string, 0, len(requested))
+	seen := make(map[string]bool)
+	for _, id := range requested {
+		if !uuidRegexp.MatchString(id) {
+			badRequest(writer, r, fmt.Sprintf("invalid task ID format: %s", id))
+			return
+		}
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+
+	var deleted []string
+	err = a.db.InTx(ctx, nil, func(tx *database.DBTx) error {
+		var err error
+		deleted, err = tx.DeleteTasks(ctx, ids)
+		return err
+	})
+	if err != nil {
+		errored(writer, r, err.Error())
+		return
+	}
+
+	taskEvents.WithLabelValues("deleted").Add(float64(len(deleted)))
+	requestLog(r).Infof("Bulk deleted %d of %d tasks", len(deleted), len(ids))
+
+	wasDeleted := make(map[string]bool, len(deleted))
+	for _, id := range deleted {
+		wasDeleted[id] = true
+	}
+
+	resp := BulkDeleteResp{Deleted: len(deleted), NotFound: make([]string, 0)}
+	for _, id := range ids {
+		if !wasDeleted[id] {
+			resp.NotFound = append(resp.NotFound, id)
+		}
+	}
+
+	jsoned, err := json.Marshal(resp)
+	if err != nil {
+		errored(writer, r, err.Error())
+		return
+	}
+
+	_, err = writer.Write(jsoned)
+	if err != nil {
+		requestLog(r).Error(err.Error())
+	}
+}
+
+// PurgeResp is the response body for POST /tasks/purge
+type PurgeResp struct {
+	Deleted int64 `json:"deleted"`
+}
+
+// PurgeTasksRequest deletes every completed task matching the same filters as GET /tasks. It's meant for operators
+// trimming the table, so it insists on an end_date_before bound and confirm=true rather than risk deleting everything.
+func (a *AsyncTasksApp) PurgeTasksRequest(writer http.ResponseWriter, r *http.Request) {
+	var (
+		v   = r.URL.Query()
+		ctx = r.Context()
+	)
+
+	if confirmed, _ := strconv.ParseBool(v.Get("confirm")); !confirmed {
+		badRequest(writer, r, "purging tasks requires confirm=true")
+		return
+	}
+
+	// a misspelled filter here would delete more than intended, so purges are always strict
+	if unknown := unknownParams(v, []string{"confirm"}); len(unknown) > 0 {
+		badRequest(writer, r, fmt.Sprintf("unknown query parameters: %s", strings.Join(unknown, ", ")))
+		return
+	}
+
+	filters, err := parseTaskFilter(v)
+	if err != nil {
+		badRequest(writer, r, err.Error())
+		return
+	}
+
+	if len(filters.EndDateBefore) == 0 {
+		badRequest(writer, r, "purging tasks requires an end_date_before filter")
+		return
+	}
+
+	// only completed tasks are purged, even if include_null_end or completed=false says otherwise
+	completed := true
+	filters.Completed = &completed
+	filters.IncludeNullEnd = false
+
+	var deleted int64
+	err = a.db.InTx(ctx, nil, func(tx *database.DBTx) error {
+		var err error
+		deleted, err = tx.DeleteTasksByFilter(ctx, filters)
+		return err
+	})
+	if err != nil {
+		errored(writer, r, err.Error())
+		return
+	}
+
+	taskEvents.WithLabelValues("deleted").Add(float64(deleted))
+	requestLog(r).Infof("Purged %d tasks", deleted)
+
+	jsoned, err := json.Marshal(PurgeResp{Deleted: deleted})
+	if err != nil {
+		errored(writer, r, err.Error())
+		return
+	}
+
+	_, err = writer.Write(jsoned)
+	if err != nil {
+		requestLog(r).Error(err.Error())
+	}
+}
+
+// getTaskTypes returns the distinct task types, optionally for a single user, from the cache if it's fresh enough
+func (a *AsyncTasksApp) getTaskTypes(ctx context.Context, username string) ([]string, error) {
+	a.taskTypesMu.Lock()
+	cached, ok := a.taskTypes[username]
+	a.taskTypesMu.Unlock()
+
+	now := time.Now()
+	if ok && now.Before(cached.expires) {
+		return cached.types, nil
+	}
+
+	var types []string
+	err := a.db.InTx(ctx, nil, func(tx *database.DBTx) error {
+		var err error
+		types, err = tx.GetTaskTypes(ctx, username)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	a.taskTypesMu.Lock()
+	defer a.taskTypesMu.Unlock()
+
+	// drop stale per-user entries so the cache doesn't grow with every username ever asked about
+	for key, entry := range a.taskTypes {
+		if now.After(entry.expires) {
+			delete(a.taskTypes, key)
+		}
+	}
+	a.taskTypes[username] = cachedTaskTypes{types: types, expires: now.Add(taskTypesCacheTTL)}
+
+	return types, nil
+}
+
+func (a *AsyncTasksApp) GetTaskTypesRequest(writer http.ResponseWriter, r *http.Request) {
+	types, err := a.getTaskTypes(r.Context(), r.URL.Query().Get("username"))
+	if err != nil {
+		errored(writer, r, err.Error())
+		return
+	}
+
+	jsoned, err := json.Marshal(types)
+	if err != nil {
+		errored(writer, r, err.Error())
+		return
+	}
+
+	_, err = writer.Write(jsoned)
+	if err != nil {
+		requestLog(r).Error(err.Error())
+	}
+}
+
+func (a *AsyncTasksApp) CreateTaskRequest(writer http.ResponseWriter, r *http.Request) {
+	var rawtask model.AsyncTask
+	ctx := r.Context()
+
+	body, err := a.readBody(writer, r)
+	if err != nil {
+		bodyErrored(writer, r, err)
+		return
+	}
+	if err := json.Unmarshal(body, &rawtask); err != nil {
+		badRequest(writer, r, err.Error())
+		return
+	}
+
+	// the template may be named in the query string or in the body, but not two different ones
+	var templated struct {
+		Template string `json:"template"`
+	}
+	if err := json.Unmarshal(body, &templated); err != nil {
+		badRequest(writer, r, err.Error())
+		return
+	}
+	templateName := r.URL.Query().Get("template")
+	if templateName != "" && templated.Template != "" && templateName != templated.Template {
+		badRequest(writer, r, fmt.Sprintf("the template parameter '%s' and the body's template '%s' disagree", templateName, templated.Template))
+		return
+	}
+	if templateName == "" {
+		templateName = templated.Template
+	}
+
+	if templateName != "" {
+		template, ok := a.taskTemplates[templateName]
+		if !ok {
+			badRequest(writer, r, fmt.Sprintf("no task template named '%s'", templateName))
+			return
+		}
+		rawtask = applyTemplate(template, rawtask)
+	}
+
+	// a source in the body wins, since the header is often set once for every request a client makes
+	if rawtask.Source == "" {
+		rawtask.Source = r.Header.Get(clientNameHeader)
+	}
+
+	// a task is owned by the user whose credentials created it, who can't create tasks for anyone else
+	if owner := authUsername(r); owner != "" {
+		if rawtask.Username != "" && rawtask.Username != owner {
+			forbidden(writer, r, fmt.Sprintf("tasks can't be created for user '%s' with the credentials of user '%s'", rawtask.Username, owner))
+			return
+		}
+		rawtask.Username = owner
+	}
+
+	var importing bool
+	if q := r.URL.Query().Get("import"); q != "" {
+		if importing, err = strconv.ParseBool(q); err != nil {
+			badRequest(writer, r, fmt.Sprintf("import must be a boolean, got '%s'", q))
+			return
+		}
+	}
+
+	if problems := a.validateNewTask(rawtask, importing); len(problems) > 0 {
+		invalid(writer, r, problems)
+		return
+	}
+
+	var (
+		id   string
+		task *model.AsyncTask
+	)
+	err = a.db.InTx(ctx, nil, func(tx *database.DBTx) error {
+		var err error
+		if id, err = tx.InsertTask(ctx, rawtask); err != nil {
+			return err
+		}
+
+		// read the task back in the same transaction so the response has its generated ID and dates
+		task, err = tx.GetTask(ctx, id, false)
+		return err
+	})
+	if err != nil {
+		dbErrored(writer, r, err)
+		return
+	}
+	taskEvents.WithLabelValues("created").Inc()
+
+	jsoned, err := json.Marshal(task)
+	if err != nil {
+		errored(writer, r, err.Error())
+		return
+	}
+
+	url, _ := a.router.Get("getById").URL("id", id)
+
+	writer.Header().Set("Location", url.EscapedPath())
+	writer.WriteHeader(http.StatusCreated)
+
+	_, err = writer.Write(jsoned)
+	if err != nil {
+		requestLog(r).Error(err.Error())
+	}
+}
+
+func (a *AsyncTasksApp) AddStatusRequest(writer http.ResponseWriter, r *http.Request) {
+	var (
+		id          string
+		complete    bool
+		ok          bool
+		rawstatuses []model.AsyncTaskStatus
+		v           = mux.Vars(r)
+		q           = r.URL.Query()
+		ctx         = r.Context()
+	)
+
+	if id, ok = v["id"]; !ok {
+		badRequest(writer, r, "No ID in URL")
+		return
+	}
+
+	if q.Get("complete") != "" {
+		complete = true
+	}
+
+	body, err := a.readBody(writer, r)
+	if err != nil {
+		bodyErrored(writer, r, err)
+		return
+	}
+	// the body is either a single status or an array of them to add in order
+	if trimmed := bytes.TrimSpace(body); len(trimmed) > 0 && trimmed[0] == '[' {
+		if err := json.Unmarshal(body, &rawstatuses); err != nil {
+			badRequest(writer, r, err.Error())
+			return
+		}
+		if len(rawstatuses) == 0 {
+			badRequest(writer, r, "At least one status must be provided")
+			return
+		}
+	} else {
+		var rawstatus model.AsyncTaskStatus
+		if err := json.Unmarshal(body, &rawstatus); err != nil {
+			badRequest(writer, r, err.Error())
+			return
+		}
+		rawstatuses = []model.AsyncTaskStatus{rawstatus}
+	}
+
+	// check every status before inserting any, so a bad one doesn't leave the rest half-applied
+	for _, rawstatus := range rawstatuses {
+		if err := a.validateStatus(rawstatus); err != nil {
+			badRequest(writer, r, err.Error())
+			return
+		}
+	}
+
+	var task *model.AsyncTask
+	err = a.db.InTx(ctx, nil, func(tx *database.DBTx) error {
+		current, err := tx.GetTask(ctx, id, true)
+		if err != nil {
+			return err
+		}
+
+		// expected_status makes this a compare-and-swap. The task's row is locked above, so no other status can be
+		// added between the check and the insert; an empty expected_status expects the task to have no statuses yet.
+		if q.Has("expected_status") {
+			expected := q.Get("expected_status")
+			latest := current.LatestStatus()
+			if latest == nil && expected != "" {
+				return respondWith(conflict, fmt.Sprintf("task %s has no status, not the expected '%s'", id, expected))
+			}
+			if latest != nil && latest.Status != expected {
+				return respondWith(conflict, fmt.Sprintf("task %s is in status '%s', not the expected '%s'", id, latest.Status, expected))
+			}
+		}
+
+		for _, rawstatus := range rawstatuses {
+			if err = tx.InsertTaskStatus(ctx, rawstatus, id); err != nil {
+				return err
+			}
+		}
+
+		if complete {
+			if err = tx.CompleteTask(ctx, id); err != nil {
+				return err
+			}
+		}
+
+		task, err = tx.GetTask(ctx, id, false)
+		return err
+	})
+	if err != nil {
+		txErrored(writer, r, err)
+		return
+	}
+	if complete {
+		taskEvents.WithLabelValues("completed").Inc()
+	}
+
+	jsoned, err := json.Marshal(task)
+	if err != nil {
+		errored(writer, r, err.Error())
+		return
+	}
+
+	url, _ := a.router.Get("getById").URL("id", id)
+
+	writer.Header().Set("Location", url.EscapedPath())
+	writer.WriteHeader(http.StatusCreated)
+
+	_, err = writer.Write(jsoned)
+	if err != nil {
+		requestLog(r).Error(err.Error())
+	}
+}
+
+func (a *AsyncTasksApp) ReopenTaskRequest(writer http.ResponseWriter, r *http.Request) {
+	var (
+		id        string
+		ok        bool
+		rawstatus *model.AsyncTaskStatus
+		v         = mux.Vars(r)
+		ctx       = r.Context()
+	)
+
+	if id, ok = v["id"]; !ok {
+		badRequest(writer, r, "No ID in URL")
+		return
+	}
+
+	body, err := a.readBody(writer, r)
+	if err != nil {
+		bodyErrored(writer, r, err)
+		return
+	}
+
+	// the body is optional, and if present is a status documenting why the task was reopened
+	if len(bytes.TrimSpace(body)) > 0 {
+		if err := json.Unmarshal(body, &rawstatus); err != nil {
+			badRequest(writer, r, err.Error())
+			return
+		}
+		if err := a.validateStatus(*rawstatus); err != nil {
+			badRequest(writer, r, err.Error())
+			return
+		}
+	}
+
+	var task *model.AsyncTask
+	err = a.db.InTx(ctx, nil, func(tx *database.DBTx) error {
+		if _, err := tx.GetTask(ctx, id, true); err != nil {
+			return err
+		}
+
+		if err := tx.ReopenTask(ctx, id); err != nil {
+			return err
+		}
+
+		if rawstatus != nil {
+			if err := tx.InsertTaskStatus(ctx, *rawstatus, id); err != nil {
+				return err
+			}
+		}
+
+		var err error
+		task, err = tx.GetTask(ctx, id, false)
+		return err
+	})
+	if err != nil {
+		dbErrored(writer, r, err)
+		return
+	}
+
+	jsoned, err := json.Marshal(task)
+	if err != nil {
+		errored(writer, r, err.Error())
+		return
+	}
+
+	_, err = writer.Write(jsoned)
+	if err != nil {
+		requestLog(r).Error(err.Error())
+	}
+}
+
+// ClaimReq is the request body for POST /tasks/{id}/claim and POST /tasks/{id}/release
+type ClaimReq struct {
+	Worker string `json:"worker"`
+
+	// Lease is how long a claim lasts if it isn't renewed or released, such as "10m". Without one the claim lasts
+	// until it's released.
+	Lease string `json:"lease"`
 }
 
-func (a *AsyncTasksApp) InitRoutes() {
-	a.router.NotFoundHandler = http.HandlerFunc(a.NotFound)
-	a.router.HandleFunc("/tasks/{id:[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}}", a.GetByIdRequest).Methods("GET").Name("getById")
-	a.router.HandleFunc("/tasks/{id:[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}}", a.DeleteByIdRequest).Methods("DELETE").Name("deleteById")
-	a.router.HandleFunc("/tasks/{id:[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}}/status", a.AddStatusRequest).Methods("POST").Name("addStatus")
-	a.router.HandleFunc("/tasks/{id:[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}}/behaviors", a.AddBehaviorRequest).Methods("POST").Name("addBehavior")
+// parseClaim reads and checks the worker claiming or releasing a task. Any error returned is the client's fault.
+func parseClaim(body []byte) (ClaimReq, error) {
+	var req ClaimReq
 
-	a.router.HandleFunc("/tasks", a.GetByFilterRequest).Methods("GET").Name("getByFilter")
-	a.router.HandleFunc("/tasks", a.CreateTaskRequest).Methods("POST").Name("createTask")
+	if err := json.Unmarshal(body, &req); err != nil {
+		return req, err
+	}
 
-	a.router.Use(loggingMiddleware)
-}
+	if req.Worker == "" {
+		return req, errors.New("worker must be provided")
+	}
 
-func (a *AsyncTasksApp) NotFound(writer http.ResponseWriter, r *http.Request) {
-	notFound(writer, fmt.Sprintf("no endpoint found at %s %s", r.Method, r.URL.Path))
+	return req, nil
 }
 
-func (a *AsyncTasksApp) GetByIdRequest(writer http.ResponseWriter, r *http.Request) {
+// ClaimTaskRequest marks a task as being worked on by a worker, so workers sharing a queue of tasks don't pick up
+// the same one. It answers 409 if another worker already holds the task. A worker may claim a task it holds again to
+// renew its lease.
+func (a *AsyncTasksApp) ClaimTaskRequest(writer http.ResponseWriter, r *http.Request) {
 	var (
-		id  string
-		ok  bool
-		v   = mux.Vars(r)
-		ctx = r.Context()
+		id    string
+		ok    bool
+		lease time.Duration
+		v     = mux.Vars(r)
+		ctx   = r.Context()
 	)
 
 	if id, ok = v["id"]; !ok {
-		badRequest(writer, "No ID in URL")
+		badRequest(writer, r, "No ID in URL")
 		return
 	}
 
-	tx, err := a.db.BeginTx(ctx, nil)
+	body, err := a.readBody(writer, r)
 	if err != nil {
-		errored(writer, err.Error())
+		bodyErrored(writer, r, err)
 		return
 	}
-	defer tx.Rollback() // nolint:errcheck
 
-	task, err := tx.GetTask(ctx, id, false)
+	req, err := parseClaim(body)
 	if err != nil {
-		errored(writer, err.Error())
+		badRequest(writer, r, err.Error())
 		return
 	}
 
-	if task.ID == "" {
-		notFound(writer, "not found")
+	if req.Lease != "" {
+		lease, err = time.ParseDuration(req.Lease)
+		if err != nil || lease <= 0 {
+			badRequest(writer, r, fmt.Sprintf("lease must be a positive duration such as \"10m\", got '%s'", req.Lease))
+			return
+		}
+	}
+
+	var task *model.AsyncTask
+	err = a.db.InTx(ctx, nil, func(tx *database.DBTx) error {
+		if err := tx.ClaimTask(ctx, id, req.Worker, lease); err != nil {
+			return err
+		}
+
+		var err error
+		task, err = tx.GetTask(ctx, id, false)
+		return err
+	})
+	if err != nil {
+		dbErrored(writer, r, err)
 		return
 	}
 
 	jsoned, err := json.Marshal(task)
 	if err != nil {
-		errored(writer, err.Error())
+		errored(writer, r, err.Error())
 		return
 	}
 
+	requestLog(r).Infof("Task %s claimed by %s", id, req.Worker)
+
 	_, err = writer.Write(jsoned)
 	if err != nil {
-		log.Error(err.Error())
+		requestLog(r).Error(err.Error())
 	}
 }
 
-func (a *AsyncTasksApp) DeleteByIdRequest(writer http.ResponseWriter, r *http.Request) {
+// ReleaseTaskRequest drops a worker's claim on a task so another worker can pick it up. Releasing a task nobody
+// holds succeeds, but releasing one held by another worker answers 409.
+func (a *AsyncTasksApp) ReleaseTaskRequest(writer http.ResponseWriter, r *http.Request) {
 	var (
 		id  string
 		ok  bool
@@ -107,259 +2026,385 @@ func (a *AsyncTasksApp) DeleteByIdRequest(writer http.ResponseWriter, r *http.Re
 	)
 
 	if id, ok = v["id"]; !ok {
-		badRequest(writer, "No ID in URL")
+		badRequest(writer, r, "No ID in URL")
 		return
 	}
 
-	tx, err := a.db.BeginTx(ctx, nil)
+	body, err := a.readBody(writer, r)
 	if err != nil {
-		errored(writer, err.Error())
+		bodyErrored(writer, r, err)
 		return
 	}
-	defer tx.Rollback() // nolint:errcheck
 
-	task, err := tx.GetTask(ctx, id, true)
+	req, err := parseClaim(body)
 	if err != nil {
-		errored(writer, err.Error())
+		badRequest(writer, r, err.Error())
 		return
 	}
 
-	if task.ID == "" {
-		notFound(writer, "not found")
+	var task *model.AsyncTask
+	err = a.db.InTx(ctx, nil, func(tx *database.DBTx) error {
+		if err := tx.ReleaseTask(ctx, id, req.Worker); err != nil {
+			return err
+		}
+
+		var err error
+		task, err = tx.GetTask(ctx, id, false)
+		return err
+	})
+	if err != nil {
+		dbErrored(writer, r, err)
 		return
 	}
 
-	err = tx.DeleteTask(ctx, id)
+	jsoned, err := json.Marshal(task)
 	if err != nil {
-		errored(writer, err.Error())
+		errored(writer, r, err.Error())
 		return
 	}
 
-	err = tx.Commit()
+	requestLog(r).Infof("Task %s released by %s", id, req.Worker)
+
+	_, err = writer.Write(jsoned)
 	if err != nil {
-		log.Error(err.Error())
+		requestLog(r).Error(err.Error())
 	}
 }
 
-func (a *AsyncTasksApp) GetByFilterRequest(writer http.ResponseWriter, r *http.Request) {
+// GetStatusesSinceRequest lists the status changes across all tasks after a point in time, oldest first. A full page
+// comes with an X-Next-Cursor header holding the since and after_id parameters for the next one.
+func (a *AsyncTasksApp) GetStatusesSinceRequest(writer http.ResponseWriter, r *http.Request) {
 	var (
-		v = r.URL.Query()
-
-		filters = database.TaskFilter{
-			IDs:           v["id"],
-			Types:         v["type"],
-			Statuses:      v["status"],
-			BehaviorTypes: v["behavior_types"],
-			Usernames:     v["username"],
-		}
-		start_date_since  = v["start_date_since"]
-		start_date_before = v["start_date_before"]
-		end_date_since    = v["end_date_since"]
-		end_date_before   = v["end_date_before"]
-		null_end          = v["include_null_end"]
-
-		ctx = r.Context()
+		q       = r.URL.Query()
+		afterID = q.Get("after_id")
+		limit   = uint64(defaultFilterLimit)
+		ctx     = r.Context()
 	)
 
-	if len(null_end) > 0 {
-		filters.IncludeNullEnd = true
+	if q.Get("since") == "" {
+		badRequest(writer, r, "since must be provided")
+		return
 	}
 
-	for _, startdate := range start_date_since {
-		parsed, err := time.Parse(time.RFC3339Nano, startdate)
-		if err != nil {
-			errored(writer, err.Error())
-			return
-		}
-		filters.StartDateSince = append(filters.StartDateSince, parsed)
+	since, err := parseFilterDate("since", q.Get("since"))
+	if err != nil {
+		badRequest(writer, r, err.Error())
+		return
 	}
 
-	for _, startdate := range start_date_before {
-		parsed, err := time.Parse(time.RFC3339Nano, startdate)
-		if err != nil {
-			errored(writer, err.Error())
-			return
-		}
-		filters.StartDateBefore = append(filters.StartDateBefore, parsed)
+	if afterID != "" && !uuidRegexp.MatchString(afterID) {
+		badRequest(writer, r, fmt.Sprintf("after_id must be a status ID, got '%s'", afterID))
+		return
 	}
 
-	for _, enddate := range end_date_since {
-		parsed, err := time.Parse(time.RFC3339Nano, enddate)
-		if err != nil {
-			errored(writer, err.Error())
+	if q.Get("limit") != "" {
+		if limit, err = strconv.ParseUint(q.Get("limit"), 10, 64); err != nil || limit == 0 {
+			badRequest(writer, r, fmt.Sprintf("limit must be a positive integer, got '%s'", q.Get("limit")))
 			return
 		}
-		filters.EndDateSince = append(filters.EndDateSince, parsed)
 	}
-
-	for _, enddate := range end_date_before {
-		parsed, err := time.Parse(time.RFC3339Nano, enddate)
-		if err != nil {
-			errored(writer, err.Error())
-			return
-		}
-		filters.EndDateBefore = append(filters.EndDateBefore, parsed)
+	if a.config.MaxFilterLimit > 0 && limit > a.config.MaxFilterLimit {
+		limit = a.config.MaxFilterLimit
 	}
 
-	tx, err := a.db.BeginTx(ctx, nil)
+	var changes []model.AsyncTaskStatusChange
+	err = a.db.InTx(ctx, nil, func(tx *database.DBTx) error {
+		var err error
+		changes, err = tx.GetStatusesSince(ctx, since, afterID, limit)
+		return err
+	})
 	if err != nil {
-		errored(writer, err.Error())
+		errored(writer, r, err.Error())
 		return
 	}
-	defer tx.Rollback() // nolint:errcheck
 
-	tasks, err := tx.GetTasksByFilter(ctx, filters, "")
-	if err != nil {
-		errored(writer, err.Error())
-		return
+	if changes == nil {
+		changes = make([]model.AsyncTaskStatusChange, 0)
+	}
+
+	if uint64(len(changes)) == limit {
+		last := changes[len(changes)-1]
+		cursor := url.Values{
+			"since":    []string{last.CreatedDate.Format(time.RFC3339Nano)},
+			"after_id": []string{last.ID},
+		}
+		writer.Header().Set("X-Next-Cursor", cursor.Encode())
 	}
 
-	jsoned, err := json.Marshal(tasks)
+	jsoned, err := json.Marshal(changes)
 	if err != nil {
-		errored(writer, err.Error())
+		errored(writer, r, err.Error())
 		return
 	}
 
 	_, err = writer.Write(jsoned)
 	if err != nil {
-		log.Error(err.Error())
+		requestLog(r).Error(err.Error())
 	}
 }
 
-func (a *AsyncTasksApp) CreateTaskRequest(writer http.ResponseWriter, r *http.Request) {
-	var rawtask model.AsyncTask
-	ctx := r.Context()
+func (a *AsyncTasksApp) GetStatusesRequest(writer http.ResponseWriter, r *http.Request) {
+	var (
+		id        string
+		ok        bool
+		limit     uint64
+		offset    uint64
+		ascending bool
+		v         = mux.Vars(r)
+		q         = r.URL.Query()
+		ctx       = r.Context()
+	)
 
-	body, err := io.ReadAll(io.LimitReader(r.Body, hundredMiB))
-	if err != nil {
-		errored(writer, err.Error())
-		return
-	}
-	if err := r.Body.Close(); err != nil {
-		errored(writer, err.Error())
+	if id, ok = v["id"]; !ok {
+		badRequest(writer, r, "No ID in URL")
 		return
 	}
-	if err := json.Unmarshal(body, &rawtask); err != nil {
-		errored(writer, err.Error())
+
+	switch strings.ToLower(q.Get("order")) {
+	case "", "asc":
+		ascending = true
+	case "desc":
+		ascending = false
+	default:
+		badRequest(writer, r, fmt.Sprintf("order must be 'asc' or 'desc', got '%s'", q.Get("order")))
 		return
 	}
 
-	if rawtask.Type == "" {
-		errored(writer, "Task type must be provided")
-		return
+	if q.Get("limit") != "" {
+		var err error
+		if limit, err = strconv.ParseUint(q.Get("limit"), 10, 64); err != nil || limit == 0 {
+			badRequest(writer, r, fmt.Sprintf("limit must be a positive integer, got '%s'", q.Get("limit")))
+			return
+		}
 	}
 
-	for _, behavior := range rawtask.Behaviors {
-		if behavior.BehaviorType == "" {
-			errored(writer, "All behaviors must have a type")
+	if q.Get("offset") != "" {
+		var err error
+		if offset, err = strconv.ParseUint(q.Get("offset"), 10, 64); err != nil {
+			badRequest(writer, r, fmt.Sprintf("offset must be a non-negative integer, got '%s'", q.Get("offset")))
 			return
 		}
 	}
 
-	if len(rawtask.Statuses) > 1 {
-		errored(writer, "A new task may only include one initial status")
+	var (
+		total    int64
+		statuses []model.AsyncTaskStatus
+	)
+	err := a.db.InTx(ctx, nil, func(tx *database.DBTx) error {
+		exists, err := tx.TaskExists(ctx, id)
+		if err != nil {
+			return err
+		}
+
+		if !exists {
+			return respondWith(notFound, "not found")
+		}
+
+		if total, err = tx.CountTaskStatuses(ctx, id); err != nil {
+			return err
+		}
+
+		statuses, err = tx.GetTaskStatuses(ctx, id, limit, offset, ascending)
+		return err
+	})
+	if err != nil {
+		txErrored(writer, r, err)
 		return
 	}
+	writer.Header().Set("X-Total-Count", strconv.FormatInt(total, 10))
 
-	if len(rawtask.Statuses) > 0 && rawtask.Statuses[0].Status == "" {
-		errored(writer, "A blank status is not allowed")
-		return
+	if statuses == nil {
+		statuses = make([]model.AsyncTaskStatus, 0)
 	}
 
-	tx, err := a.db.BeginTx(ctx, nil)
+	jsoned, err := json.Marshal(statuses)
 	if err != nil {
-		errored(writer, err.Error())
+		errored(writer, r, err.Error())
 		return
 	}
-	defer tx.Rollback() // nolint:errcheck
 
-	id, err := tx.InsertTask(ctx, rawtask)
+	_, err = writer.Write(jsoned)
 	if err != nil {
-		errored(writer, err.Error())
+		requestLog(r).Error(err.Error())
+	}
+}
+
+// DeleteAllStatusesRequest clears a task's status history so it can be rerun in place, keeping its ID, data, and
+// behaviors. With reset_start=true the start date is also set to now, since a task without statuses has its
+// statuschangetimeout timeouts counted from its start date.
+func (a *AsyncTasksApp) DeleteAllStatusesRequest(writer http.ResponseWriter, r *http.Request) {
+	var (
+		id         string
+		ok         bool
+		resetStart bool
+		v          = mux.Vars(r)
+		q          = r.URL.Query()
+		ctx        = r.Context()
+	)
+
+	if id, ok = v["id"]; !ok {
+		badRequest(writer, r, "No ID in URL")
 		return
 	}
 
-	err = tx.Commit()
-	if err != nil {
-		log.Error(err.Error())
+	if q.Get("reset_start") != "" {
+		var err error
+		if resetStart, err = strconv.ParseBool(q.Get("reset_start")); err != nil {
+			badRequest(writer, r, fmt.Sprintf("reset_start must be a boolean, got '%s'", q.Get("reset_start")))
+			return
+		}
 	}
 
-	url, _ := a.router.Get("getById").URL("id", id)
+	var deleted int64
+	err := a.db.InTx(ctx, nil, func(tx *database.DBTx) error {
+		// lock the task without loading the statuses that are about to go
+		_, err := tx.GetTaskSansStatuses(ctx, id, true)
+		if err != nil {
+			return err
+		}
 
-	writer.Header().Set("Location", url.EscapedPath())
-	writer.WriteHeader(http.StatusCreated)
+		if deleted, err = tx.DeleteAllTaskStatuses(ctx, id); err != nil {
+			return err
+		}
+
+		if resetStart {
+			return tx.ResetTaskStartDate(ctx, id)
+		}
+		return nil
+	})
+	if err != nil {
+		dbErrored(writer, r, err)
+		return
+	}
+
+	requestLog(r).Infof("Deleted all %d statuses of task %s", deleted, id)
+	writer.WriteHeader(http.StatusNoContent)
 }
 
-func (a *AsyncTasksApp) AddStatusRequest(writer http.ResponseWriter, r *http.Request) {
+func (a *AsyncTasksApp) DeleteStatusRequest(writer http.ResponseWriter, r *http.Request) {
 	var (
-		id        string
-		complete  bool
-		ok        bool
-		rawstatus model.AsyncTaskStatus
-		v         = mux.Vars(r)
-		q         = r.URL.Query()
-		ctx       = r.Context()
+		id       string
+		statusID string
+		ok       bool
+		v        = mux.Vars(r)
+		ctx      = r.Context()
 	)
 
 	if id, ok = v["id"]; !ok {
-		badRequest(writer, "No ID in URL")
+		badRequest(writer, r, "No ID in URL")
 		return
 	}
 
-	if q.Get("complete") != "" {
-		complete = true
+	if statusID, ok = v["status_id"]; !ok {
+		badRequest(writer, r, "No status ID in URL")
+		return
 	}
 
-	tx, err := a.db.BeginTx(ctx, nil)
+	err := a.db.InTx(ctx, nil, func(tx *database.DBTx) error {
+		if _, err := tx.GetTask(ctx, id, true); err != nil {
+			return err
+		}
+		return tx.DeleteTaskStatus(ctx, id, statusID)
+	})
 	if err != nil {
-		errored(writer, err.Error())
+		dbErrored(writer, r, err)
 		return
 	}
-	defer tx.Rollback() // nolint:errcheck
 
-	task, err := tx.GetTask(ctx, id, true)
-	if err != nil {
-		errored(writer, err.Error())
+	writer.WriteHeader(http.StatusNoContent)
+}
+
+func (a *AsyncTasksApp) GetBehaviorsRequest(writer http.ResponseWriter, r *http.Request) {
+	var (
+		id  string
+		ok  bool
+		v   = mux.Vars(r)
+		ctx = r.Context()
+	)
+
+	if id, ok = v["id"]; !ok {
+		badRequest(writer, r, "No ID in URL")
 		return
 	}
 
-	if task.ID == "" {
-		notFound(writer, "not found")
+	var behaviors []model.AsyncTaskBehavior
+	err := a.db.InTx(ctx, nil, func(tx *database.DBTx) error {
+		exists, err := tx.TaskExists(ctx, id)
+		if err != nil {
+			return err
+		}
+
+		if !exists {
+			return respondWith(notFound, "not found")
+		}
+
+		behaviors, err = tx.GetTaskBehaviors(ctx, id)
+		return err
+	})
+	if err != nil {
+		txErrored(writer, r, err)
 		return
 	}
 
-	body, err := io.ReadAll(io.LimitReader(r.Body, hundredMiB))
+	if behaviors == nil {
+		behaviors = make([]model.AsyncTaskBehavior, 0)
+	}
+
+	jsoned, err := json.Marshal(behaviors)
+	if err != nil {
+		errored(writer, r, err.Error())
+		return
+	}
 
+	_, err = writer.Write(jsoned)
 	if err != nil {
-		errored(writer, err.Error())
+		requestLog(r).Error(err.Error())
+	}
+}
+
+func (a *AsyncTasksApp) AddBehaviorRequest(writer http.ResponseWriter, r *http.Request) {
+	var (
+		id          string
+		ok          bool
+		rawbehavior model.AsyncTaskBehavior
+		v           = mux.Vars(r)
+		ctx         = r.Context()
+	)
+
+	if id, ok = v["id"]; !ok {
+		badRequest(writer, r, "No ID in URL")
 		return
 	}
-	if err := r.Body.Close(); err != nil {
-		errored(writer, err.Error())
+
+	body, err := a.readBody(writer, r)
+	if err != nil {
+		bodyErrored(writer, r, err)
 		return
 	}
-	if err := json.Unmarshal(body, &rawstatus); err != nil {
-		errored(writer, err.Error())
+	if err := json.Unmarshal(body, &rawbehavior); err != nil {
+		badRequest(writer, r, err.Error())
 		return
 	}
 
-	err = tx.InsertTaskStatus(ctx, rawstatus, id)
-	if err != nil {
-		errored(writer, err.Error())
+	if rawbehavior.BehaviorType == "" {
+		badRequest(writer, r, "Behavior type must be provided")
 		return
 	}
 
-	if complete {
-		err = tx.CompleteTask(ctx, id)
-		if err != nil {
-			errored(writer, err.Error())
-			return
-		}
+	if err := a.validateBehavior(rawbehavior); err != nil {
+		badRequest(writer, r, err.Error())
+		return
 	}
 
-	err = tx.Commit()
+	err = a.db.InTx(ctx, nil, func(tx *database.DBTx) error {
+		if _, err := tx.GetTask(ctx, id, true); err != nil {
+			return err
+		}
+		return tx.InsertTaskBehavior(ctx, rawbehavior, id)
+	})
 	if err != nil {
-		log.Error(err.Error())
+		dbErrored(writer, r, err)
+		return
 	}
 
 	url, _ := a.router.Get("getById").URL("id", id)
@@ -368,7 +2413,7 @@ func (a *AsyncTasksApp) AddStatusRequest(writer http.ResponseWriter, r *http.Req
 	writer.WriteHeader(http.StatusCreated)
 }
 
-func (a *AsyncTasksApp) AddBehaviorRequest(writer http.ResponseWriter, r *http.Request) {
+func (a *AsyncTasksApp) UpsertBehaviorRequest(writer http.ResponseWriter, r *http.Request) {
 	var (
 		id          string
 		ok          bool
@@ -378,81 +2423,221 @@ func (a *AsyncTasksApp) AddBehaviorRequest(writer http.ResponseWriter, r *http.R
 	)
 
 	if id, ok = v["id"]; !ok {
-		badRequest(writer, "No ID in URL")
+		badRequest(writer, r, "No ID in URL")
 		return
 	}
 
-	tx, err := a.db.BeginTx(ctx, nil)
+	body, err := a.readBody(writer, r)
 	if err != nil {
-		errored(writer, err.Error())
+		bodyErrored(writer, r, err)
+		return
+	}
+	if err := json.Unmarshal(body, &rawbehavior); err != nil {
+		badRequest(writer, r, err.Error())
 		return
 	}
-	defer tx.Rollback() // nolint:errcheck
 
-	task, err := tx.GetTask(ctx, id, true)
-	if err != nil {
-		errored(writer, err.Error())
+	if rawbehavior.BehaviorType == "" {
+		badRequest(writer, r, "Behavior type must be provided")
 		return
 	}
 
-	if task.ID == "" {
-		notFound(writer, "not found")
+	if err := a.validateBehavior(rawbehavior); err != nil {
+		badRequest(writer, r, err.Error())
 		return
 	}
 
-	body, err := io.ReadAll(io.LimitReader(r.Body, hundredMiB))
+	var behaviors []model.AsyncTaskBehavior
+	err = a.db.InTx(ctx, nil, func(tx *database.DBTx) error {
+		if _, err := tx.GetTask(ctx, id, true); err != nil {
+			return err
+		}
+
+		if err := tx.UpsertTaskBehavior(ctx, rawbehavior, id); err != nil {
+			return err
+		}
 
+		var err error
+		behaviors, err = tx.GetTaskBehaviors(ctx, id)
+		return err
+	})
 	if err != nil {
-		errored(writer, err.Error())
+		dbErrored(writer, r, err)
 		return
 	}
-	if err := r.Body.Close(); err != nil {
-		errored(writer, err.Error())
+
+	jsoned, err := json.Marshal(behaviors)
+	if err != nil {
+		errored(writer, r, err.Error())
 		return
 	}
-	if err := json.Unmarshal(body, &rawbehavior); err != nil {
-		errored(writer, err.Error())
+
+	_, err = writer.Write(jsoned)
+	if err != nil {
+		requestLog(r).Error(err.Error())
+	}
+}
+
+func (a *AsyncTasksApp) DeleteBehaviorRequest(writer http.ResponseWriter, r *http.Request) {
+	var (
+		id           string
+		behaviorType string
+		ok           bool
+		v            = mux.Vars(r)
+		ctx          = r.Context()
+	)
+
+	if id, ok = v["id"]; !ok {
+		badRequest(writer, r, "No ID in URL")
 		return
 	}
 
-	err = tx.InsertTaskBehavior(ctx, rawbehavior, id)
-	if err != nil {
-		errored(writer, err.Error())
+	if behaviorType, ok = v["behavior_type"]; !ok {
+		badRequest(writer, r, "No behavior type in URL")
 		return
 	}
 
-	err = tx.Commit()
+	err := a.db.InTx(ctx, nil, func(tx *database.DBTx) error {
+		if _, err := tx.GetTask(ctx, id, true); err != nil {
+			return err
+		}
+		return tx.DeleteTaskBehavior(ctx, id, behaviorType)
+	})
 	if err != nil {
-		log.Error(err.Error())
+		dbErrored(writer, r, err)
+		return
 	}
 
-	url, _ := a.router.Get("getById").URL("id", id)
-
-	writer.Header().Set("Location", url.EscapedPath())
-	writer.WriteHeader(http.StatusCreated)
+	writer.WriteHeader(http.StatusNoContent)
 }
 
 type ErrorResp struct {
-	Msg string `json:"msg"`
+	Msg       string       `json:"msg"`
+	RequestID string       `json:"request_id,omitempty"`
+	Errors    []FieldError `json:"errors,omitempty"`
 }
 
-func makeErrorJson(msg string) string {
-	err := ErrorResp{Msg: msg}
+// FieldError is one problem with a request body, naming the field it's in, such as behaviors[0].type
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+func makeErrorJson(r *http.Request, msg string) string {
+	err := ErrorResp{Msg: msg, RequestID: requestID(r)}
 	jsoned, _ := json.Marshal(err)
 	return string(jsoned)
 }
 
-func badRequest(writer http.ResponseWriter, msg string) {
-	http.Error(writer, makeErrorJson(msg), http.StatusBadRequest)
-	log.Error(msg)
+func badRequest(writer http.ResponseWriter, r *http.Request, msg string) {
+	http.Error(writer, makeErrorJson(r, msg), http.StatusBadRequest)
+	requestLog(r).Error(msg)
+}
+
+// invalid responds with a 400 listing every problem found with a request body in its errors, along with a msg that
+// sums them up for clients that only read that
+func invalid(writer http.ResponseWriter, r *http.Request, problems []FieldError) {
+	messages := make([]string, 0, len(problems))
+	for _, problem := range problems {
+		messages = append(messages, problem.Message)
+	}
+	msg := strings.Join(messages, "; ")
+
+	jsoned, _ := json.Marshal(ErrorResp{Msg: msg, RequestID: requestID(r), Errors: problems})
+	http.Error(writer, string(jsoned), http.StatusBadRequest)
+	requestLog(r).Error(msg)
+}
+
+func errored(writer http.ResponseWriter, r *http.Request, msg string) {
+	http.Error(writer, makeErrorJson(r, msg), http.StatusInternalServerError)
+	requestLog(r).Error(msg)
+}
+
+func notFound(writer http.ResponseWriter, r *http.Request, msg string) {
+	http.Error(writer, makeErrorJson(r, msg), http.StatusNotFound)
+	requestLog(r).Error(msg)
+}
+
+func conflict(writer http.ResponseWriter, r *http.Request, msg string) {
+	http.Error(writer, makeErrorJson(r, msg), http.StatusConflict)
+	requestLog(r).Error(msg)
+}
+
+// bodyErrored responds to a failure reading a request body, with a 413 if it was too large
+func bodyErrored(writer http.ResponseWriter, r *http.Request, err error) {
+	var mediaTypeErr *unsupportedMediaTypeError
+	if errors.As(err, &mediaTypeErr) {
+		http.Error(writer, makeErrorJson(r, mediaTypeErr.Error()), http.StatusUnsupportedMediaType)
+		requestLog(r).Warn(err.Error())
+		return
+	}
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		http.Error(writer, makeErrorJson(r, fmt.Sprintf("request body is larger than the limit of %d bytes", maxBytesErr.Limit)), http.StatusRequestEntityTooLarge)
+		requestLog(r).Error(err.Error())
+		return
+	}
+	errored(writer, r, err.Error())
+}
+
+// responseError is returned from inside a handler's transaction to roll it back and send a particular error response
+type responseError struct {
+	respond func(writer http.ResponseWriter, r *http.Request, msg string)
+	msg     string
+}
+
+func (e *responseError) Error() string { return e.msg }
+
+// respondWith makes a responseError that answers with one of the error helpers, such as badRequest or conflict
+func respondWith(respond func(writer http.ResponseWriter, r *http.Request, msg string), msg string) error {
+	return &responseError{respond: respond, msg: msg}
+}
+
+// txErrored responds to an error from a handler's transaction, with a responseError's own response or the one matching
+// a database error
+func txErrored(writer http.ResponseWriter, r *http.Request, err error) {
+	var respErr *responseError
+	if errors.As(err, &respErr) {
+		respErr.respond(writer, r, respErr.msg)
+		return
+	}
+	dbErrored(writer, r, err)
+}
+
+// dbErrored responds with the status code matching an error returned by the database package
+func dbErrored(writer http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, database.ErrNotFound):
+		notFound(writer, r, err.Error())
+	case errors.Is(err, database.ErrConflict):
+		conflict(writer, r, err.Error())
+	default:
+		errored(writer, r, err.Error())
+	}
+}
+
+func preconditionFailed(writer http.ResponseWriter, r *http.Request, msg string) {
+	http.Error(writer, makeErrorJson(r, msg), http.StatusPreconditionFailed)
+	requestLog(r).Error(msg)
+}
+
+func forbidden(writer http.ResponseWriter, r *http.Request, msg string) {
+	http.Error(writer, makeErrorJson(r, msg), http.StatusForbidden)
+	requestLog(r).Warn(msg)
+}
+
+func unauthorized(writer http.ResponseWriter, r *http.Request, msg string) {
+	writer.Header().Set("WWW-Authenticate", `Bearer realm="async-tasks"`)
+	http.Error(writer, makeErrorJson(r, msg), http.StatusUnauthorized)
+	requestLog(r).Warn(msg)
 }
 
-func errored(writer http.ResponseWriter, msg string) {
-	http.Error(writer, makeErrorJson(msg), http.StatusInternalServerError)
-	log.Error(msg)
+func tooManyRequests(writer http.ResponseWriter, r *http.Request, msg string) {
+	http.Error(writer, makeErrorJson(r, msg), http.StatusTooManyRequests)
+	requestLog(r).Warn(msg)
 }
 
-func notFound(writer http.ResponseWriter, msg string) {
-	http.Error(writer, makeErrorJson(msg), http.StatusNotFound)
-	log.Error(msg)
+func unavailable(writer http.ResponseWriter, r *http.Request, msg string) {
+	http.Error(writer, makeErrorJson(r, msg), http.StatusServiceUnavailable)
+	requestLog(r).Error(msg)
 }
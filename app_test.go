@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/cyverse-de/async-tasks/model"
+)
+
+// doJSON sends a request with an optional JSON body and decodes the JSON response into out, if it's given, returning
+// the response's status code
+func doJSON(t *testing.T, method, url string, body interface{}, out interface{}) int {
+	t.Helper()
+
+	var reader *bytes.Reader
+	if body == nil {
+		reader = bytes.NewReader(nil)
+	} else {
+		jsoned, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader = bytes.NewReader(jsoned)
+	}
+
+	req, err := http.NewRequest(method, url, reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if out != nil && resp.StatusCode < 300 {
+		if err = json.NewDecoder(resp.Body).Decode(out); err != nil {
+			t.Fatalf("decoding the response to %s %s: %s", method, url, err)
+		}
+	}
+
+	return resp.StatusCode
+}
+
+func TestCreateAndGetTask(t *testing.T) {
+	server, _ := newTestServer(t)
+
+	newTask := map[string]interface{}{
+		"type":     "test",
+		"username": "tester",
+		"data":     map[string]interface{}{"analysis_id": "a1"},
+		"statuses": []map[string]interface{}{{"status": "submitted"}},
+		"behaviors": []map[string]interface{}{{
+			"type": "statuschangetimeout",
+			"data": map[string]interface{}{"statuses": []map[string]interface{}{{"start_status": "submitted", "end_status": "failed", "timeout": "1h"}}},
+		}},
+	}
+
+	var created model.AsyncTask
+	if code := doJSON(t, http.MethodPost, server.URL+"/tasks", newTask, &created); code != http.StatusCreated {
+		t.Fatalf("creating a task returned %d", code)
+	}
+	if created.ID == "" {
+		t.Fatal("the created task has no ID")
+	}
+
+	var fetched model.AsyncTask
+	if code := doJSON(t, http.MethodGet, server.URL+"/tasks/"+created.ID, nil, &fetched); code != http.StatusOK {
+		t.Fatalf("getting the task returned %d", code)
+	}
+
+	if fetched.Type != "test" || fetched.Username != "tester" {
+		t.Errorf("got type '%s' and username '%s', want 'test' and 'tester'", fetched.Type, fetched.Username)
+	}
+	if fetched.Data["analysis_id"] != "a1" {
+		t.Errorf("got data %v, want analysis_id a1", fetched.Data)
+	}
+	if latest := fetched.LatestStatus(); latest == nil || latest.Status != "submitted" {
+		t.Errorf("got latest status %v, want submitted", latest)
+	}
+	if len(fetched.Behaviors) != 1 || fetched.Behaviors[0].BehaviorType != "statuschangetimeout" {
+		t.Errorf("got behaviors %v, want one statuschangetimeout", fetched.Behaviors)
+	}
+}
+
+func TestCreateTaskRejectsBadBehaviorData(t *testing.T) {
+	server, _ := newTestServer(t)
+
+	newTask := map[string]interface{}{
+		"type": "test",
+		"behaviors": []map[string]interface{}{{
+			"type": "statuschangetimeout",
+			"data": map[string]interface{}{"statuses": []map[string]interface{}{{"end_status": "failed", "timeout": "soon"}}},
+		}},
+	}
+
+	if code := doJSON(t, http.MethodPost, server.URL+"/tasks", newTask, nil); code != http.StatusBadRequest {
+		t.Errorf("creating a task with an invalid timeout returned %d, want %d", code, http.StatusBadRequest)
+	}
+}
+
+func TestGetByFilterRequest(t *testing.T) {
+	server, _ := newTestServer(t)
+
+	for _, task := range []map[string]interface{}{
+		{"type": "wanted", "username": "a"},
+		{"type": "wanted", "username": "b"},
+		{"type": "other", "username": "a"},
+	} {
+		if code := doJSON(t, http.MethodPost, server.URL+"/tasks", task, nil); code != http.StatusCreated {
+			t.Fatalf("creating a task returned %d", code)
+		}
+	}
+
+	var tasks []model.AsyncTask
+	if code := doJSON(t, http.MethodGet, server.URL+"/tasks?type=wanted&username=a", nil, &tasks); code != http.StatusOK {
+		t.Fatalf("listing tasks returned %d", code)
+	}
+
+	if len(tasks) != 1 || tasks[0].Type != "wanted" || tasks[0].Username != "a" {
+		t.Errorf("got %v, want only the wanted task of user a", tasks)
+	}
+}
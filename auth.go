@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// authLeeway is how far apart the service's clock and a token issuer's may be before a token's exp or nbf is enforced
+const authLeeway = 30 * time.Second
+
+const authUsernameKey contextKey = "auth_username"
+
+// authExemptPaths can always be reached without credentials, so probes and metrics scrapers don't need any. They're
+// relative to the base path.
+var authExemptPaths = map[string]bool{
+	"/":        true,
+	"/healthz": true,
+	"/version": true,
+	"/metrics": true,
+}
+
+// AuthConfig controls how API requests are authenticated
+type AuthConfig struct {
+	// Mode is "none", which lets anyone in, "token", which requires Token as a bearer token, or "jwt", which requires a
+	// bearer JWT signed with JWTSecret (HS256) or the private half of the RSA key in JWTPublicKeyFile (RS256)
+	Mode  string
+	Token string
+
+	JWTSecret        string
+	JWTPublicKeyFile string
+
+	// JWTIssuer and JWTAudience, if set, must match the token's iss and aud claims
+	JWTIssuer   string
+	JWTAudience string
+
+	// UsernameClaim names the JWT claim holding the caller's username. Every JWT must have it, and the tasks a caller
+	// creates are owned by that user.
+	UsernameClaim string
+}
+
+// authenticator checks the credentials on API requests. A nil authenticator lets every request through.
+type authenticator struct {
+	config    AuthConfig
+	publicKey *rsa.PublicKey
+}
+
+// newAuthenticator checks an AuthConfig and loads its key, returning nil if authentication is turned off
+func newAuthenticator(config AuthConfig) (*authenticator, error) {
+	a := &authenticator{config: config}
+
+	switch config.Mode {
+	case "", "none":
+		return nil, nil
+	case "token":
+		if config.Token == "" {
+			return nil, errors.New("auth.token must be set when auth.mode is 'token'")
+		}
+	case "jwt":
+		if (config.JWTSecret == "") == (config.JWTPublicKeyFile == "") {
+			return nil, errors.New("exactly one of auth.jwt.secret and auth.jwt.public_key_file must be set when auth.mode is 'jwt'")
+		}
+		if config.JWTPublicKeyFile != "" {
+			key, err := loadRSAPublicKey(config.JWTPublicKeyFile)
+			if err != nil {
+				return nil, fmt.Errorf("auth.jwt.public_key_file: %w", err)
+			}
+			a.publicKey = key
+		}
+	default:
+		return nil, fmt.Errorf("auth.mode must be 'none', 'token', or 'jwt', got '%s'", config.Mode)
+	}
+
+	return a, nil
+}
+
+// loadRSAPublicKey reads a PEM-encoded RSA public key, in either PKIX or PKCS #1 form
+func loadRSAPublicKey(path string) (*rsa.PublicKey, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(contents)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+
+	if block.Type == "RSA PUBLIC KEY" {
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	}
+
+	parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("the key is not an RSA key")
+	}
+	return key, nil
+}
+
+// bearerToken pulls the token out of a request's Authorization header
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return "", false
+	}
+	return strings.TrimSpace(token), true
+}
+
+// authenticate checks a request's bearer token, returning the caller's username if the token carries one. Any error
+// returned means the request must be refused.
+func (a *authenticator) authenticate(r *http.Request) (string, error) {
+	token, ok := bearerToken(r)
+	if !ok {
+		return "", errors.New("a bearer token is required")
+	}
+
+	if a.config.Mode == "token" {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(a.config.Token)) != 1 {
+			return "", errors.New("invalid bearer token")
+		}
+		return "", nil
+	}
+
+	claims, err := a.verifyJWT(token, time.Now())
+	if err != nil {
+		return "", fmt.Errorf("invalid bearer token: %w", err)
+	}
+
+	// without a username, a caller could create tasks owned by anyone
+	username, _ := claims[a.config.UsernameClaim].(string)
+	if username == "" {
+		return "", fmt.Errorf("invalid bearer token: no %s claim", a.config.UsernameClaim)
+	}
+	return username, nil
+}
+
+// verifyJWT checks a JWT's signature and its time, issuer, and audience claims, and returns its claims. Only the one
+// algorithm the configured key is for is accepted, so a token can't pick a weaker one for itself.
+func (a *authenticator) verifyJWT(token string, now time.Time) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("malformed header: %w", err)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed signature: %w", err)
+	}
+
+	signed := []byte(parts[0] + "." + parts[1])
+	if a.publicKey != nil {
+		if header.Alg != "RS256" {
+			return nil, fmt.Errorf("algorithm must be RS256, got '%s'", header.Alg)
+		}
+		digest := sha256.Sum256(signed)
+		if err = rsa.VerifyPKCS1v15(a.publicKey, crypto.SHA256, digest[:], signature); err != nil {
+			return nil, errors.New("bad signature")
+		}
+	} else {
+		if header.Alg != "HS256" {
+			return nil, fmt.Errorf("algorithm must be HS256, got '%s'", header.Alg)
+		}
+		mac := hmac.New(sha256.New, []byte(a.config.JWTSecret))
+		mac.Write(signed)
+		if !hmac.Equal(mac.Sum(nil), signature) {
+			return nil, errors.New("bad signature")
+		}
+	}
+
+	var claims map[string]interface{}
+	if err = decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("malformed claims: %w", err)
+	}
+
+	// a token without an expiry would be good forever if it leaked
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return nil, errors.New("token has no exp claim")
+	}
+	if now.After(time.Unix(int64(exp), 0).Add(authLeeway)) {
+		return nil, errors.New("token has expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(authLeeway).Before(time.Unix(int64(nbf), 0)) {
+		return nil, errors.New("token is not valid yet")
+	}
+
+	if a.config.JWTIssuer != "" && claims["iss"] != a.config.JWTIssuer {
+		return nil, fmt.Errorf("issuer must be '%s'", a.config.JWTIssuer)
+	}
+
+	if a.config.JWTAudience != "" && !hasAudience(claims["aud"], a.config.JWTAudience) {
+		return nil, fmt.Errorf("audience must include '%s'", a.config.JWTAudience)
+	}
+
+	return claims, nil
+}
+
+func decodeJWTPart(part string, dest interface{}) error {
+	decoded, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(decoded, dest)
+}
+
+// hasAudience checks an aud claim, which may be a single audience or a list of them
+func hasAudience(aud interface{}, audience string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == audience
+	case []interface{}:
+		for _, a := range aud {
+			if a == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// authUsername returns the username the request's credentials were issued to, if they named one
+func authUsername(r *http.Request) string {
+	username, _ := r.Context().Value(authUsernameKey).(string)
+	return username
+}
+
+// authMiddleware refuses API requests without valid credentials with a 401, and stores the caller's username in the
+// request context for the handlers
+func (a *AsyncTasksApp) authMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if a.config.Authenticator == nil || authExemptPaths[strings.TrimPrefix(r.URL.Path, a.config.BasePath)] {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		username, err := a.config.Authenticator.authenticate(r)
+		if err != nil {
+			unauthorized(w, r, err.Error())
+			return
+		}
+
+		if username != "" {
+			ctx := context.WithValue(r.Context(), authUsernameKey, username)
+			ctx = context.WithValue(ctx, requestLogKey, requestLog(r).WithField("username", username))
+			r = r.WithContext(ctx)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
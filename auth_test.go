@@ -0,0 +1,227 @@
+package main
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const testJWTSecret = "test-secret"
+
+// encodeJWTPart base64url-encodes a token's header or claims
+func encodeJWTPart(t *testing.T, part interface{}) string {
+	t.Helper()
+
+	jsoned, err := json.Marshal(part)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(jsoned)
+}
+
+// makeHS256 signs a token with an HMAC key, under whatever algorithm its header claims
+func makeHS256(t *testing.T, alg string, claims map[string]interface{}, key []byte) string {
+	t.Helper()
+
+	signed := encodeJWTPart(t, map[string]string{"alg": alg, "typ": "JWT"}) + "." + encodeJWTPart(t, claims)
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// makeRS256 signs a token with an RSA private key
+func makeRS256(t *testing.T, claims map[string]interface{}, key *rsa.PrivateKey) string {
+	t.Helper()
+
+	signed := encodeJWTPart(t, map[string]string{"alg": "RS256", "typ": "JWT"}) + "." + encodeJWTPart(t, claims)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestVerifyJWT(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	claims := func(extra map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{"sub": "alice", "exp": now.Add(time.Hour).Unix()}
+		for key, value := range extra {
+			if value == nil {
+				delete(c, key)
+				continue
+			}
+			c[key] = value
+		}
+		return c
+	}
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicDER := x509.MarshalPKCS1PublicKey(&rsaKey.PublicKey)
+
+	hsAuth := &authenticator{config: AuthConfig{Mode: "jwt", JWTSecret: testJWTSecret, UsernameClaim: "sub"}}
+	rsAuth := &authenticator{config: AuthConfig{Mode: "jwt", UsernameClaim: "sub"}, publicKey: &rsaKey.PublicKey}
+	issuerAuth := &authenticator{config: AuthConfig{Mode: "jwt", JWTSecret: testJWTSecret, JWTIssuer: "de", UsernameClaim: "sub"}}
+	audienceAuth := &authenticator{config: AuthConfig{Mode: "jwt", JWTSecret: testJWTSecret, JWTAudience: "async-tasks", UsernameClaim: "sub"}}
+
+	hs := func(c map[string]interface{}) string { return makeHS256(t, "HS256", c, []byte(testJWTSecret)) }
+	tampered := hs(claims(nil))
+	tampered = tampered[:len(tampered)-2] + "AA"
+
+	tests := []struct {
+		name  string
+		auth  *authenticator
+		token string
+		valid bool
+	}{
+		{"HS256", hsAuth, hs(claims(nil)), true},
+		{"RS256", rsAuth, makeRS256(t, claims(nil), rsaKey), true},
+		{"malformed", hsAuth, "not-a-token", false},
+		{"alg none", hsAuth, encodeJWTPart(t, map[string]string{"alg": "none"}) + "." + encodeJWTPart(t, claims(nil)) + ".", false},
+		{"HS256 token against an RS256 key", rsAuth, makeHS256(t, "HS256", claims(nil), publicDER), false},
+		{"HS256 signature claiming RS256", rsAuth, makeHS256(t, "RS256", claims(nil), publicDER), false},
+		{"RS256 token against an HS256 secret", hsAuth, makeRS256(t, claims(nil), rsaKey), false},
+		{"wrong secret", hsAuth, makeHS256(t, "HS256", claims(nil), []byte("other-secret")), false},
+		{"wrong RSA key", rsAuth, makeRS256(t, claims(nil), otherKey), false},
+		{"tampered signature", hsAuth, tampered, false},
+		{"missing exp", hsAuth, hs(claims(map[string]interface{}{"exp": nil})), false},
+		{"expired", hsAuth, hs(claims(map[string]interface{}{"exp": now.Add(-time.Minute).Unix()})), false},
+		{"expired within leeway", hsAuth, hs(claims(map[string]interface{}{"exp": now.Add(-authLeeway / 2).Unix()})), true},
+		{"not valid yet", hsAuth, hs(claims(map[string]interface{}{"nbf": now.Add(time.Minute).Unix()})), false},
+		{"not valid yet within leeway", hsAuth, hs(claims(map[string]interface{}{"nbf": now.Add(authLeeway / 2).Unix()})), true},
+		{"issuer", issuerAuth, hs(claims(map[string]interface{}{"iss": "de"})), true},
+		{"wrong issuer", issuerAuth, hs(claims(map[string]interface{}{"iss": "elsewhere"})), false},
+		{"missing issuer", issuerAuth, hs(claims(nil)), false},
+		{"audience string", audienceAuth, hs(claims(map[string]interface{}{"aud": "async-tasks"})), true},
+		{"audience list", audienceAuth, hs(claims(map[string]interface{}{"aud": []string{"other", "async-tasks"}})), true},
+		{"wrong audience string", audienceAuth, hs(claims(map[string]interface{}{"aud": "other"})), false},
+		{"wrong audience list", audienceAuth, hs(claims(map[string]interface{}{"aud": []string{"other"}})), false},
+		{"missing audience", audienceAuth, hs(claims(nil)), false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := test.auth.verifyJWT(test.token, now)
+			if test.valid && err != nil {
+				t.Errorf("got %s, want the token accepted", err)
+			}
+			if !test.valid && err == nil {
+				t.Error("the token was accepted")
+			}
+		})
+	}
+}
+
+func TestAuthenticateRequiresUsername(t *testing.T) {
+	auth := &authenticator{config: AuthConfig{Mode: "jwt", JWTSecret: testJWTSecret, UsernameClaim: "sub"}}
+	exp := time.Now().Add(time.Hour).Unix()
+
+	tests := []struct {
+		name   string
+		header string
+		want   string
+		valid  bool
+	}{
+		{"username", "Bearer " + makeHS256(t, "HS256", map[string]interface{}{"sub": "alice", "exp": exp}, []byte(testJWTSecret)), "alice", true},
+		{"no username", "Bearer " + makeHS256(t, "HS256", map[string]interface{}{"exp": exp}, []byte(testJWTSecret)), "", false},
+		{"blank username", "Bearer " + makeHS256(t, "HS256", map[string]interface{}{"sub": "", "exp": exp}, []byte(testJWTSecret)), "", false},
+		{"no bearer token", "", "", false},
+		{"another scheme", "Basic YWxpY2U6c2VjcmV0", "", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/tasks", nil)
+			if test.header != "" {
+				r.Header.Set("Authorization", test.header)
+			}
+
+			username, err := auth.authenticate(r)
+			if test.valid && (err != nil || username != test.want) {
+				t.Errorf("got '%s' and %v, want '%s'", username, err, test.want)
+			}
+			if !test.valid && err == nil {
+				t.Errorf("the request was let in as '%s'", username)
+			}
+		})
+	}
+}
+
+func TestNewAuthenticatorLoadsPublicKey(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "key.pem")
+	if err = os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	auth, err := newAuthenticator(AuthConfig{Mode: "jwt", JWTPublicKeyFile: path, UsernameClaim: "sub"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token := makeRS256(t, map[string]interface{}{"sub": "alice", "exp": time.Now().Add(time.Hour).Unix()}, key)
+	if _, err = auth.verifyJWT(token, time.Now()); err != nil {
+		t.Errorf("a token signed with the loaded key was refused: %s", err)
+	}
+
+	if _, err = newAuthenticator(AuthConfig{Mode: "jwt", JWTSecret: testJWTSecret, JWTPublicKeyFile: path}); err == nil {
+		t.Error("both a secret and a public key were accepted")
+	}
+}
+
+func TestAuthMiddlewareExemptPaths(t *testing.T) {
+	auth, err := newAuthenticator(AuthConfig{Mode: "token", Token: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := &AsyncTasksApp{config: AppConfig{BasePath: "/async", Authenticator: auth}}
+	handler := app.authMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	tests := []struct {
+		path string
+		want int
+	}{
+		{"/async/", http.StatusOK},
+		{"/async/healthz", http.StatusOK},
+		{"/async/version", http.StatusOK},
+		{"/async/metrics", http.StatusOK},
+		{"/async/tasks", http.StatusUnauthorized},
+		{"/async/tasks/healthz", http.StatusUnauthorized},
+		{"/asyncx/healthz", http.StatusUnauthorized},
+	}
+
+	for _, test := range tests {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, test.path, nil))
+		if recorder.Code != test.want {
+			t.Errorf("%s without credentials got %d, want %d", test.path, recorder.Code, test.want)
+		}
+	}
+}
@@ -0,0 +1,379 @@
+package amqp
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/cyverse-de/async-tasks/behaviors"
+	"github.com/cyverse-de/async-tasks/database"
+	"github.com/cyverse-de/async-tasks/model"
+	"github.com/mitchellh/mapstructure"
+	"github.com/pkg/errors"
+	amqp091 "github.com/rabbitmq/amqp091-go"
+	"github.com/sirupsen/logrus"
+)
+
+// publishedStatusKey is the key in the behavior's state holding the ID of the status a message was last published for,
+// so it isn't published twice for the same status
+const publishedStatusKey = "published_status_id"
+
+// OutboxKind is the kind of the outbox messages amqp behaviors queue
+const OutboxKind = "amqp"
+
+// Config holds the broker connection settings shared by every amqp behavior
+type Config struct {
+	URI          string
+	ExchangeName string
+	ExchangeType string
+
+	// UseOutbox queues messages in the outbox, in the same transaction as the state that records them, for the
+	// outbox dispatcher to publish with SendOutboxMessage instead of publishing them directly
+	UseOutbox bool
+}
+
+// outboxPayload is a message waiting in the outbox, with the task as it was when the message was triggered
+type outboxPayload struct {
+	RoutingKey string          `json:"routing_key"`
+	Task       json.RawMessage `json:"task"`
+}
+
+type AMQPData struct {
+	Statuses   []string `mapstructure:"statuses"`
+	RoutingKey string   `mapstructure:"routing_key"`
+}
+
+// ValidateData checks that an amqp behavior's data can be decoded, lists its triggering statuses, and has a usable
+// routing key template
+func ValidateData(data map[string]interface{}) error {
+	var amqpData AMQPData
+	err := mapstructure.Decode(data, &amqpData)
+	if err != nil {
+		return err
+	}
+
+	if len(amqpData.Statuses) == 0 {
+		return errors.New("statuses must list at least one status")
+	}
+
+	if amqpData.RoutingKey == "" {
+		return errors.New("routing_key must be provided")
+	}
+
+	_, err = template.New("routing_key").Parse(amqpData.RoutingKey)
+	if err != nil {
+		return errors.Wrap(err, "invalid routing_key template")
+	}
+
+	return nil
+}
+
+// routingKey renders a behavior's routing key template against the task, so keys like tasks.{{.Type}} can be used
+func routingKey(keyTemplate string, task *model.AsyncTask) (string, error) {
+	tmpl, err := template.New("routing_key").Parse(keyTemplate)
+	if err != nil {
+		return "", err
+	}
+
+	var key strings.Builder
+	if err = tmpl.Execute(&key, task); err != nil {
+		return "", err
+	}
+
+	return key.String(), nil
+}
+
+// publish sends a task's JSON and waits for the broker to confirm it. A non-empty message ID is set on the message, so
+// consumers can recognize one that's published more than once.
+func publish(ctx context.Context, ch *amqp091.Channel, exchange string, key string, body []byte, messageID string) error {
+	confirmation, err := ch.PublishWithDeferredConfirmWithContext(ctx, exchange, key, false, false, amqp091.Publishing{
+		ContentType:  "application/json",
+		DeliveryMode: amqp091.Persistent,
+		MessageId:    messageID,
+		Timestamp:    time.Now(),
+		Body:         body,
+	})
+	if err != nil {
+		return err
+	}
+
+	acked, err := confirmation.WaitContext(ctx)
+	if err != nil {
+		return err
+	}
+	if !acked {
+		return errors.New("the broker did not accept the message")
+	}
+
+	return nil
+}
+
+// processSingleTask publishes a task's message if its latest status triggers one. ch is nil when messages are queued
+// in the outbox rather than published.
+func processSingleTask(ctx context.Context, log *logrus.Entry, db *database.DBConnection, ch *amqp091.Channel, exchange string, ID string) (bool, error) {
+	select {
+	// If the context is cancelled, don't bother
+	case <-ctx.Done():
+		return false, nil
+	default:
+	}
+
+	var updated bool
+	err := db.InTx(ctx, nil, func(tx *database.DBTx) error {
+		updated = false
+
+		fullTask, err := tx.GetTask(ctx, ID, true)
+		if errors.Is(err, database.ErrNotFound) {
+			// the task was deleted after it was listed, so there's nothing left to do
+			log.Infof("task %s no longer exists", ID)
+			return nil
+		}
+		if err != nil {
+			err = errors.Wrap(err, "failed getting task")
+			log.Error(err)
+			return err
+		}
+
+		latest := fullTask.LatestStatus()
+		if latest == nil {
+			log.Infof("Task %s has no statuses yet", ID)
+			return nil
+		}
+
+		for _, behavior := range fullTask.Behaviors {
+			// only one of each type because of the DB FK
+			if behavior.BehaviorType != "amqp" {
+				continue
+			}
+
+			var data AMQPData
+			err = mapstructure.Decode(behavior.Data, &data)
+			if err != nil {
+				err = errors.Wrap(err, "failed decoding behavior")
+				log.Error(err)
+				return err
+			}
+
+			triggered := false
+			for _, status := range data.Statuses {
+				if status == latest.Status {
+					triggered = true
+					break
+				}
+			}
+
+			if !triggered {
+				log.Infof("Task %s is in status '%s', which does not trigger its message", ID, latest.Status)
+				continue
+			}
+
+			if publishedID, _ := behavior.State[publishedStatusKey].(string); publishedID == latest.ID {
+				log.Infof("Task %s has already had its message published for status '%s'", ID, latest.Status)
+				continue
+			}
+
+			key, err := routingKey(data.RoutingKey, fullTask)
+			if err != nil {
+				err = errors.Wrap(err, "failed rendering routing key")
+				log.Error(err)
+				return err
+			}
+
+			jsoned, err := json.Marshal(fullTask)
+			if err != nil {
+				err = errors.Wrap(err, "failed encoding task")
+				log.Error(err)
+				return err
+			}
+
+			detail := fmt.Sprintf("%s %s on status '%s'", exchange, key, latest.Status)
+			if ch == nil {
+				payload, err := json.Marshal(outboxPayload{RoutingKey: key, Task: jsoned})
+				if err != nil {
+					err = errors.Wrap(err, "failed encoding outbox payload")
+					log.Error(err)
+					return err
+				}
+
+				// keyed by the triggering status, so the same status change is never queued twice
+				_, err = tx.InsertOutboxMessage(ctx, ID, OutboxKind, OutboxKind+":"+latest.ID, payload)
+				if err != nil {
+					err = errors.Wrap(err, "failed queueing message in the outbox")
+					log.Error(err)
+					return err
+				}
+				detail = "queued " + detail
+			} else {
+				err = publish(ctx, ch, exchange, key, jsoned, "")
+				if err != nil {
+					// don't mark it published, so it's retried on the next tick
+					err = errors.Wrapf(err, "failed publishing to %s with routing key %s", exchange, key)
+					log.Error(err)
+					return err
+				}
+			}
+
+			// kept in the behavior's state rather than as a status, so the task's latest status stays the one that
+			// triggered the message
+			err = tx.SetBehaviorState(ctx, ID, behavior.BehaviorType, map[string]interface{}{publishedStatusKey: latest.ID})
+			if err != nil {
+				err = errors.Wrap(err, "failed recording message as published")
+				log.Error(err)
+				if ch != nil {
+					// running the transaction again would publish the message again
+					return database.NotRetryable(err)
+				}
+				return err
+			}
+
+			updated = true
+			log.Infof("Handled message for task %s: %s", ID, detail)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return updated, nil
+}
+
+// Publisher processes amqp behaviors using a single broker configuration
+type Publisher struct {
+	config Config
+
+	// mu guards the connection SendOutboxMessage keeps open between messages
+	mu   sync.Mutex
+	conn *amqp091.Connection
+	ch   *amqp091.Channel
+}
+
+func NewPublisher(config Config) *Publisher {
+	return &Publisher{config: config}
+}
+
+// connect opens a channel to the broker with publisher confirms turned on, declaring the exchange if need be
+func (p *Publisher) connect() (*amqp091.Connection, *amqp091.Channel, error) {
+	conn, err := amqp091.Dial(p.config.URI)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed connecting to the AMQP broker")
+	}
+
+	ch, err := conn.Channel()
+	if err != nil {
+		conn.Close()
+		return nil, nil, errors.Wrap(err, "failed opening an AMQP channel")
+	}
+
+	err = ch.ExchangeDeclare(p.config.ExchangeName, p.config.ExchangeType, true, false, false, false, nil)
+	if err != nil {
+		conn.Close()
+		return nil, nil, errors.Wrapf(err, "failed declaring exchange %s", p.config.ExchangeName)
+	}
+
+	// confirms let a task be marked published only once the broker has the message
+	err = ch.Confirm(false)
+	if err != nil {
+		conn.Close()
+		return nil, nil, errors.Wrap(err, "failed enabling publisher confirms")
+	}
+
+	return conn, ch, nil
+}
+
+// SendOutboxMessage publishes a message that was queued in the outbox, using the outbox message's ID as its message
+// ID. The broker connection is kept open between messages and reopened after a failure.
+func (p *Publisher) SendOutboxMessage(ctx context.Context, message database.OutboxMessage) error {
+	var payload outboxPayload
+	if err := json.Unmarshal(message.Payload, &payload); err != nil {
+		return errors.Wrap(err, "failed decoding outbox payload")
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.ch == nil || p.ch.IsClosed() {
+		if p.conn != nil {
+			p.conn.Close()
+		}
+
+		conn, ch, err := p.connect()
+		if err != nil {
+			p.conn, p.ch = nil, nil
+			return err
+		}
+		p.conn, p.ch = conn, ch
+	}
+
+	err := publish(ctx, p.ch, p.config.ExchangeName, payload.RoutingKey, payload.Task, message.ID)
+	if err != nil {
+		// start over with a fresh connection next time, in case this one is broken
+		p.conn.Close()
+		p.conn, p.ch = nil, nil
+		return errors.Wrapf(err, "failed publishing to %s with routing key %s", p.config.ExchangeName, payload.RoutingKey)
+	}
+
+	return nil
+}
+
+// Processor connects to the broker for the duration of a tick. If the broker can't be reached the error is returned
+// and nothing is marked published, so every triggered task is tried again on the next tick. When messages go through
+// the outbox, it only queues them and doesn't connect at all.
+func (p *Publisher) Processor(ctx context.Context, log *logrus.Entry, _ time.Time, db *database.DBConnection) (behaviors.Result, error) {
+	var result behaviors.Result
+
+	filter := database.TaskFilter{
+		BehaviorTypes: []string{"amqp"},
+	}
+
+	var tasks []model.AsyncTask
+	err := db.InTx(ctx, nil, func(tx *database.DBTx) error {
+		var err error
+		tasks, err = tx.GetTasksByFilter(ctx, filter, "")
+		return err
+	})
+	if err != nil {
+		return result, err
+	}
+
+	log.Infof("Tasks with amqp behavior: %d", len(tasks))
+
+	if len(tasks) == 0 {
+		return result, nil
+	}
+
+	var ch *amqp091.Channel
+	if !p.config.UseOutbox {
+		var conn *amqp091.Connection
+		conn, ch, err = p.connect()
+		if err != nil {
+			return result, err
+		}
+		defer conn.Close()
+	}
+
+ProcessLoop:
+	for _, task := range tasks {
+		select {
+		// If the context is cancelled, don't bother
+		case <-ctx.Done():
+			log.Info("Not continuing to process tasks due to a canceled context.")
+			break ProcessLoop
+		default:
+		}
+
+		updated, err := processSingleTask(ctx, log, db, ch, p.config.ExchangeName, task.ID)
+		result.Record(updated, err)
+		behaviors.RecordOutcome(ctx, log, db, task.ID, "amqp", updated, err)
+		if err != nil {
+			log.Error(errors.Wrap(err, "failed processing a task"))
+		}
+	}
+
+	return result, nil
+}
@@ -0,0 +1,165 @@
+package autocomplete
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/cyverse-de/async-tasks/behaviors"
+	"github.com/cyverse-de/async-tasks/database"
+	"github.com/cyverse-de/async-tasks/model"
+	"github.com/mitchellh/mapstructure"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+type AutocompleteData struct {
+	// Statuses are the terminal statuses that mean a task is done
+	Statuses []string `mapstructure:"statuses"`
+
+	// IgnoreStatuses lists statuses that are passed over when finding the task's latest status
+	IgnoreStatuses []string `mapstructure:"ignore_statuses"`
+}
+
+// ValidateData checks that an autocomplete behavior's data can be decoded and lists at least one terminal status
+func ValidateData(data map[string]interface{}) error {
+	var autocompleteData AutocompleteData
+	err := mapstructure.Decode(data, &autocompleteData)
+	if err != nil {
+		return err
+	}
+
+	if len(autocompleteData.Statuses) == 0 {
+		return errors.New("statuses must list at least one terminal status")
+	}
+
+	for _, status := range autocompleteData.Statuses {
+		if status == "" {
+			return errors.New("statuses must not include a blank status")
+		}
+		if slices.Contains(autocompleteData.IgnoreStatuses, status) {
+			return fmt.Errorf("'%s' can't be both a terminal status and an ignored one", status)
+		}
+	}
+
+	return nil
+}
+
+func processSingleTask(ctx context.Context, log *logrus.Entry, db *database.DBConnection, ID string) (bool, error) {
+	select {
+	// If the context is cancelled, don't bother
+	case <-ctx.Done():
+		return false, nil
+	default:
+	}
+
+	var updated bool
+	err := db.InTx(ctx, nil, func(tx *database.DBTx) error {
+		updated = false
+
+		fullTask, err := tx.GetTask(ctx, ID, true)
+		if errors.Is(err, database.ErrNotFound) {
+			// the task was deleted after it was listed, so there's nothing left to do
+			log.Infof("task %s no longer exists", ID)
+			return nil
+		}
+		if err != nil {
+			err = errors.Wrap(err, "failed getting task")
+			log.Error(err)
+			return err
+		}
+
+		// someone else may have completed the task since it was listed
+		if fullTask.EndDate != nil {
+			return nil
+		}
+
+		for _, behavior := range fullTask.Behaviors {
+			// only one of each type because of the DB FK
+			if behavior.BehaviorType != "autocomplete" {
+				continue
+			}
+
+			var data AutocompleteData
+			err = mapstructure.Decode(behavior.Data, &data)
+			if err != nil {
+				err = errors.Wrap(err, "failed decoding behavior")
+				log.Error(err)
+				return err
+			}
+
+			latest := behaviors.LatestStatus(fullTask.Statuses, data.IgnoreStatuses)
+			if latest == nil || !slices.Contains(data.Statuses, latest.Status) {
+				log.Infof("Task %s is not in a terminal status", ID)
+				continue
+			}
+
+			err = tx.CompleteTask(ctx, ID)
+			if err != nil {
+				err = errors.Wrap(err, "failed completing task")
+				log.Error(err)
+				return err
+			}
+
+			updated = true
+			log.Infof("Completed task %s since its latest status '%s' is terminal", ID, latest.Status)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return updated, nil
+}
+
+// ProcessTask completes one task if its latest status is terminal, reporting whether it was completed
+func ProcessTask(ctx context.Context, log *logrus.Entry, db *database.DBConnection, ID string) (bool, error) {
+	return processSingleTask(ctx, log, db, ID)
+}
+
+// Processor completes the outstanding tasks with an autocomplete behavior whose latest status is terminal, catching
+// the clients that post a final status without ?complete=true
+func Processor(ctx context.Context, log *logrus.Entry, _ time.Time, db *database.DBConnection) (behaviors.Result, error) {
+	var result behaviors.Result
+
+	completed := false
+	filter := database.TaskFilter{
+		BehaviorTypes: []string{"autocomplete"},
+		Completed:     &completed,
+	}
+
+	var tasks []model.AsyncTask
+	err := db.InTx(ctx, nil, func(tx *database.DBTx) error {
+		var err error
+		tasks, err = tx.GetTasksByFilter(ctx, filter, "")
+		return err
+	})
+	if err != nil {
+		return result, err
+	}
+
+	log.Infof("Tasks with autocomplete behavior: %d", len(tasks))
+
+ProcessLoop:
+	for _, task := range tasks {
+		select {
+		// If the context is cancelled, don't bother
+		case <-ctx.Done():
+			log.Info("Not continuing to process tasks due to a canceled context.")
+			break ProcessLoop
+		default:
+		}
+
+		updated, err := processSingleTask(ctx, log, db, task.ID)
+		result.Record(updated, err)
+		behaviors.RecordOutcome(ctx, log, db, task.ID, "autocomplete", updated, err)
+		if err != nil {
+			log.Error(errors.Wrap(err, "failed processing a task"))
+		}
+	}
+
+	return result, nil
+}
@@ -0,0 +1,196 @@
+package dependency
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/cyverse-de/async-tasks/behaviors"
+	"github.com/cyverse-de/async-tasks/database"
+	"github.com/cyverse-de/async-tasks/model"
+	"github.com/google/uuid"
+	"github.com/mitchellh/mapstructure"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// BrokenStatus is the status recorded on a task when one of its prerequisites was deleted and on_deleted is "broken"
+const BrokenStatus = "dependency-broken"
+
+// The values accepted for on_deleted, which decides what a deleted prerequisite means
+const (
+	OnDeletedSatisfied = "satisfied"
+	OnDeletedBroken    = "broken"
+)
+
+type DependencyData struct {
+	Prerequisites []string `mapstructure:"prerequisites"`
+	ReadyStatus   string   `mapstructure:"ready_status"`
+	OnDeleted     string   `mapstructure:"on_deleted"`
+}
+
+// ValidateData checks that a dependency behavior's data can be decoded and lists prerequisites and a ready status
+func ValidateData(data map[string]interface{}) error {
+	var depData DependencyData
+	err := mapstructure.Decode(data, &depData)
+	if err != nil {
+		return err
+	}
+
+	if len(depData.Prerequisites) == 0 {
+		return errors.New("at least one prerequisite must be provided")
+	}
+
+	for _, prereq := range depData.Prerequisites {
+		if _, err := uuid.Parse(prereq); err != nil {
+			return errors.Wrapf(err, "invalid prerequisite task ID '%s'", prereq)
+		}
+	}
+
+	if depData.ReadyStatus == "" {
+		return errors.New("ready_status must be provided")
+	}
+
+	switch depData.OnDeleted {
+	case "", OnDeletedSatisfied, OnDeletedBroken:
+	default:
+		return fmt.Errorf("on_deleted must be '%s' or '%s', got '%s'", OnDeletedSatisfied, OnDeletedBroken, depData.OnDeleted)
+	}
+
+	return nil
+}
+
+func processSingleTask(ctx context.Context, log *logrus.Entry, db *database.DBConnection, ID string) (bool, error) {
+	select {
+	// If the context is cancelled, don't bother
+	case <-ctx.Done():
+		return false, nil
+	default:
+	}
+
+	var updated bool
+	err := db.InTx(ctx, nil, func(tx *database.DBTx) error {
+		updated = false
+
+		fullTask, err := tx.GetTask(ctx, ID, true)
+		if errors.Is(err, database.ErrNotFound) {
+			// the task was deleted after it was listed, so there's nothing left to do
+			log.Infof("task %s no longer exists", ID)
+			return nil
+		}
+		if err != nil {
+			err = errors.Wrap(err, "failed getting task")
+			log.Error(err)
+			return err
+		}
+
+		for _, behavior := range fullTask.Behaviors {
+			// only one of each type because of the DB FK
+			if behavior.BehaviorType != "dependency" {
+				continue
+			}
+
+			var data DependencyData
+			err = mapstructure.Decode(behavior.Data, &data)
+			if err != nil {
+				err = errors.Wrap(err, "failed decoding behavior")
+				log.Error(err)
+				return err
+			}
+
+			// once either status is recorded the task is no longer waiting
+			if behaviors.EverHadStatus(fullTask.Statuses, data.ReadyStatus) || behaviors.EverHadStatus(fullTask.Statuses, BrokenStatus) {
+				log.Infof("Task %s is no longer waiting on its prerequisites", ID)
+				continue
+			}
+
+			var pending, deleted []string
+			for _, prereqID := range data.Prerequisites {
+				prereq, err := tx.GetTask(ctx, prereqID, false)
+				if errors.Is(err, database.ErrNotFound) {
+					deleted = append(deleted, prereqID)
+					continue
+				}
+				if err != nil {
+					err = errors.Wrapf(err, "failed getting prerequisite task %s", prereqID)
+					log.Error(err)
+					return err
+				}
+
+				if prereq.EndDate == nil {
+					pending = append(pending, prereqID)
+				}
+			}
+
+			var newstatus model.AsyncTaskStatus
+			switch {
+			case len(deleted) > 0 && data.OnDeleted == OnDeletedBroken:
+				newstatus = model.AsyncTaskStatus{Status: BrokenStatus, Detail: fmt.Sprintf("prerequisite tasks were deleted: %v", deleted)}
+			case len(pending) > 0:
+				log.Infof("Task %s is still waiting on %d prerequisites", ID, len(pending))
+				continue
+			default:
+				newstatus = model.AsyncTaskStatus{Status: data.ReadyStatus, Detail: "all prerequisite tasks are complete"}
+			}
+
+			err = tx.InsertInternalTaskStatus(ctx, newstatus, ID)
+			if err != nil {
+				err = errors.Wrap(err, "failed inserting task status")
+				log.Error(err)
+				return err
+			}
+
+			updated = true
+			log.Infof("Task %s got status '%s' from its prerequisites", ID, newstatus.Status)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return updated, nil
+}
+
+func Processor(ctx context.Context, log *logrus.Entry, _ time.Time, db *database.DBConnection) (behaviors.Result, error) {
+	var result behaviors.Result
+
+	incomplete := false
+	filter := database.TaskFilter{
+		BehaviorTypes: []string{"dependency"},
+		Completed:     &incomplete,
+	}
+
+	var tasks []model.AsyncTask
+	err := db.InTx(ctx, nil, func(tx *database.DBTx) error {
+		var err error
+		tasks, err = tx.GetTasksByFilter(ctx, filter, "")
+		return err
+	})
+	if err != nil {
+		return result, err
+	}
+
+	log.Infof("Incomplete tasks with dependency behavior: %d", len(tasks))
+
+ProcessLoop:
+	for _, task := range tasks {
+		select {
+		// If the context is cancelled, don't bother
+		case <-ctx.Done():
+			log.Info("Not continuing to process tasks due to a canceled context.")
+			break ProcessLoop
+		default:
+		}
+
+		updated, err := processSingleTask(ctx, log, db, task.ID)
+		result.Record(updated, err)
+		behaviors.RecordOutcome(ctx, log, db, task.ID, "dependency", updated, err)
+		if err != nil {
+			log.Error(errors.Wrap(err, "failed processing a task"))
+		}
+	}
+
+	return result, nil
+}
@@ -0,0 +1,197 @@
+package escalate
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/cyverse-de/async-tasks/behaviors"
+	"github.com/cyverse-de/async-tasks/database"
+	"github.com/cyverse-de/async-tasks/model"
+	"github.com/mitchellh/mapstructure"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// escalatedStatusKey is the key in the behavior's state holding the ID of the status the task was last escalated for
+// being stuck in, so it's escalated only once each time it gets stuck
+const escalatedStatusKey = "escalated_status_id"
+
+// escalatedDateKey is the key in the behavior's state holding when the task was last escalated
+const escalatedDateKey = "escalated_date"
+
+type EscalateData struct {
+	Status    string `mapstructure:"status"`
+	Threshold string `mapstructure:"threshold"`
+
+	// EscalationStatus is recorded on a task that's stuck, for a webhook or amqp behavior to trigger on. It's always
+	// ignored when finding the status the task is in, so escalating doesn't move the task along.
+	EscalationStatus string `mapstructure:"escalation_status"`
+
+	// IgnoreStatuses lists statuses that don't count as the task moving on
+	IgnoreStatuses []string `mapstructure:"ignore_statuses"`
+}
+
+// ValidateData checks that an escalate behavior's data can be decoded, names the status to watch and a different status
+// to escalate with, and has a positive threshold
+func ValidateData(data map[string]interface{}) error {
+	var escalateData EscalateData
+	err := mapstructure.Decode(data, &escalateData)
+	if err != nil {
+		return err
+	}
+
+	if escalateData.Status == "" {
+		return errors.New("status must be provided")
+	}
+
+	if escalateData.EscalationStatus == "" {
+		return errors.New("escalation_status must be provided")
+	}
+	if escalateData.EscalationStatus == escalateData.Status {
+		return fmt.Errorf("escalation_status must differ from status '%s'", escalateData.Status)
+	}
+
+	threshold, err := time.ParseDuration(escalateData.Threshold)
+	if err != nil {
+		return errors.Wrap(err, "invalid threshold")
+	}
+	if threshold <= 0 {
+		return fmt.Errorf("threshold must be positive, got %s", threshold)
+	}
+
+	return nil
+}
+
+func processSingleTask(ctx context.Context, log *logrus.Entry, now time.Time, db *database.DBConnection, ID string) (bool, error) {
+	select {
+	// If the context is cancelled, don't bother
+	case <-ctx.Done():
+		return false, nil
+	default:
+	}
+
+	var updated bool
+	err := db.InTx(ctx, nil, func(tx *database.DBTx) error {
+		updated = false
+
+		fullTask, err := tx.GetTask(ctx, ID, true)
+		if errors.Is(err, database.ErrNotFound) {
+			// the task was deleted after it was listed, so there's nothing left to do
+			log.Infof("task %s no longer exists", ID)
+			return nil
+		}
+		if err != nil {
+			err = errors.Wrap(err, "failed getting task")
+			log.Error(err)
+			return err
+		}
+
+		for _, behavior := range fullTask.Behaviors {
+			// only one of each type because of the DB FK
+			if behavior.BehaviorType != "escalate" {
+				continue
+			}
+
+			var data EscalateData
+			err = mapstructure.Decode(behavior.Data, &data)
+			if err != nil {
+				err = errors.Wrap(err, "failed decoding behavior")
+				log.Error(err)
+				return err
+			}
+
+			threshold, err := time.ParseDuration(data.Threshold)
+			if err != nil {
+				err = errors.Wrap(err, "failed parsing threshold duration")
+				log.Error(err)
+				return err
+			}
+
+			ignored := append([]string{data.EscalationStatus}, data.IgnoreStatuses...)
+			current := behaviors.LatestStatus(fullTask.Statuses, ignored)
+			if current == nil || current.Status != data.Status || current.CreatedDate.Add(threshold).After(now) {
+				log.Infof("Task %s is not stuck in '%s' for %s", ID, data.Status, threshold)
+				continue
+			}
+
+			// having escalated for this very status means the task hasn't moved on since
+			if escalatedID, _ := behavior.State[escalatedStatusKey].(string); escalatedID == current.ID {
+				log.Infof("Task %s was already escalated for being stuck in '%s'", ID, data.Status)
+				continue
+			}
+
+			newstatus := model.AsyncTaskStatus{
+				Status: data.EscalationStatus,
+				Detail: fmt.Sprintf("in '%s' for more than %s", data.Status, threshold),
+			}
+			err = tx.InsertInternalTaskStatus(ctx, newstatus, ID)
+			if err != nil {
+				err = errors.Wrap(err, "failed inserting task status")
+				log.Error(err)
+				return err
+			}
+
+			state := map[string]interface{}{
+				escalatedStatusKey: current.ID,
+				escalatedDateKey:   now.UTC().Format(time.RFC3339Nano),
+			}
+			err = tx.SetBehaviorState(ctx, ID, behavior.BehaviorType, state)
+			if err != nil {
+				err = errors.Wrap(err, "failed recording escalation")
+				log.Error(err)
+				return err
+			}
+
+			updated = true
+			log.Warnf("Escalated task %s to '%s' after %s in '%s' since %s", ID, data.EscalationStatus, threshold, data.Status, current.CreatedDate)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return updated, nil
+}
+
+func Processor(ctx context.Context, log *logrus.Entry, tickerTime time.Time, db *database.DBConnection) (behaviors.Result, error) {
+	var result behaviors.Result
+
+	filter := database.TaskFilter{
+		BehaviorTypes: []string{"escalate"},
+	}
+
+	var tasks []model.AsyncTask
+	err := db.InTx(ctx, nil, func(tx *database.DBTx) error {
+		var err error
+		tasks, err = tx.GetTasksByFilter(ctx, filter, "")
+		return err
+	})
+	if err != nil {
+		return result, err
+	}
+
+	log.Infof("Tasks with escalate behavior: %d", len(tasks))
+
+ProcessLoop:
+	for _, task := range tasks {
+		select {
+		// If the context is cancelled, don't bother
+		case <-ctx.Done():
+			log.Info("Not continuing to process tasks due to a canceled context.")
+			break ProcessLoop
+		default:
+		}
+
+		updated, err := processSingleTask(ctx, log, tickerTime, db, task.ID)
+		result.Record(updated, err)
+		behaviors.RecordOutcome(ctx, log, db, task.ID, "escalate", updated, err)
+		if err != nil {
+			log.Error(errors.Wrap(err, "failed processing a task"))
+		}
+	}
+
+	return result, nil
+}
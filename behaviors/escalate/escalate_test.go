@@ -0,0 +1,94 @@
+package escalate
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/cyverse-de/async-tasks/database"
+	"github.com/cyverse-de/async-tasks/database/dbtest"
+	"github.com/cyverse-de/async-tasks/model"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+func TestValidateData(t *testing.T) {
+	tests := []struct {
+		name  string
+		data  map[string]interface{}
+		valid bool
+	}{
+		{"valid", map[string]interface{}{"status": "running", "threshold": "1h", "escalation_status": "stuck"}, true},
+		{"no status", map[string]interface{}{"threshold": "1h", "escalation_status": "stuck"}, false},
+		{"no escalation status", map[string]interface{}{"status": "running", "threshold": "1h"}, false},
+		{"escalation status is the watched status", map[string]interface{}{"status": "running", "threshold": "1h", "escalation_status": "running"}, false},
+		{"bad threshold", map[string]interface{}{"status": "running", "threshold": "soon", "escalation_status": "stuck"}, false},
+		{"zero threshold", map[string]interface{}{"status": "running", "threshold": "0s", "escalation_status": "stuck"}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := ValidateData(test.data)
+			if test.valid && err != nil {
+				t.Errorf("got %s, want no error", err)
+			}
+			if !test.valid && err == nil {
+				t.Error("got no error")
+			}
+		})
+	}
+}
+
+func TestProcessorEscalatesOnce(t *testing.T) {
+	db := dbtest.New(t)
+	ctx := context.Background()
+	now := time.Now()
+
+	task := model.AsyncTask{
+		Type:     "test",
+		Statuses: []model.AsyncTaskStatus{{Status: "running", CreatedDate: now.Add(-2 * time.Hour)}},
+		Behaviors: []model.AsyncTaskBehavior{{
+			BehaviorType: "escalate",
+			Data:         map[string]interface{}{"status": "running", "threshold": "1h", "escalation_status": "stuck"},
+		}},
+	}
+
+	var id string
+	err := db.InTx(ctx, nil, func(tx *database.DBTx) error {
+		var err error
+		id, err = tx.InsertTask(ctx, task)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logger, _ := test.NewNullLogger()
+	for i := 0; i < 2; i++ {
+		if _, err = Processor(ctx, logrus.NewEntry(logger), now, db); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var fullTask *model.AsyncTask
+	err = db.InTx(ctx, nil, func(tx *database.DBTx) error {
+		var err error
+		fullTask, err = tx.GetTask(ctx, id, false)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, status := range fullTask.Statuses {
+		got = append(got, status.Status)
+	}
+	if len(got) != 2 || got[1] != "stuck" {
+		t.Errorf("got statuses %v, want running then a single stuck", got)
+	}
+
+	if len(fullTask.Behaviors) != 1 || len(got) == 0 || fullTask.Behaviors[0].State[escalatedStatusKey] != fullTask.Statuses[0].ID {
+		t.Errorf("got behaviors %+v, want the escalation recorded against the running status", fullTask.Behaviors)
+	}
+}
@@ -0,0 +1,232 @@
+package fork
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/cyverse-de/async-tasks/behaviors"
+	"github.com/cyverse-de/async-tasks/database"
+	"github.com/cyverse-de/async-tasks/model"
+	"github.com/mitchellh/mapstructure"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// forkedKey is the key in a task's data where the ID of the task it forked into is kept, so it only forks once. It's
+// kept in the data rather than as a status, so forking doesn't change the task's latest status.
+const forkedKey = "forked_task_id"
+
+// parentKey is the key in a forked task's data that holds its parent's ID, when link_parent is set
+const parentKey = "parent_id"
+
+type ForkData struct {
+	// Status is the status that makes the task fork. It only has to have been reached, not to still be the latest.
+	Status string `mapstructure:"status"`
+
+	// Type is the new task's type, which defaults to the parent's
+	Type string `mapstructure:"type"`
+
+	// CopyData lists the keys of the parent's data to copy to the new task, or all of them if it's empty
+	CopyData []string `mapstructure:"copy_data"`
+
+	// Behaviors lists the types of the parent's behaviors to copy to the new task
+	Behaviors []string `mapstructure:"behaviors"`
+
+	// InitialStatus, if set, is the new task's first status
+	InitialStatus string `mapstructure:"initial_status"`
+
+	// LinkParent records the parent's ID in the new task's data, under parent_id
+	LinkParent bool `mapstructure:"link_parent"`
+}
+
+// ValidateData checks that a fork behavior's data can be decoded and names the status to fork on
+func ValidateData(data map[string]interface{}) error {
+	var forkData ForkData
+	err := mapstructure.Decode(data, &forkData)
+	if err != nil {
+		return err
+	}
+
+	if forkData.Status == "" {
+		return errors.New("status must be provided")
+	}
+
+	for _, behaviorType := range forkData.Behaviors {
+		if behaviorType == "" {
+			return errors.New("behaviors must not include a blank behavior type")
+		}
+	}
+
+	return nil
+}
+
+// makeChild builds the task a parent forks into. The fork's own bookkeeping keys are never copied, or the child would
+// look like it had already forked, or name its grandparent as its parent.
+func makeChild(parent *model.AsyncTask, data ForkData) model.AsyncTask {
+	child := model.AsyncTask{
+		Type:     data.Type,
+		Username: parent.Username,
+		Source:   parent.Source,
+		Tags:     parent.Tags,
+	}
+	if child.Type == "" {
+		child.Type = parent.Type
+	}
+
+	childData := make(map[string]interface{})
+	for key, value := range parent.Data {
+		if key == forkedKey || key == parentKey {
+			continue
+		}
+		if len(data.CopyData) == 0 || slices.Contains(data.CopyData, key) {
+			childData[key] = value
+		}
+	}
+	if data.LinkParent {
+		childData[parentKey] = parent.ID
+	}
+	child.Data = childData
+
+	for _, behavior := range parent.Behaviors {
+		if slices.Contains(data.Behaviors, behavior.BehaviorType) {
+			child.Behaviors = append(child.Behaviors, behavior)
+		}
+	}
+
+	if data.InitialStatus != "" {
+		child.Statuses = []model.AsyncTaskStatus{{Status: data.InitialStatus, Detail: fmt.Sprintf("forked from task %s", parent.ID)}}
+	}
+
+	return child
+}
+
+func processSingleTask(ctx context.Context, log *logrus.Entry, db *database.DBConnection, ID string) (bool, error) {
+	select {
+	// If the context is cancelled, don't bother
+	case <-ctx.Done():
+		return false, nil
+	default:
+	}
+
+	var updated bool
+	err := db.InTx(ctx, nil, func(tx *database.DBTx) error {
+		updated = false
+
+		fullTask, err := tx.GetTask(ctx, ID, true)
+		if errors.Is(err, database.ErrNotFound) {
+			// the task was deleted after it was listed, so there's nothing left to do
+			log.Infof("task %s no longer exists", ID)
+			return nil
+		}
+		if err != nil {
+			err = errors.Wrap(err, "failed getting task")
+			log.Error(err)
+			return err
+		}
+
+		if _, ok := fullTask.Data[forkedKey]; ok {
+			log.Infof("Task %s has already forked", ID)
+			return nil
+		}
+
+		for _, behavior := range fullTask.Behaviors {
+			// only one of each type because of the DB FK
+			if behavior.BehaviorType != "fork" {
+				continue
+			}
+
+			var data ForkData
+			err = mapstructure.Decode(behavior.Data, &data)
+			if err != nil {
+				err = errors.Wrap(err, "failed decoding behavior")
+				log.Error(err)
+				return err
+			}
+
+			if !behaviors.EverHadStatus(fullTask.Statuses, data.Status) {
+				log.Infof("Task %s has not reached status '%s'", ID, data.Status)
+				continue
+			}
+
+			// the child and the parent's record of it go in one transaction, so a crash can't fork twice
+			childID, err := tx.InsertTask(ctx, makeChild(fullTask, data))
+			if err != nil {
+				err = errors.Wrap(err, "failed inserting forked task")
+				log.Error(err)
+				return err
+			}
+
+			newdata := make(map[string]interface{})
+			for key, value := range fullTask.Data {
+				newdata[key] = value
+			}
+			newdata[forkedKey] = childID
+
+			err = tx.UpdateTaskData(ctx, ID, newdata)
+			if err != nil {
+				err = errors.Wrap(err, "failed recording forked task")
+				log.Error(err)
+				return err
+			}
+
+			updated = true
+			log.Infof("Forked task %s into task %s on reaching status '%s'", ID, childID, data.Status)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return updated, nil
+}
+
+// ProcessTask forks one task if it has reached its fork status, reporting whether it forked
+func ProcessTask(ctx context.Context, log *logrus.Entry, db *database.DBConnection, ID string) (bool, error) {
+	return processSingleTask(ctx, log, db, ID)
+}
+
+// Processor forks the tasks with a fork behavior that have reached their fork status and haven't forked yet
+func Processor(ctx context.Context, log *logrus.Entry, _ time.Time, db *database.DBConnection) (behaviors.Result, error) {
+	var result behaviors.Result
+
+	filter := database.TaskFilter{
+		BehaviorTypes:   []string{"fork"},
+		ExcludeDataKeys: []string{forkedKey},
+	}
+
+	var tasks []model.AsyncTask
+	err := db.InTx(ctx, nil, func(tx *database.DBTx) error {
+		var err error
+		tasks, err = tx.GetTasksByFilter(ctx, filter, "")
+		return err
+	})
+	if err != nil {
+		return result, err
+	}
+
+	log.Infof("Tasks with fork behavior: %d", len(tasks))
+
+ProcessLoop:
+	for _, task := range tasks {
+		select {
+		// If the context is cancelled, don't bother
+		case <-ctx.Done():
+			log.Info("Not continuing to process tasks due to a canceled context.")
+			break ProcessLoop
+		default:
+		}
+
+		updated, err := processSingleTask(ctx, log, db, task.ID)
+		result.Record(updated, err)
+		behaviors.RecordOutcome(ctx, log, db, task.ID, "fork", updated, err)
+		if err != nil {
+			log.Error(errors.Wrap(err, "failed processing a task"))
+		}
+	}
+
+	return result, nil
+}
@@ -0,0 +1,29 @@
+package behaviors
+
+import (
+	"context"
+
+	"github.com/cyverse-de/async-tasks/database"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// RecordOutcome keeps the last error a behavior failed with on the behavior itself, where clients can see it. A
+// failure replaces the recorded error, and a run that acted on the task clears it; runs with nothing to do leave it be,
+// so checking on an idle task doesn't cost a write. Failing to record the outcome is only logged.
+func RecordOutcome(ctx context.Context, log *logrus.Entry, db *database.DBConnection, taskID string, behaviorType string, updated bool, err error) {
+	// errors from a canceled run are about the cancellation, not the behavior
+	if ctx.Err() != nil || (err == nil && !updated) {
+		return
+	}
+
+	recordErr := db.InTx(ctx, nil, func(tx *database.DBTx) error {
+		if err != nil {
+			return tx.SetBehaviorError(ctx, taskID, behaviorType, err.Error())
+		}
+		return tx.ClearBehaviorError(ctx, taskID, behaviorType)
+	})
+	if recordErr != nil {
+		log.Error(errors.Wrap(recordErr, "failed recording the outcome of a behavior"))
+	}
+}
@@ -0,0 +1,30 @@
+// Package behaviors holds what the behavior processors in its subpackages share.
+package behaviors
+
+// Result counts how a behavior processor's run went for the tasks it evaluated, so the updater can report it
+type Result struct {
+	// Evaluated is every task looked at. Each of them is also counted in exactly one of the others.
+	Evaluated int
+
+	// Updated counts the tasks the processor acted on, such as by adding a status or sending a message
+	Updated int
+
+	// NotReady counts the tasks that had nothing due yet, or that no longer needed anything
+	NotReady int
+
+	// Errored counts the tasks that failed to process
+	Errored int
+}
+
+// Record counts the outcome of processing one task
+func (r *Result) Record(updated bool, err error) {
+	r.Evaluated++
+	switch {
+	case err != nil:
+		r.Errored++
+	case updated:
+		r.Updated++
+	default:
+		r.NotReady++
+	}
+}
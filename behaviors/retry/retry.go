@@ -0,0 +1,206 @@
+package retry
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/cyverse-de/async-tasks/behaviors"
+	"github.com/cyverse-de/async-tasks/database"
+	"github.com/cyverse-de/async-tasks/model"
+	"github.com/mitchellh/mapstructure"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// ExhaustedStatus is the status recorded on a task once it has failed after all of its retries
+const ExhaustedStatus = "retry-exhausted"
+
+// attemptsKey is the key in a task's data where the number of retries so far is tracked
+const attemptsKey = "retry_attempts"
+
+type RetryData struct {
+	FailedStatus string `mapstructure:"failed_status"`
+	RetryStatus  string `mapstructure:"retry_status"`
+	MaxAttempts  int    `mapstructure:"max_attempts"`
+	Backoff      string `mapstructure:"backoff"`
+}
+
+// ValidateData checks that a retry behavior's data can be decoded and has the statuses and backoff it needs
+func ValidateData(data map[string]interface{}) error {
+	var retryData RetryData
+	err := mapstructure.Decode(data, &retryData)
+	if err != nil {
+		return err
+	}
+
+	if retryData.FailedStatus == "" || retryData.RetryStatus == "" {
+		return errors.New("failed_status and retry_status must be provided")
+	}
+
+	_, err = time.ParseDuration(retryData.Backoff)
+	if err != nil {
+		return errors.Wrap(err, "invalid backoff")
+	}
+
+	return nil
+}
+
+// attempts reads the number of retries so far from a task's data
+func attempts(data map[string]interface{}) int {
+	// JSON numbers come back out of the database as float64
+	if count, ok := data[attemptsKey].(float64); ok {
+		return int(count)
+	}
+	return 0
+}
+
+func processSingleTask(ctx context.Context, log *logrus.Entry, now time.Time, db *database.DBConnection, ID string) (bool, error) {
+	select {
+	// If the context is cancelled, don't bother
+	case <-ctx.Done():
+		return false, nil
+	default:
+	}
+
+	var updated bool
+	err := db.InTx(ctx, nil, func(tx *database.DBTx) error {
+		updated = false
+
+		fullTask, err := tx.GetTask(ctx, ID, true)
+		if errors.Is(err, database.ErrNotFound) {
+			// the task was deleted after it was listed, so there's nothing left to do
+			log.Infof("task %s no longer exists", ID)
+			return nil
+		}
+		if err != nil {
+			err = errors.Wrap(err, "failed getting task")
+			log.Error(err)
+			return err
+		}
+
+		latest := fullTask.LatestStatus()
+		if latest == nil {
+			log.Infof("Task %s has no statuses yet", ID)
+			return nil
+		}
+
+		for _, behavior := range fullTask.Behaviors {
+			// only one of each type because of the DB FK
+			if behavior.BehaviorType != "retry" {
+				continue
+			}
+
+			var data RetryData
+			err = mapstructure.Decode(behavior.Data, &data)
+			if err != nil {
+				err = errors.Wrap(err, "failed decoding behavior")
+				log.Error(err)
+				return err
+			}
+
+			backoff, err := time.ParseDuration(data.Backoff)
+			if err != nil {
+				err = errors.Wrap(err, "failed parsing backoff duration")
+				log.Error(err)
+				return err
+			}
+
+			if latest.Status != data.FailedStatus || latest.CreatedDate.Add(backoff).After(now) {
+				log.Infof("Task was not ready to retry given time %s, backoff %s, and status '%s'", latest.CreatedDate, backoff, latest.Status)
+				continue
+			}
+
+			// the counter and the status go in the same transaction so a crash can't count an attempt that never happened
+			count := attempts(fullTask.Data)
+			if count >= data.MaxAttempts {
+				newstatus := model.AsyncTaskStatus{Status: ExhaustedStatus, Detail: fmt.Sprintf("gave up after %d attempts", count)}
+				err = tx.InsertInternalTaskStatus(ctx, newstatus, ID)
+				if err != nil {
+					err = errors.Wrap(err, "failed inserting task status")
+					log.Error(err)
+					return err
+				}
+				updated = true
+				log.Infof("Task %s exhausted its %d retries", ID, data.MaxAttempts)
+				continue
+			}
+
+			newdata := make(map[string]interface{})
+			for key, value := range fullTask.Data {
+				newdata[key] = value
+			}
+			newdata[attemptsKey] = count + 1
+
+			err = tx.UpdateTaskData(ctx, ID, newdata)
+			if err != nil {
+				err = errors.Wrap(err, "failed updating retry count")
+				log.Error(err)
+				return err
+			}
+
+			newstatus := model.AsyncTaskStatus{Status: data.RetryStatus, Detail: fmt.Sprintf("retry attempt %d of %d", count+1, data.MaxAttempts)}
+			err = tx.InsertInternalTaskStatus(ctx, newstatus, ID)
+			if err != nil {
+				err = errors.Wrap(err, "failed inserting task status")
+				log.Error(err)
+				return err
+			}
+
+			updated = true
+			log.Infof("Retrying task %s from '%s' to '%s', attempt %d of %d", ID, data.FailedStatus, data.RetryStatus, count+1, data.MaxAttempts)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return updated, nil
+}
+
+// ProcessTask handles the retry behavior of one task, reporting whether it was retried or marked exhausted
+func ProcessTask(ctx context.Context, log *logrus.Entry, db *database.DBConnection, ID string) (bool, error) {
+	return processSingleTask(ctx, log, time.Now(), db, ID)
+}
+
+func Processor(ctx context.Context, log *logrus.Entry, tickerTime time.Time, db *database.DBConnection) (behaviors.Result, error) {
+	var result behaviors.Result
+
+	filter := database.TaskFilter{
+		BehaviorTypes: []string{"retry"},
+	}
+
+	var tasks []model.AsyncTask
+	err := db.InTx(ctx, nil, func(tx *database.DBTx) error {
+		var err error
+		tasks, err = tx.GetTasksByFilter(ctx, filter, "")
+		return err
+	})
+	if err != nil {
+		return result, err
+	}
+
+	log.Infof("Tasks with retry behavior: %d", len(tasks))
+
+ProcessLoop:
+	for _, task := range tasks {
+		select {
+		// If the context is cancelled, don't bother
+		case <-ctx.Done():
+			log.Info("Not continuing to process tasks due to a canceled context.")
+			break ProcessLoop
+		default:
+		}
+
+		updated, err := processSingleTask(ctx, log, tickerTime, db, task.ID)
+		result.Record(updated, err)
+		behaviors.RecordOutcome(ctx, log, db, task.ID, "retry", updated, err)
+		if err != nil {
+			log.Error(errors.Wrap(err, "failed processing a task"))
+		}
+	}
+
+	return result, nil
+}
@@ -2,8 +2,11 @@ package statuschangetimeout
 
 import (
 	"context"
+	"fmt"
+	"strings"
 	"time"
 
+	"github.com/cyverse-de/async-tasks/behaviors"
 	"github.com/cyverse-de/async-tasks/database"
 	"github.com/cyverse-de/async-tasks/model"
 	"github.com/mitchellh/mapstructure"
@@ -11,7 +14,11 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
+// StatusChangeTimeoutData is one transition from a statuschangetimeout behavior's statuses array. A task can only have
+// one behavior of each type, so Name optionally labels which logical timeout configuration a transition belongs to
+// when several share the array.
 type StatusChangeTimeoutData struct {
+	Name        string `mapstructure:"name"`
 	StartStatus string `mapstructure:"start_status"`
 	EndStatus   string `mapstructure:"end_status"`
 	Timeout     string `mapstructure:"timeout"`
@@ -19,135 +26,245 @@ type StatusChangeTimeoutData struct {
 	Delete      bool   `mapstructure:"delete"`
 }
 
-func rollbackLogError(tx *database.DBTx, log *logrus.Entry) {
-	err := tx.Rollback()
-	if err != nil {
-		log.Error(err)
+// ValidateData checks that a statuschangetimeout behavior's data has a statuses array whose entries decode without
+// unknown keys, name an end status, and have non-negative timeouts. Entries that fail these checks would otherwise only
+// be skipped, with an error in the logs, when the behavior is processed.
+func ValidateData(data map[string]interface{}) error {
+	statuses, ok := data["statuses"].([]interface{})
+	if !ok {
+		return errors.New("statuses must be an array")
+	}
+
+	for i, datum := range statuses {
+		var taskData StatusChangeTimeoutData
+		// a misspelled key like "timout" would otherwise just leave its field empty
+		decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{ErrorUnused: true, Result: &taskData})
+		if err != nil {
+			return err
+		}
+		if err = decoder.Decode(datum); err != nil {
+			return errors.Wrapf(err, "statuses[%d] could not be decoded", i)
+		}
+
+		if taskData.EndStatus == "" {
+			return fmt.Errorf("statuses[%d] must have an end_status", i)
+		}
+
+		timeout, err := time.ParseDuration(taskData.Timeout)
+		if err != nil {
+			return errors.Wrapf(err, "statuses[%d] has an invalid timeout", i)
+		}
+		if timeout < 0 {
+			return fmt.Errorf("statuses[%d] must not have a negative timeout, got %s", i, timeout)
+		}
+	}
+
+	return nil
+}
+
+// transition is a decoded entry of a statuschangetimeout behavior's statuses array
+type transition struct {
+	data    StatusChangeTimeoutData
+	timeout time.Duration
+}
+
+// decodeTransitions decodes a statuschangetimeout behavior's statuses array in order. Entries that can't be used are
+// skipped so the rest still apply, and an error describing all of them is returned along with the usable ones.
+func decodeTransitions(data []interface{}) ([]transition, error) {
+	var (
+		transitions []transition
+		problems    []string
+	)
+	for i, datum := range data {
+		var taskData StatusChangeTimeoutData
+		err := mapstructure.Decode(datum, &taskData)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("statuses[%d] could not be decoded: %s", i, err))
+			continue
+		}
+
+		timeout, err := time.ParseDuration(taskData.Timeout)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("statuses[%d] has an invalid timeout: %s", i, err))
+			continue
+		}
+
+		transitions = append(transitions, transition{data: taskData, timeout: timeout})
+	}
+
+	if len(problems) > 0 {
+		return transitions, errors.New(strings.Join(problems, "; "))
 	}
+	return transitions, nil
 }
 
-func processSingleTask(ctx context.Context, log *logrus.Entry, db *database.DBConnection, ID string) error {
+func processSingleTask(ctx context.Context, log *logrus.Entry, now time.Time, db *database.DBConnection, ID string) (bool, error) {
 	select {
 	// If the context is cancelled, don't bother
 	case <-ctx.Done():
-		return nil
+		return false, nil
 	default:
 	}
 
-	tx, err := db.BeginTx(ctx, nil)
-	if err != nil {
-		return err
-	}
-	defer rollbackLogError(tx, log)
+	var (
+		updated   bool
+		decodeErr error
+	)
+	err := db.InTx(ctx, nil, func(tx *database.DBTx) error {
+		updated, decodeErr = false, nil
 
-	fullTask, err := tx.GetTask(ctx, ID, true)
-	if err != nil {
-		err = errors.Wrap(err, "failed getting task")
-		log.Error(err)
-		return err
-	}
+		// only the latest status matters, so don't load what may be a long history of them
+		fullTask, err := tx.GetTaskSansStatuses(ctx, ID, true)
+		if errors.Is(err, database.ErrNotFound) {
+			// the task was deleted after it was listed, so there's nothing left to do
+			log.Infof("task %s no longer exists", ID)
+			return nil
+		}
+		if err != nil {
+			err = errors.Wrap(err, "failed getting task")
+			log.Error(err)
+			return err
+		}
+
+		latest, err := tx.GetTaskStatuses(ctx, ID, 1, 0, false)
+		if err != nil {
+			err = errors.Wrap(err, "failed getting latest status")
+			log.Error(err)
+			return err
+		}
+
+		var comparisonTimestamp time.Time
+		var comparisonStatus string
+		if len(latest) == 0 {
+			comparisonTimestamp = *fullTask.StartDate
+		} else {
+			comparisonTimestamp = latest[0].CreatedDate
+			comparisonStatus = latest[0].Status
+		}
+
+		log.Infof("Most recent timestamp for task %s: %s", ID, comparisonTimestamp)
+
+		var transitions []transition
+		for _, behavior := range fullTask.Behaviors {
+			// only one of each type because of the DB FK
+			if behavior.BehaviorType == "statuschangetimeout" {
+				data, ok := behavior.Data["statuses"].([]interface{})
+				if !ok {
+					err = errors.New("Behavior data is not an array")
+					log.Error(err)
+					return err
+				}
 
-	var comparisonTimestamp time.Time
-	var comparisonStatus string
-	if len(fullTask.Statuses) == 0 {
-		comparisonTimestamp = *fullTask.StartDate
-	} else {
-		for _, status := range fullTask.Statuses {
-			if status.CreatedDate.After(comparisonTimestamp) {
-				comparisonTimestamp = status.CreatedDate
-				comparisonStatus = status.Status
+				// the usable transitions still apply, and the error is returned once they have, so it's recorded on the
+				// behavior
+				transitions, decodeErr = decodeTransitions(data)
+				if decodeErr != nil {
+					decodeErr = errors.Wrap(decodeErr, "failed decoding behavior")
+					log.Error(decodeErr)
+				}
 			}
 		}
-	}
 
-	log.Infof("Most recent timestamp for task %s: %s", ID, comparisonTimestamp)
+		// A task idle long enough for several hops takes all of them in this pass. Each hop is timed from when the one
+		// before it would have happened, and the first listed transition that is due from the current status wins. Each
+		// transition is applied at most once per pass, so a cycle of statuses can't loop forever.
+		applied := make([]bool, len(transitions))
+		for {
+			next := -1
+			for i, t := range transitions {
+				if !applied[i] && t.data.StartStatus == comparisonStatus && comparisonTimestamp.Add(t.timeout).Before(now) {
+					next = i
+					break
+				}
+			}
 
-	for _, behavior := range fullTask.Behaviors {
-		// only one of each type because of the DB FK
-		if behavior.BehaviorType == "statuschangetimeout" {
-			data, ok := behavior.Data["statuses"].([]interface{})
-			if !ok {
-				err = errors.New("Behavior data is not an array")
+			if next < 0 {
+				log.Infof("Task has no more transitions due given time %s and status '%s'", comparisonTimestamp, comparisonStatus)
+				break
+			}
+
+			applied[next] = true
+			taskData, timeout := transitions[next].data, transitions[next].timeout
+
+			newstatus := model.AsyncTaskStatus{Status: taskData.EndStatus}
+			if taskData.Name != "" {
+				newstatus.Detail = fmt.Sprintf("statuschangetimeout %s", taskData.Name)
+			}
+			err = tx.InsertInternalTaskStatus(ctx, newstatus, ID)
+			if err != nil {
+				// do die here, because the transaction is probably dead
+				err = errors.Wrap(err, "failed inserting task status")
 				log.Error(err)
 				return err
 			}
-			for _, datum := range data {
-				var taskData StatusChangeTimeoutData
-				err := mapstructure.Decode(datum, &taskData)
-				if err != nil {
-					// don't die here, let it try other behaviors
-					log.Error(errors.Wrap(err, "failed decoding behavior"))
-					continue
+			if taskData.Complete {
+				err = tx.CompleteTask(ctx, ID)
+				if errors.Is(err, database.ErrAlreadyComplete) {
+					// keep the original end date, but still apply the status change
+					log.Infof("Task %s was already complete", ID)
+				} else if err != nil {
+					// do die here, because the transaction is probably dead
+					err = errors.Wrap(err, "failed setting task complete")
+					log.Error(err)
+					return err
 				}
-
-				timeout, err := time.ParseDuration(taskData.Timeout)
+			}
+			if taskData.Delete {
+				err = tx.DeleteTask(ctx, ID)
 				if err != nil {
-					// don't die here, let it try other behaviors
-					log.Error(errors.Wrap(err, "failed parsing timeout duration"))
-					continue
+					// do die here, because the transaction is probably dead
+					err = errors.Wrap(err, "failed deleting task")
+					log.Error(err)
+					return err
 				}
+			}
+			updated = true
+			log.Infof("Updated task with time %s and timeout %s from '%s' to '%s' by transition '%s', set complete: %t, deleted: %t", comparisonTimestamp, timeout, comparisonStatus, taskData.EndStatus, taskData.Name, taskData.Complete, taskData.Delete)
 
-				if comparisonTimestamp.Add(timeout).Before(time.Now()) && comparisonStatus == taskData.StartStatus {
-					newstatus := model.AsyncTaskStatus{Status: taskData.EndStatus}
-					err = tx.InsertTaskStatus(ctx, newstatus, ID)
-					if err != nil {
-						// do die here, because the transaction is probably dead
-						err = errors.Wrap(err, "failed inserting task status")
-						log.Error(err)
-						return err
-					}
-					if taskData.Complete {
-						err = tx.CompleteTask(ctx, ID)
-						if err != nil {
-							// do die here, because the transaction is probably dead
-							err = errors.Wrap(err, "failed setting task complete")
-							log.Error(err)
-							return err
-						}
-					}
-					if taskData.Delete {
-						err = tx.DeleteTask(ctx, ID)
-						if err != nil {
-							// do die here, because the transaction is probably dead
-							err = errors.Wrap(err, "failed deleting task")
-							log.Error(err)
-							return err
-						}
-					}
-					log.Infof("Updated task with time %s and timeout %s from '%s' to '%s', set complete: %t, deleted: %t", comparisonTimestamp, timeout, comparisonStatus, taskData.EndStatus, taskData.Complete, taskData.Delete)
-				} else {
-					log.Infof("Task was not ready to update given time %s, timeout %s, and status '%s'", comparisonTimestamp, timeout, comparisonStatus)
-				}
+			if taskData.Delete {
+				// nothing is left to transition
+				break
 			}
+
+			comparisonTimestamp = comparisonTimestamp.Add(timeout)
+			comparisonStatus = taskData.EndStatus
 		}
-	}
 
-	err = tx.Commit()
+		return nil
+	})
 	if err != nil {
-		log.Error(errors.Wrap(err, "failed committing transaction"))
+		return false, err
 	}
 
-	return nil
+	return updated, decodeErr
 }
 
-func Processor(ctx context.Context, log *logrus.Entry, _ time.Time, db *database.DBConnection) error {
+// ProcessTask applies whatever transitions are due for one task, reporting whether any were
+func ProcessTask(ctx context.Context, log *logrus.Entry, db *database.DBConnection, ID string) (bool, error) {
+	return processSingleTask(ctx, log, time.Now(), db, ID)
+}
+
+// Processor applies the due transitions of every task with a statuschangetimeout behavior. Timeouts are judged against
+// the tick's time rather than the clock, so every task in a pass is measured against the same moment and a pass can
+// be run for any chosen time.
+func Processor(ctx context.Context, log *logrus.Entry, tickerTime time.Time, db *database.DBConnection) (behaviors.Result, error) {
+	var result behaviors.Result
+
 	filter := database.TaskFilter{
 		BehaviorTypes: []string{"statuschangetimeout"},
 	}
 
-	tx, err := db.BeginTx(ctx, nil)
-	if err != nil {
+	// the read transaction is closed before processing so it isn't held open across the per-task transactions
+	var tasks []model.AsyncTask
+	err := db.InTx(ctx, nil, func(tx *database.DBTx) error {
+		var err error
+		tasks, err = tx.GetTasksByFilter(ctx, filter, "end_date IS NOT NULL DESC")
 		return err
-	}
-	defer rollbackLogError(tx, log)
-
-	tasks, err := tx.GetTasksByFilter(ctx, filter, "end_date IS NOT NULL DESC")
+	})
 	if err != nil {
-		return err
+		return result, err
 	}
 
-	rollbackLogError(tx, log)
-
 	log.Infof("Tasks with statuschangetimeout behavior: %d", len(tasks))
 
 ProcessLoop:
@@ -160,11 +277,13 @@ ProcessLoop:
 		default:
 		}
 
-		err = processSingleTask(ctx, log, db, task.ID)
+		updated, err := processSingleTask(ctx, log, tickerTime, db, task.ID)
+		result.Record(updated, err)
+		behaviors.RecordOutcome(ctx, log, db, task.ID, "statuschangetimeout", updated, err)
 		if err != nil {
 			log.Error(errors.Wrap(err, "failed processing a task"))
 		}
 	}
 
-	return nil
+	return result, nil
 }
@@ -0,0 +1,177 @@
+package statuschangetimeout
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/cyverse-de/async-tasks/database"
+	"github.com/cyverse-de/async-tasks/database/dbtest"
+	"github.com/cyverse-de/async-tasks/model"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+func TestProcessorLogsNoRollbackErrors(t *testing.T) {
+	db := dbtest.New(t)
+	ctx := context.Background()
+	now := time.Now()
+
+	task := model.AsyncTask{
+		Type:     "test",
+		Statuses: []model.AsyncTaskStatus{{Status: "submitted", CreatedDate: now.Add(-2 * time.Hour)}},
+		Behaviors: []model.AsyncTaskBehavior{{
+			BehaviorType: "statuschangetimeout",
+			Data: map[string]interface{}{"statuses": []interface{}{
+				map[string]interface{}{"start_status": "submitted", "end_status": "timed-out", "timeout": "1h"},
+			}},
+		}},
+	}
+
+	var id string
+	err := db.InTx(ctx, nil, func(tx *database.DBTx) error {
+		var err error
+		id, err = tx.InsertTask(ctx, task)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logger, hook := test.NewNullLogger()
+	result, err := Processor(ctx, logrus.NewEntry(logger), now, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, entry := range hook.AllEntries() {
+		if entry.Level <= logrus.ErrorLevel {
+			t.Errorf("a normal run logged an error: %s", entry.Message)
+		}
+	}
+
+	if result.Updated != 1 || result.Errored != 0 {
+		t.Errorf("got %+v, want one task updated and no errors", result)
+	}
+
+	var latest *model.AsyncTaskStatus
+	err = db.InTx(ctx, nil, func(tx *database.DBTx) error {
+		fullTask, err := tx.GetTask(ctx, id, false)
+		if err != nil {
+			return err
+		}
+		latest = fullTask.LatestStatus()
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latest == nil || latest.Status != "timed-out" {
+		t.Errorf("got latest status %v, want timed-out", latest)
+	}
+}
+
+func TestProcessorChainsTransitions(t *testing.T) {
+	hop := func(start, end string) map[string]interface{} {
+		return map[string]interface{}{"start_status": start, "end_status": end, "timeout": "1h"}
+	}
+
+	tests := []struct {
+		name        string
+		transitions []interface{}
+		idle        time.Duration // how long the task has been in its first status
+		want        []string      // nil if the task should be deleted
+	}{
+		{
+			name:        "each hop timed from when the one before it was due",
+			transitions: []interface{}{hop("a", "b"), hop("b", "c")},
+			idle:        150 * time.Minute,
+			want:        []string{"a", "b", "c"},
+		},
+		{
+			name:        "later hop not due yet",
+			transitions: []interface{}{hop("a", "b"), hop("b", "c")},
+			idle:        90 * time.Minute,
+			want:        []string{"a", "b"},
+		},
+		{
+			name:        "first listed transition wins",
+			transitions: []interface{}{hop("a", "b"), hop("a", "c")},
+			idle:        90 * time.Minute,
+			want:        []string{"a", "b"},
+		},
+		{
+			name:        "each transition applied once per pass",
+			transitions: []interface{}{hop("a", "b"), hop("b", "a")},
+			idle:        10 * time.Hour,
+			want:        []string{"a", "b", "a"},
+		},
+		{
+			name: "delete ends the chain",
+			transitions: []interface{}{
+				map[string]interface{}{"start_status": "a", "end_status": "b", "timeout": "1h", "delete": true},
+				hop("b", "c"),
+			},
+			idle: 10 * time.Hour,
+			want: nil,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			db := dbtest.New(t)
+			ctx := context.Background()
+			tickerTime := time.Now()
+
+			task := model.AsyncTask{
+				Type:     "test",
+				Statuses: []model.AsyncTaskStatus{{Status: "a", CreatedDate: tickerTime.Add(-tc.idle)}},
+				Behaviors: []model.AsyncTaskBehavior{{
+					BehaviorType: "statuschangetimeout",
+					Data:         map[string]interface{}{"statuses": tc.transitions},
+				}},
+			}
+
+			var id string
+			err := db.InTx(ctx, nil, func(tx *database.DBTx) error {
+				var err error
+				id, err = tx.InsertTask(ctx, task)
+				return err
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			logger, _ := test.NewNullLogger()
+			if _, err = Processor(ctx, logrus.NewEntry(logger), tickerTime, db); err != nil {
+				t.Fatal(err)
+			}
+
+			var fullTask *model.AsyncTask
+			err = db.InTx(ctx, nil, func(tx *database.DBTx) error {
+				var err error
+				fullTask, err = tx.GetTask(ctx, id, false)
+				return err
+			})
+			if tc.want == nil {
+				if !errors.Is(err, database.ErrNotFound) {
+					t.Errorf("got error %v, want the task deleted", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got []string
+			for _, status := range fullTask.Statuses {
+				got = append(got, status.Status)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got statuses %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
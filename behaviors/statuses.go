@@ -0,0 +1,32 @@
+package behaviors
+
+import (
+	"slices"
+
+	"github.com/cyverse-de/async-tasks/model"
+)
+
+// EverHadStatus reports whether any of a task's statuses, not just its latest one, is the given status
+func EverHadStatus(statuses []model.AsyncTaskStatus, status string) bool {
+	for _, s := range statuses {
+		if s.Status == status {
+			return true
+		}
+	}
+	return false
+}
+
+// LatestStatus finds a task's latest status other than the ignored ones, by the same rule as model.AsyncTask's
+// LatestStatus: the most recent created date, with the last one listed winning a tie
+func LatestStatus(statuses []model.AsyncTaskStatus, ignored []string) *model.AsyncTaskStatus {
+	var latest *model.AsyncTaskStatus
+	for i, status := range statuses {
+		if slices.Contains(ignored, status.Status) {
+			continue
+		}
+		if latest == nil || !status.CreatedDate.Before(latest.CreatedDate) {
+			latest = &statuses[i]
+		}
+	}
+	return latest
+}
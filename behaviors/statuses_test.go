@@ -0,0 +1,52 @@
+package behaviors
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cyverse-de/async-tasks/model"
+)
+
+func TestLatestStatus(t *testing.T) {
+	early := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	late := early.Add(time.Second)
+	statuses := []model.AsyncTaskStatus{
+		{ID: "1", Status: "running", CreatedDate: early},
+		{ID: "2", Status: "succeeded", CreatedDate: late},
+		{ID: "3", Status: "heartbeat", CreatedDate: late},
+	}
+
+	tests := []struct {
+		name    string
+		ignored []string
+		want    string
+	}{
+		{"tie goes to the last listed", nil, "3"},
+		{"ignored statuses passed over", []string{"heartbeat"}, "2"},
+		{"falls back to older statuses", []string{"heartbeat", "succeeded"}, "1"},
+		{"everything ignored", []string{"heartbeat", "succeeded", "running"}, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var got string
+			if latest := LatestStatus(statuses, test.ignored); latest != nil {
+				got = latest.ID
+			}
+			if got != test.want {
+				t.Errorf("got '%s', want '%s'", got, test.want)
+			}
+		})
+	}
+}
+
+func TestEverHadStatus(t *testing.T) {
+	statuses := []model.AsyncTaskStatus{{Status: "submitted"}, {Status: "running"}}
+
+	if !EverHadStatus(statuses, "submitted") {
+		t.Error("an earlier status wasn't found")
+	}
+	if EverHadStatus(statuses, "failed") {
+		t.Error("a status the task never had was found")
+	}
+}
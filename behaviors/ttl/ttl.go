@@ -0,0 +1,214 @@
+package ttl
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/cyverse-de/async-tasks/behaviors"
+	"github.com/cyverse-de/async-tasks/database"
+	"github.com/cyverse-de/async-tasks/model"
+	"github.com/mitchellh/mapstructure"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// ExpiredStatus is the status recorded on a task instead of deleting it when soft_delete is set
+const ExpiredStatus = "expired"
+
+// defaultBatchSize is how many tasks are removed per transaction when the behavior doesn't say
+const defaultBatchSize = 100
+
+type TTLData struct {
+	TaskType   string `mapstructure:"task_type"`
+	MaxAge     string `mapstructure:"max_age"`
+	BatchSize  int    `mapstructure:"batch_size"`
+	SoftDelete bool   `mapstructure:"soft_delete"`
+}
+
+// ValidateData checks that a ttl behavior's data can be decoded and names a task type and a usable max age
+func ValidateData(data map[string]interface{}) error {
+	var ttlData TTLData
+	err := mapstructure.Decode(data, &ttlData)
+	if err != nil {
+		return err
+	}
+
+	if ttlData.TaskType == "" {
+		return errors.New("task_type must be provided")
+	}
+
+	maxAge, err := time.ParseDuration(ttlData.MaxAge)
+	if err != nil {
+		return errors.Wrap(err, "invalid max_age")
+	}
+	if maxAge <= 0 {
+		return fmt.Errorf("max_age must be positive, got %s", maxAge)
+	}
+
+	if ttlData.BatchSize < 0 {
+		return fmt.Errorf("batch_size must not be negative, got %d", ttlData.BatchSize)
+	}
+
+	return nil
+}
+
+// expireBatch removes, or marks as expired, up to one batch of tasks that completed before the cutoff. It returns the
+// IDs it handled, which is fewer than the batch size once there is nothing left to do.
+func expireBatch(ctx context.Context, db *database.DBConnection, data TTLData, cutoff time.Time, batchSize int) ([]string, error) {
+	completed := true
+	filter := database.TaskFilter{
+		Types:         []string{data.TaskType},
+		Completed:     &completed,
+		EndDateBefore: []time.Time{cutoff},
+		Limit:         uint64(batchSize),
+	}
+	if data.SoftDelete {
+		filter.ExcludeStatuses = []string{ExpiredStatus}
+	}
+
+	var ids []string
+	err := db.InTx(ctx, nil, func(tx *database.DBTx) error {
+		ids = nil
+
+		tasks, err := tx.GetTasksByFilter(ctx, filter, "end_date ASC")
+		if err != nil {
+			return errors.Wrap(err, "failed getting expired tasks")
+		}
+
+		for _, task := range tasks {
+			if data.SoftDelete {
+				newstatus := model.AsyncTaskStatus{Status: ExpiredStatus, Detail: fmt.Sprintf("completed more than %s ago", data.MaxAge)}
+				err = tx.InsertInternalTaskStatus(ctx, newstatus, task.ID)
+			} else {
+				err = tx.DeleteTask(ctx, task.ID)
+			}
+			if err != nil {
+				return errors.Wrapf(err, "failed expiring task %s", task.ID)
+			}
+			ids = append(ids, task.ID)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return ids, nil
+}
+
+// processSingleTask expires the tasks described by one ttl behavior, a batch at a time
+func processSingleTask(ctx context.Context, log *logrus.Entry, now time.Time, db *database.DBConnection, task model.AsyncTask) (bool, error) {
+	var taskBehaviors []model.AsyncTaskBehavior
+	err := db.InTx(ctx, nil, func(tx *database.DBTx) error {
+		var err error
+		taskBehaviors, err = tx.GetTaskBehaviors(ctx, task.ID)
+		return err
+	})
+	if err != nil {
+		return false, errors.Wrap(err, "failed getting task behaviors")
+	}
+
+	var updated bool
+	for _, behavior := range taskBehaviors {
+		// only one of each type because of the DB FK
+		if behavior.BehaviorType != "ttl" {
+			continue
+		}
+
+		var data TTLData
+		err = mapstructure.Decode(behavior.Data, &data)
+		if err != nil {
+			err = errors.Wrap(err, "failed decoding behavior")
+			log.Error(err)
+			return false, err
+		}
+
+		maxAge, err := time.ParseDuration(data.MaxAge)
+		if err != nil {
+			err = errors.Wrap(err, "failed parsing max_age duration")
+			log.Error(err)
+			return false, err
+		}
+
+		batchSize := data.BatchSize
+		if batchSize <= 0 {
+			batchSize = defaultBatchSize
+		}
+
+		cutoff := now.Add(-maxAge)
+
+		for {
+			select {
+			// If the context is cancelled, stop between batches
+			case <-ctx.Done():
+				return updated, nil
+			default:
+			}
+
+			ids, err := expireBatch(ctx, db, data, cutoff, batchSize)
+			if err != nil {
+				log.Error(err)
+				return false, err
+			}
+
+			if len(ids) > 0 {
+				updated = true
+				if data.SoftDelete {
+					log.Infof("Marked %d %s tasks completed before %s as expired: %v", len(ids), data.TaskType, cutoff, ids)
+				} else {
+					log.Infof("Deleted %d %s tasks completed before %s: %v", len(ids), data.TaskType, cutoff, ids)
+				}
+			}
+
+			if len(ids) < batchSize {
+				break
+			}
+		}
+	}
+
+	return updated, nil
+}
+
+// Processor expires old completed tasks for every ttl behavior. Like other processors it runs under the updater's
+// per-behavior lock, so only one instance deletes at a time.
+func Processor(ctx context.Context, log *logrus.Entry, tickerTime time.Time, db *database.DBConnection) (behaviors.Result, error) {
+	var result behaviors.Result
+
+	filter := database.TaskFilter{
+		BehaviorTypes: []string{"ttl"},
+	}
+
+	var tasks []model.AsyncTask
+	err := db.InTx(ctx, nil, func(tx *database.DBTx) error {
+		var err error
+		tasks, err = tx.GetTasksByFilter(ctx, filter, "")
+		return err
+	})
+	if err != nil {
+		return result, err
+	}
+
+	log.Infof("Tasks with ttl behavior: %d", len(tasks))
+
+ProcessLoop:
+	for _, task := range tasks {
+		select {
+		// If the context is cancelled, don't bother
+		case <-ctx.Done():
+			log.Info("Not continuing to process tasks due to a canceled context.")
+			break ProcessLoop
+		default:
+		}
+
+		updated, err := processSingleTask(ctx, log, tickerTime, db, task)
+		result.Record(updated, err)
+		behaviors.RecordOutcome(ctx, log, db, task.ID, "ttl", updated, err)
+		if err != nil {
+			log.Error(errors.Wrap(err, "failed processing a task"))
+		}
+	}
+
+	return result, nil
+}
@@ -0,0 +1,282 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/cyverse-de/async-tasks/behaviors"
+	"github.com/cyverse-de/async-tasks/database"
+	"github.com/cyverse-de/async-tasks/model"
+	"github.com/mitchellh/mapstructure"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// sentStatusKey is the key in the behavior's state holding the ID of the status the webhook was last sent for, so it
+// isn't sent twice for the same status
+const sentStatusKey = "sent_status_id"
+
+const requestTimeout = 30 * time.Second
+
+var client = &http.Client{Timeout: requestTimeout}
+
+// OutboxKind is the kind of the outbox messages webhook behaviors queue
+const OutboxKind = "webhook"
+
+// queueInOutbox makes webhook behaviors write their requests to the outbox instead of sending them directly
+var queueInOutbox bool
+
+// QueueInOutbox makes webhook behaviors queue their requests in the outbox, in the same transaction as the state that
+// records them, for the outbox dispatcher to send with SendOutboxMessage. Call it before behaviors are processed.
+func QueueInOutbox() {
+	queueInOutbox = true
+}
+
+// outboxPayload is a webhook request waiting in the outbox, with the task as it was when the webhook was triggered
+type outboxPayload struct {
+	Method string          `json:"method"`
+	URL    string          `json:"url"`
+	Task   json.RawMessage `json:"task"`
+}
+
+type WebhookData struct {
+	URL      string   `mapstructure:"url"`
+	Method   string   `mapstructure:"method"`
+	Statuses []string `mapstructure:"statuses"`
+}
+
+// ValidateData checks that a webhook behavior's data can be decoded and has a URL to send to
+func ValidateData(data map[string]interface{}) error {
+	var webhookData WebhookData
+	err := mapstructure.Decode(data, &webhookData)
+	if err != nil {
+		return err
+	}
+
+	if webhookData.URL == "" {
+		return errors.New("url must be provided")
+	}
+
+	if len(webhookData.Statuses) == 0 {
+		return errors.New("statuses must list at least one status")
+	}
+
+	return nil
+}
+
+// sendWebhook sends a task's JSON to a webhook. A non-empty idempotency key is passed along in the Idempotency-Key
+// header, so receivers can recognize a request that's sent more than once.
+func sendWebhook(ctx context.Context, method string, url string, body []byte, idempotencyKey string) error {
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if idempotencyKey != "" {
+		req.Header.Set("Idempotency-Key", idempotencyKey)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned status %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// SendOutboxMessage sends a webhook request that was queued in the outbox, using the message's ID as its
+// Idempotency-Key
+func SendOutboxMessage(ctx context.Context, message database.OutboxMessage) error {
+	var payload outboxPayload
+	if err := json.Unmarshal(message.Payload, &payload); err != nil {
+		return errors.Wrap(err, "failed decoding outbox payload")
+	}
+
+	return sendWebhook(ctx, payload.Method, payload.URL, payload.Task, message.ID)
+}
+
+func processSingleTask(ctx context.Context, log *logrus.Entry, db *database.DBConnection, ID string) (bool, error) {
+	select {
+	// If the context is cancelled, don't bother
+	case <-ctx.Done():
+		return false, nil
+	default:
+	}
+
+	var updated bool
+	err := db.InTx(ctx, nil, func(tx *database.DBTx) error {
+		updated = false
+
+		fullTask, err := tx.GetTask(ctx, ID, true)
+		if errors.Is(err, database.ErrNotFound) {
+			// the task was deleted after it was listed, so there's nothing left to do
+			log.Infof("task %s no longer exists", ID)
+			return nil
+		}
+		if err != nil {
+			err = errors.Wrap(err, "failed getting task")
+			log.Error(err)
+			return err
+		}
+
+		latest := fullTask.LatestStatus()
+		if latest == nil {
+			log.Infof("Task %s has no statuses yet", ID)
+			return nil
+		}
+
+		for _, behavior := range fullTask.Behaviors {
+			// only one of each type because of the DB FK
+			if behavior.BehaviorType != "webhook" {
+				continue
+			}
+
+			var data WebhookData
+			err = mapstructure.Decode(behavior.Data, &data)
+			if err != nil {
+				err = errors.Wrap(err, "failed decoding behavior")
+				log.Error(err)
+				return err
+			}
+
+			if data.URL == "" {
+				err = errors.New("Behavior data has no url")
+				log.Error(err)
+				return err
+			}
+
+			if data.Method == "" {
+				data.Method = http.MethodPost
+			}
+
+			triggered := false
+			for _, status := range data.Statuses {
+				if status == latest.Status {
+					triggered = true
+					break
+				}
+			}
+
+			if !triggered {
+				log.Infof("Task %s is in status '%s', which does not trigger its webhook", ID, latest.Status)
+				continue
+			}
+
+			if sentID, _ := behavior.State[sentStatusKey].(string); sentID == latest.ID {
+				log.Infof("Task %s has already had its webhook sent for status '%s'", ID, latest.Status)
+				continue
+			}
+
+			jsoned, err := json.Marshal(fullTask)
+			if err != nil {
+				err = errors.Wrap(err, "failed encoding task")
+				log.Error(err)
+				return err
+			}
+
+			detail := fmt.Sprintf("%s %s on status '%s'", data.Method, data.URL, latest.Status)
+			if queueInOutbox {
+				payload, err := json.Marshal(outboxPayload{Method: data.Method, URL: data.URL, Task: jsoned})
+				if err != nil {
+					err = errors.Wrap(err, "failed encoding outbox payload")
+					log.Error(err)
+					return err
+				}
+
+				// keyed by the triggering status, so the same status change is never queued twice
+				_, err = tx.InsertOutboxMessage(ctx, ID, OutboxKind, OutboxKind+":"+latest.ID, payload)
+				if err != nil {
+					err = errors.Wrap(err, "failed queueing webhook in the outbox")
+					log.Error(err)
+					return err
+				}
+				detail = "queued " + detail
+			} else {
+				err = sendWebhook(ctx, data.Method, data.URL, jsoned, "")
+				if err != nil {
+					// don't mark it sent, so it's retried on the next tick
+					err = errors.Wrapf(err, "failed sending webhook to %s", data.URL)
+					log.Error(err)
+					return err
+				}
+			}
+
+			// kept in the behavior's state rather than as a status, so the task's latest status stays the one that
+			// triggered the webhook
+			err = tx.SetBehaviorState(ctx, ID, behavior.BehaviorType, map[string]interface{}{sentStatusKey: latest.ID})
+			if err != nil {
+				err = errors.Wrap(err, "failed recording webhook as sent")
+				log.Error(err)
+				if !queueInOutbox {
+					// running the transaction again would send the webhook again
+					return database.NotRetryable(err)
+				}
+				return err
+			}
+
+			updated = true
+			log.Infof("Handled webhook for task %s: %s", ID, detail)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return updated, nil
+}
+
+// ProcessTask sends one task's webhook if its latest status calls for it, reporting whether it was sent
+func ProcessTask(ctx context.Context, log *logrus.Entry, db *database.DBConnection, ID string) (bool, error) {
+	return processSingleTask(ctx, log, db, ID)
+}
+
+func Processor(ctx context.Context, log *logrus.Entry, _ time.Time, db *database.DBConnection) (behaviors.Result, error) {
+	var result behaviors.Result
+
+	filter := database.TaskFilter{
+		BehaviorTypes: []string{"webhook"},
+	}
+
+	var tasks []model.AsyncTask
+	err := db.InTx(ctx, nil, func(tx *database.DBTx) error {
+		var err error
+		tasks, err = tx.GetTasksByFilter(ctx, filter, "")
+		return err
+	})
+	if err != nil {
+		return result, err
+	}
+
+	log.Infof("Tasks with webhook behavior: %d", len(tasks))
+
+ProcessLoop:
+	for _, task := range tasks {
+		select {
+		// If the context is cancelled, don't bother
+		case <-ctx.Done():
+			log.Info("Not continuing to process tasks due to a canceled context.")
+			break ProcessLoop
+		default:
+		}
+
+		updated, err := processSingleTask(ctx, log, db, task.ID)
+		result.Record(updated, err)
+		behaviors.RecordOutcome(ctx, log, db, task.ID, "webhook", updated, err)
+		if err != nil {
+			log.Error(errors.Wrap(err, "failed processing a task"))
+		}
+	}
+
+	return result, nil
+}
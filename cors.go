@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// corsPathPrefix limits CORS handling to the task API. It's relative to the base path.
+const corsPathPrefix = "/tasks"
+
+// corsExposedHeaders are the response headers browsers may read besides the CORS-safelisted ones
+var corsExposedHeaders = []string{"ETag", "Location", requestIDHeader, "X-Total-Count"}
+
+// CORSConfig lists the browser origins allowed to call the task API and the methods they may use. An empty
+// AllowedOrigins turns CORS off; "*" allows any origin.
+type CORSConfig struct {
+	AllowedOrigins []string
+	AllowedMethods []string
+}
+
+func (c CORSConfig) originAllowed(origin string) bool {
+	for _, allowed := range c.AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// corsMiddleware adds CORS headers to task API responses for allowed origins and answers their preflight requests. It
+// wraps the whole router rather than being added with Use, since mux only runs middleware for matched routes and would
+// otherwise reject preflight OPTIONS requests as not allowed before the headers could be added. Being outside the
+// router, it sees the full path, so it needs the base path the routes are under.
+func corsMiddleware(config CORSConfig, basePath string) func(http.Handler) http.Handler {
+	prefix := basePath + corsPathPrefix
+
+	return func(next http.Handler) http.Handler {
+		if len(config.AllowedOrigins) == 0 {
+			return next
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			origin := r.Header.Get("Origin")
+			if origin == "" || !strings.HasPrefix(r.URL.Path, prefix) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			header := w.Header()
+			header.Add("Vary", "Origin")
+
+			if !config.originAllowed(origin) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			header.Set("Access-Control-Allow-Origin", origin)
+
+			if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+				header.Add("Vary", "Access-Control-Request-Method")
+				header.Add("Vary", "Access-Control-Request-Headers")
+				header.Set("Access-Control-Allow-Methods", strings.Join(config.AllowedMethods, ", "))
+				if requested := r.Header.Get("Access-Control-Request-Headers"); requested != "" {
+					header.Set("Access-Control-Allow-Headers", requested)
+				}
+				header.Set("Access-Control-Max-Age", "600")
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+
+			header.Set("Access-Control-Expose-Headers", strings.Join(corsExposedHeaders, ", "))
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/cyverse-de/async-tasks/model"
+)
+
+const csvContentType = "text/csv"
+
+// csvColumns is the header row of CSV task listings. The data column holds each task's data serialized as JSON, since
+// its keys differ between task types and can't be flattened into fixed columns.
+var csvColumns = []string{"id", "type", "username", "start_date", "end_date", "latest_status", "data"}
+
+// formatCSVDate formats an optional date for a CSV cell, leaving it empty if it isn't set
+func formatCSVDate(date *time.Time) string {
+	if date == nil {
+		return ""
+	}
+	return date.Format(time.RFC3339Nano)
+}
+
+// taskCSVRecord lays out a task as a CSV row in the order of csvColumns. The task's statuses must have been loaded for
+// its latest status to be filled in.
+func taskCSVRecord(task *model.AsyncTask) ([]string, error) {
+	var latestStatus string
+	if latest := task.LatestStatus(); latest != nil {
+		latestStatus = latest.Status
+	}
+
+	data, err := json.Marshal(task.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	return []string{
+		task.ID,
+		task.Type,
+		task.Username,
+		formatCSVDate(task.StartDate),
+		formatCSVDate(task.EndDate),
+		latestStatus,
+		string(data),
+	}, nil
+}
@@ -11,6 +11,9 @@ import (
 	"github.com/lib/pq"
 
 	"errors"
+	"fmt"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/sirupsen/logrus"
@@ -18,20 +21,71 @@ import (
 	"encoding/json"
 )
 
+// BehaviorProcessorTypePrefix starts the type of the internal tasks the updater uses as locks for behavior processors
+const BehaviorProcessorTypePrefix = "behaviorprocessor-"
+
+// ErrNotFound is returned when a task, or a status or behavior of a task, doesn't exist
+var ErrNotFound = errors.New("not found")
+
+// ErrConflict is returned when a change conflicts with the current state of a task
+var ErrConflict = errors.New("conflict")
+
+// translateError maps database errors with a well-known meaning onto ErrNotFound and ErrConflict
+func translateError(err error) error {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) {
+		return err
+	}
+
+	switch pqErr.Code.Name() {
+	case "unique_violation":
+		return fmt.Errorf("%w: %s", ErrConflict, pqErr.Message)
+	case "foreign_key_violation":
+		return fmt.Errorf("%w: %s", ErrNotFound, pqErr.Message)
+	default:
+		return err
+	}
+}
+
+// ErrTooManyStatuses is returned when adding a status to a task that already has as many as its StatusLimit allows
+var ErrTooManyStatuses = fmt.Errorf("%w: task has reached its limit of statuses", ErrConflict)
+
+// StatusLimit caps how many statuses a task may have, protecting the service from clients that post statuses without
+// end. A zero Max means no cap. Past the cap, new statuses are rejected with ErrTooManyStatuses, or if Prune is set,
+// the task's oldest statuses are deleted to make room. Pruning never deletes a task's latest status, the statuses
+// behaviors recorded, or any status listed in Keep, such as terminal ones, and statuses behaviors add are never
+// rejected, so a runaway client can't keep a task's automation from working.
+type StatusLimit struct {
+	Max   int64
+	Prune bool
+	Keep  []string
+}
+
 // DBConnection wraps a sql.DB
 type DBConnection struct {
-	db  *sql.DB
-	log *logrus.Entry
+	db          *sql.DB
+	log         *logrus.Entry
+	statusLimit StatusLimit
+	retryConfig RetryConfig
 }
 
 // DBTx wraps a sql.Tx for this DB
 type DBTx struct {
-	tx  *sql.Tx
-	log *logrus.Entry
+	tx          *sql.Tx
+	log         *logrus.Entry
+	statusLimit StatusLimit
 }
 
-// SetupDB initializes a DBConnection for the given dbURI
-func SetupDB(dbURI string, log *logrus.Entry) (*DBConnection, error) {
+// PoolConfig limits the connections the database pool keeps open. As with sql.DB, a zero MaxOpenConns or
+// ConnMaxLifetime means no limit, while a zero MaxIdleConns keeps no idle connections.
+type PoolConfig struct {
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+}
+
+// SetupDB initializes a DBConnection for the given dbURI, with its connection pool limited by pool
+func SetupDB(dbURI string, pool PoolConfig, log *logrus.Entry) (*DBConnection, error) {
 	log.Info("Connecting to the database...")
 
 	connector, err := dbutil.NewDefaultConnector("1m")
@@ -46,6 +100,12 @@ func SetupDB(dbURI string, log *logrus.Entry) (*DBConnection, error) {
 
 	log.Info("Created database connector")
 
+	db.SetMaxOpenConns(pool.MaxOpenConns)
+	db.SetMaxIdleConns(pool.MaxIdleConns)
+	db.SetConnMaxLifetime(pool.ConnMaxLifetime)
+
+	log.Infof("Database pool allows %d open connections, %d idle connections, and a connection lifetime of %s", pool.MaxOpenConns, pool.MaxIdleConns, pool.ConnMaxLifetime)
+
 	if err = db.Ping(); err != nil {
 		return nil, err
 	}
@@ -60,6 +120,21 @@ func (d *DBConnection) Close() error {
 	return d.db.Close()
 }
 
+// Ping defers to sql.DB PingContext()
+func (d *DBConnection) Ping(ctx context.Context) error {
+	return d.db.PingContext(ctx)
+}
+
+// SetStatusLimit sets the cap on statuses per task for transactions begun after it's called
+func (d *DBConnection) SetStatusLimit(limit StatusLimit) {
+	d.statusLimit = limit
+}
+
+// SetRetry sets how transient errors are retried by BeginTx and InTx
+func (d *DBConnection) SetRetry(config RetryConfig) {
+	d.retryConfig = config
+}
+
 // GetCount gets a count of async tasks in the DB
 func (d *DBConnection) GetCount(ctx context.Context) (int64, error) {
 	var res struct{ count int64 }
@@ -70,13 +145,19 @@ func (d *DBConnection) GetCount(ctx context.Context) (int64, error) {
 	return res.count, nil
 }
 
-// BeginTx starts a DBTx for the given DBConnection
+// BeginTx starts a DBTx for the given DBConnection, retrying if the connection fails. Nothing has run in the
+// transaction yet, so that's always safe.
 func (d *DBConnection) BeginTx(ctx context.Context, opts *sql.TxOptions) (*DBTx, error) {
-	tx, err := d.db.BeginTx(ctx, opts)
+	var tx *sql.Tx
+	err := d.retry(ctx, "beginning a transaction", func() error {
+		var err error
+		tx, err = d.db.BeginTx(ctx, opts)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
-	return &DBTx{tx: tx, log: d.log}, nil
+	return &DBTx{tx: tx, log: d.log, statusLimit: d.statusLimit}, nil
 }
 
 // Rollback defers to underlying Rollback
@@ -92,14 +173,15 @@ func (t *DBTx) Commit() error {
 var psql squirrel.StatementBuilderType = squirrel.StatementBuilder.PlaceholderFormat(squirrel.Dollar)
 
 var baseTaskSelect squirrel.SelectBuilder = psql.Select(
-	"id", "type", "username", "data",
+	"async_tasks.id", "type", "username", "source", "data", "tags",
 	"start_date at time zone (select current_setting('TIMEZONE'))",
 	"end_date at time zone (select current_setting('TIMEZONE'))",
+	"claimed_by", "claimed_until",
 ).From("async_tasks")
 
-// getBaseTask fetches a task from the database by ID (sans behaviors/statuses)
+// getBaseTask fetches a task from the database by ID (sans behaviors/statuses), returning ErrNotFound if it doesn't exist
 func (t *DBTx) getBaseTask(ctx context.Context, id string, forUpdate bool) (*model.AsyncTask, error) {
-	query := baseTaskSelect.Where("id::text = ?", id)
+	query := baseTaskSelect.Where("id = ?", id)
 
 	if forUpdate {
 		query = query.Suffix(" FOR UPDATE")
@@ -112,19 +194,57 @@ func (t *DBTx) getBaseTask(ctx context.Context, id string, forUpdate bool) (*mod
 	defer rows.Close()
 
 	var dbtask model.DBTask
+	var found bool
 	for rows.Next() {
-		if err := rows.Scan(&dbtask.ID, &dbtask.Type, &dbtask.Username, &dbtask.Data, &dbtask.StartDate, &dbtask.EndDate); err != nil {
+		if err := rows.Scan(&dbtask.ID, &dbtask.Type, &dbtask.Username, &dbtask.Source, &dbtask.Data, &dbtask.Tags, &dbtask.StartDate, &dbtask.EndDate, &dbtask.ClaimedBy, &dbtask.ClaimedUntil); err != nil {
 			return nil, err
 		}
+		found = true
 	}
 
 	if err = rows.Err(); err != nil {
 		return nil, err
 	}
 
+	if !found {
+		return nil, ErrNotFound
+	}
+
 	return makeTask(dbtask)
 }
 
+// TaskExists checks whether a task with the given ID exists, without loading it
+func (t *DBTx) TaskExists(ctx context.Context, id string) (bool, error) {
+	var exists bool
+
+	query := psql.Select("1").From("async_tasks").Where("id = ?", id).Prefix("SELECT EXISTS (").Suffix(")")
+
+	err := query.RunWith(t.tx).QueryRowContext(ctx).Scan(&exists)
+	if err != nil {
+		return false, err
+	}
+
+	return exists, nil
+}
+
+// GetTaskUpdatedAt returns the last time a task, or one of its statuses or behaviors, changed. ErrNotFound is returned
+// if the task doesn't exist.
+func (t *DBTx) GetTaskUpdatedAt(ctx context.Context, id string) (time.Time, error) {
+	var updatedAt time.Time
+
+	query := psql.Select("updated_at").From("async_tasks").Where("id = ?", id)
+
+	err := query.RunWith(t.tx).QueryRowContext(ctx).Scan(&updatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return time.Time{}, ErrNotFound
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return updatedAt, nil
+}
+
 func makeTask(dbtask model.DBTask) (*model.AsyncTask, error) {
 	var err error
 	task := &model.AsyncTask{ID: dbtask.ID, Type: dbtask.Type}
@@ -133,6 +253,18 @@ func makeTask(dbtask model.DBTask) (*model.AsyncTask, error) {
 		task.Username = dbtask.Username.String
 	}
 
+	if dbtask.Source.Valid {
+		task.Source = dbtask.Source.String
+	}
+
+	// an expired claim is as good as no claim, so it isn't shown
+	if dbtask.ClaimedBy.Valid && (!dbtask.ClaimedUntil.Valid || dbtask.ClaimedUntil.Time.After(time.Now())) {
+		task.ClaimedBy = dbtask.ClaimedBy.String
+		if dbtask.ClaimedUntil.Valid {
+			task.ClaimedUntil = &dbtask.ClaimedUntil.Time
+		}
+	}
+
 	if dbtask.Data.Valid {
 		jsonData := make(map[string]interface{})
 
@@ -144,6 +276,12 @@ func makeTask(dbtask model.DBTask) (*model.AsyncTask, error) {
 		task.Data = jsonData
 	}
 
+	if dbtask.Tags.Valid {
+		if err = json.Unmarshal([]byte(dbtask.Tags.String), &task.Tags); err != nil {
+			return task, err
+		}
+	}
+
 	if dbtask.StartDate.Valid {
 		task.StartDate = &dbtask.StartDate.Time
 	}
@@ -157,7 +295,7 @@ func makeTask(dbtask model.DBTask) (*model.AsyncTask, error) {
 
 // DeleteTask deletes a task from the database by ID
 func (t *DBTx) DeleteTask(ctx context.Context, id string) error {
-	query := psql.Delete("async_tasks").Where("id::text = ?", id)
+	query := psql.Delete("async_tasks").Where("id = ?", id)
 
 	_, err := query.RunWith(t.tx).ExecContext(ctx)
 	if err != nil {
@@ -167,9 +305,195 @@ func (t *DBTx) DeleteTask(ctx context.Context, id string) error {
 	return nil
 }
 
-// CompleteTask marks a task as ended by setting the end date to now()
+// DeleteTasks deletes the tasks with the given IDs in one statement, returning the IDs of the tasks that existed and
+// were deleted
+func (t *DBTx) DeleteTasks(ctx context.Context, ids []string) ([]string, error) {
+	query := psql.Delete("async_tasks").Where("id = ANY(?::uuid[])", pq.Array(ids)).Suffix("RETURNING id::text")
+
+	rows, err := query.RunWith(t.tx).QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var deleted []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		deleted = append(deleted, id)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return deleted, nil
+}
+
+// DeleteTasksByFilter deletes every task matching a set of provided filters, ignoring any limit or offset, and returns
+// how many were deleted
+func (t *DBTx) DeleteTasksByFilter(ctx context.Context, filters TaskFilter) (int64, error) {
+	// the subquery keeps ? placeholders so they're numbered along with the outer statement's
+	matching := t.applyTaskFilter(squirrel.Select("async_tasks.id").From("async_tasks"), filters)
+	query := psql.Delete("async_tasks").Where(squirrel.Expr("id IN (?)", matching))
+
+	result, err := query.RunWith(t.tx).ExecContext(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+// ErrAlreadyComplete is returned when trying to complete a task that already has an end date
+var ErrAlreadyComplete = fmt.Errorf("%w: task is already complete", ErrConflict)
+
+// CompleteTask marks a task as ended by setting the end date to now(). If the task already has an end date it is left
+// alone and ErrAlreadyComplete is returned, so the original completion time is kept.
 func (t *DBTx) CompleteTask(ctx context.Context, id string) error {
-	query := psql.Update("async_tasks").Set("end_date", squirrel.Expr("now()")).Where("id::text = ?", id)
+	query := psql.Update("async_tasks").Set("end_date", squirrel.Expr("now()")).Where("id = ?", id).Where("end_date IS NULL")
+
+	result, err := query.RunWith(t.tx).ExecContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return ErrAlreadyComplete
+	}
+
+	return nil
+}
+
+// ErrNotComplete is returned when trying to reopen a task that has no end date
+var ErrNotComplete = fmt.Errorf("%w: task is not complete", ErrConflict)
+
+// ReopenTask clears a task's end date so it counts as outstanding again. If the task has no end date ErrNotComplete is
+// returned.
+func (t *DBTx) ReopenTask(ctx context.Context, id string) error {
+	query := psql.Update("async_tasks").Set("end_date", nil).Where("id = ?", id).Where("end_date IS NOT NULL")
+
+	result, err := query.RunWith(t.tx).ExecContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return ErrNotComplete
+	}
+
+	return nil
+}
+
+// activeClaim matches tasks held by a claim that hasn't expired
+const activeClaim = "(claimed_by IS NOT NULL AND (claimed_until IS NULL OR claimed_until > now()))"
+
+// ErrClaimed is returned when trying to claim or release a task that another worker has claimed
+var ErrClaimed = fmt.Errorf("%w: task is claimed by another worker", ErrConflict)
+
+// ClaimTask marks a task as claimed by a worker. A lease makes the claim expire after that long, and a zero lease
+// keeps it until it's released. A worker may claim a task it already holds again, which replaces its lease. If
+// another worker holds an unexpired claim on the task ErrClaimed is returned.
+func (t *DBTx) ClaimTask(ctx context.Context, id string, worker string, lease time.Duration) error {
+	var claimedUntil interface{}
+	if lease > 0 {
+		claimedUntil = squirrel.Expr("now() + ? * interval '1 microsecond'", lease.Microseconds())
+	}
+
+	query := psql.Update("async_tasks").
+		Set("claimed_by", worker).
+		Set("claimed_until", claimedUntil).
+		Where("id = ?", id).
+		Where("(claimed_by = ? OR NOT "+activeClaim+")", worker)
+
+	return t.claimResult(ctx, id, query)
+}
+
+// ReleaseTask drops a worker's claim on a task. Releasing a task nobody holds does nothing, but if another worker
+// holds an unexpired claim on it ErrClaimed is returned.
+func (t *DBTx) ReleaseTask(ctx context.Context, id string, worker string) error {
+	query := psql.Update("async_tasks").
+		Set("claimed_by", nil).
+		Set("claimed_until", nil).
+		Where("id = ?", id).
+		Where("(claimed_by IS NULL OR claimed_by = ? OR NOT "+activeClaim+")", worker)
+
+	return t.claimResult(ctx, id, query)
+}
+
+// claimResult runs a claim or release, telling a missing task apart from one held by another worker when nothing
+// was updated
+func (t *DBTx) claimResult(ctx context.Context, id string, query squirrel.UpdateBuilder) error {
+	result, err := query.RunWith(t.tx).ExecContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated > 0 {
+		return nil
+	}
+
+	exists, err := t.TaskExists(ctx, id)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrNotFound
+	}
+	return ErrClaimed
+}
+
+// UpdateTaskType changes a task's type
+func (t *DBTx) UpdateTaskType(ctx context.Context, id string, taskType string) error {
+	if taskType == "" {
+		return errors.New("Task type must be provided")
+	}
+
+	query := psql.Update("async_tasks").Set("type", taskType).Where("id = ?", id)
+
+	result, err := query.RunWith(t.tx).ExecContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+// UpdateTaskData replaces the data for a task with the provided data, or clears it if the data is empty
+func (t *DBTx) UpdateTaskData(ctx context.Context, id string, data map[string]interface{}) error {
+	query := psql.Update("async_tasks").Where("id = ?", id)
+
+	if len(data) > 0 {
+		jsoned, err := json.Marshal(data)
+		if err != nil {
+			return err
+		}
+		query = query.Set("data", jsoned)
+	} else {
+		query = query.Set("data", nil)
+	}
 
 	rows, err := query.RunWith(t.tx).QueryContext(ctx)
 	if err != nil {
@@ -185,7 +509,8 @@ func (t *DBTx) CompleteTask(ctx context.Context, id string) error {
 	return nil
 }
 
-// GetTask fetches a task from the database by ID, including behaviors and statuses
+// GetTask fetches a task from the database by ID, including behaviors and statuses. ErrNotFound is returned if the task
+// doesn't exist.
 func (t *DBTx) GetTask(ctx context.Context, id string, forUpdate bool) (*model.AsyncTask, error) {
 	task, err := t.getBaseTask(ctx, id, forUpdate)
 	if err != nil {
@@ -209,13 +534,31 @@ func (t *DBTx) GetTask(ctx context.Context, id string, forUpdate bool) (*model.A
 	return task, err
 }
 
+// GetTaskSansStatuses fetches a task and its behaviors from the DB by ID, but not its statuses, which can be many. Use
+// GetTaskStatuses to fetch some of them.
+func (t *DBTx) GetTaskSansStatuses(ctx context.Context, id string, forUpdate bool) (*model.AsyncTask, error) {
+	task, err := t.getBaseTask(ctx, id, forUpdate)
+	if err != nil {
+		return task, err
+	}
+
+	behaviors, err := t.getTaskBehaviors(ctx, id, forUpdate)
+	if err != nil {
+		return task, err
+	}
+	task.Behaviors = behaviors
+	task.BehaviorsLoaded = true
+
+	return task, nil
+}
+
 var baseTaskBehaviorSelect squirrel.SelectBuilder = psql.Select(
-	"behavior_type", "data",
+	"behavior_type", "data", "last_error", "last_error_date", "state",
 ).From("async_task_behavior")
 
 // getTaskBehaviors fetches a task's set of behaviors from the DB by ID
 func (t *DBTx) getTaskBehaviors(ctx context.Context, id string, forUpdate bool) ([]model.AsyncTaskBehavior, error) {
-	query := baseTaskBehaviorSelect.Where("async_task_id::text = ?", id)
+	query := baseTaskBehaviorSelect.Where("async_task_id = ?", id)
 
 	if forUpdate {
 		query = query.Suffix(" FOR UPDATE")
@@ -230,11 +573,17 @@ func (t *DBTx) getTaskBehaviors(ctx context.Context, id string, forUpdate bool)
 	var behaviors []model.AsyncTaskBehavior
 	for rows.Next() {
 		var dbbehavior model.DBTaskBehavior
-		if err := rows.Scan(&dbbehavior.BehaviorType, &dbbehavior.Data); err != nil {
+		if err := rows.Scan(&dbbehavior.BehaviorType, &dbbehavior.Data, &dbbehavior.LastError, &dbbehavior.LastErrorDate, &dbbehavior.State); err != nil {
 			return nil, err
 		}
 
 		behavior := model.AsyncTaskBehavior{BehaviorType: dbbehavior.BehaviorType}
+		if dbbehavior.LastError.Valid {
+			behavior.LastError = dbbehavior.LastError.String
+		}
+		if dbbehavior.LastErrorDate.Valid {
+			behavior.LastErrorDate = &dbbehavior.LastErrorDate.Time
+		}
 		if dbbehavior.Data.Valid {
 			jsonData := make(map[string]interface{})
 
@@ -245,6 +594,11 @@ func (t *DBTx) getTaskBehaviors(ctx context.Context, id string, forUpdate bool)
 
 			behavior.Data = jsonData
 		}
+		if dbbehavior.State.Valid {
+			if err = json.Unmarshal([]byte(dbbehavior.State.String), &behavior.State); err != nil {
+				return behaviors, err
+			}
+		}
 
 		behaviors = append(behaviors, behavior)
 	}
@@ -252,18 +606,66 @@ func (t *DBTx) getTaskBehaviors(ctx context.Context, id string, forUpdate bool)
 	return behaviors, nil
 }
 
+// GetTaskBehaviors fetches just a task's set of behaviors from the DB by ID
+func (t *DBTx) GetTaskBehaviors(ctx context.Context, id string) ([]model.AsyncTaskBehavior, error) {
+	return t.getTaskBehaviors(ctx, id, false)
+}
+
 var baseTaskStatusSelect squirrel.SelectBuilder = psql.Select(
-	"status", "detail", "created_date at time zone (select current_setting('TIMEZONE'))",
+	"id::text", "status", "detail", "created_date at time zone (select current_setting('TIMEZONE'))",
 ).From("async_task_status")
 
-// getTaskStatuses fetches a tasks's list of statuses from the DB by ID, ordered by creation date
+// getTaskStatuses fetches a tasks's list of statuses from the DB by ID, ordered by creation date and then ID, so the
+// last one listed is the latest by the same rule every other query uses
 func (t *DBTx) getTaskStatuses(ctx context.Context, id string, forUpdate bool) ([]model.AsyncTaskStatus, error) {
-	query := baseTaskStatusSelect.Where("async_task_id::text = ?", id).OrderBy("created_date ASC")
+	query := baseTaskStatusSelect.Where("async_task_id = ?", id).OrderBy("created_date ASC", "id ASC")
 
 	if forUpdate {
 		query = query.Suffix(" FOR UPDATE")
 	}
 
+	return t.queryTaskStatuses(ctx, query)
+}
+
+// GetTaskStatuses fetches a task's list of statuses from the DB by ID, ordered by creation date and then ID in the
+// requested direction. Pages are counted back from the most recent status: offset skips that many of the newest
+// statuses, and if limit is nonzero only the limit most recent of the rest are returned.
+func (t *DBTx) GetTaskStatuses(ctx context.Context, id string, limit uint64, offset uint64, ascending bool) ([]model.AsyncTaskStatus, error) {
+	query := baseTaskStatusSelect.Where("async_task_id = ?", id)
+
+	if limit > 0 || offset > 0 {
+		page := psql.Select("id").From("async_task_status").Where("async_task_id = ?", id).OrderBy("created_date DESC", "id DESC").Offset(offset)
+		if limit > 0 {
+			page = page.Limit(limit)
+		}
+		query = query.Where(squirrel.Expr("id IN (?)", page.PlaceholderFormat(squirrel.Question)))
+	}
+
+	if ascending {
+		query = query.OrderBy("created_date ASC", "id ASC")
+	} else {
+		query = query.OrderBy("created_date DESC", "id DESC")
+	}
+
+	return t.queryTaskStatuses(ctx, query)
+}
+
+// CountTaskStatuses counts a task's statuses without loading them
+func (t *DBTx) CountTaskStatuses(ctx context.Context, id string) (int64, error) {
+	var count int64
+
+	query := psql.Select("COUNT(*)").From("async_task_status").Where("async_task_id = ?", id)
+
+	err := query.RunWith(t.tx).QueryRowContext(ctx).Scan(&count)
+	if err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
+
+// queryTaskStatuses runs a query built from baseTaskStatusSelect and collects the resulting statuses
+func (t *DBTx) queryTaskStatuses(ctx context.Context, query squirrel.SelectBuilder) ([]model.AsyncTaskStatus, error) {
 	rows, err := query.RunWith(t.tx).QueryContext(ctx)
 	if err != nil {
 		return nil, err
@@ -273,11 +675,11 @@ func (t *DBTx) getTaskStatuses(ctx context.Context, id string, forUpdate bool) (
 	var statuses []model.AsyncTaskStatus
 	for rows.Next() {
 		var dbstatus model.DBTaskStatus
-		if err := rows.Scan(&dbstatus.Status, &dbstatus.Detail, &dbstatus.CreatedDate); err != nil {
+		if err := rows.Scan(&dbstatus.ID, &dbstatus.Status, &dbstatus.Detail, &dbstatus.CreatedDate); err != nil {
 			return nil, err
 		}
 
-		status := model.AsyncTaskStatus{Status: dbstatus.Status, CreatedDate: dbstatus.CreatedDate}
+		status := model.AsyncTaskStatus{ID: dbstatus.ID, Status: dbstatus.Status, CreatedDate: dbstatus.CreatedDate}
 
 		if dbstatus.Detail.Valid {
 			status.Detail = dbstatus.Detail.String
@@ -286,30 +688,113 @@ func (t *DBTx) getTaskStatuses(ctx context.Context, id string, forUpdate bool) (
 		statuses = append(statuses, status)
 	}
 
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
 	return statuses, nil
 }
 
-type TaskFilter struct {
-	IDs             []string
-	Types           []string
-	Usernames       []string
-	StartDateSince  []time.Time
-	StartDateBefore []time.Time
-	EndDateSince    []time.Time
-	EndDateBefore   []time.Time
-	IncludeNullEnd  bool
-	Statuses        []string
-	BehaviorTypes   []string
-}
+// GetStatusesSince fetches the statuses of all tasks created after a point in time, ordered by creation date and then
+// ID. If afterID is set, statuses created exactly at since are also returned when their ID sorts after it, so that the
+// last status of one page can be used to fetch the next. If limit is nonzero, at most limit statuses are returned.
+func (t *DBTx) GetStatusesSince(ctx context.Context, since time.Time, afterID string, limit uint64) ([]model.AsyncTaskStatusChange, error) {
+	query := psql.Select(
+		"id::text", "async_task_id::text", "status", "detail", "created_date at time zone (select current_setting('TIMEZONE'))",
+	).From("async_task_status").OrderBy("created_date ASC", "id ASC")
 
-// GetTasksByFilter fetches a set of tasks by a set of provided filters
-func (t *DBTx) GetTasksByFilter(ctx context.Context, filters TaskFilter, order string) ([]model.AsyncTask, error) {
-	var tasks []model.AsyncTask
+	if afterID != "" {
+		query = query.Where("(created_date, id) > (?, ?::uuid)", since, afterID)
+	} else {
+		query = query.Where("created_date > ?", since)
+	}
+
+	if limit > 0 {
+		query = query.Limit(limit)
+	}
+
+	rows, err := query.RunWith(t.tx).QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var changes []model.AsyncTaskStatusChange
+	for rows.Next() {
+		var (
+			dbstatus model.DBTaskStatus
+			taskID   string
+		)
+		if err := rows.Scan(&dbstatus.ID, &taskID, &dbstatus.Status, &dbstatus.Detail, &dbstatus.CreatedDate); err != nil {
+			return nil, err
+		}
+
+		change := model.AsyncTaskStatusChange{
+			AsyncTaskStatus: model.AsyncTaskStatus{ID: dbstatus.ID, Status: dbstatus.Status, CreatedDate: dbstatus.CreatedDate},
+			TaskID:          taskID,
+		}
+
+		if dbstatus.Detail.Valid {
+			change.Detail = dbstatus.Detail.String
+		}
+
+		changes = append(changes, change)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
 
-	query := baseTaskSelect
+	return changes, nil
+}
+
+type TaskFilter struct {
+	IDs              []string
+	Types            []string
+	Usernames        []string
+	ExcludeUsernames []string
+	Sources          []string
+	StartDateSince   []time.Time
+	StartDateBefore  []time.Time
+	EndDateSince     []time.Time
+	EndDateBefore    []time.Time
+	IncludeNullEnd   bool
+	Completed        *bool
+	Claimed          *bool
+	Statuses         []string // matched against each task's latest status only
+	EverStatuses     []string // matched against every status the task has had
+	ExcludeStatuses  []string // also every status, not just the latest
+	BehaviorTypes    []string
+	Limit            uint64
+	Offset           uint64
+
+	// AfterStartDate and AfterID are a keyset pagination cursor: only tasks after the task with that start date and ID,
+	// in start_date then ID order, are returned. AfterID may be left empty to start strictly after AfterStartDate.
+	AfterStartDate *time.Time
+	AfterID        string
+
+	// IncludeStatuses and IncludeBehaviors load each task's statuses and behaviors along with it, in the same query
+	IncludeStatuses  bool
+	IncludeBehaviors bool
+
+	// DataFilters matches top-level keys in a task's data against string values. Nested keys and non-string
+	// comparisons are not supported.
+	DataFilters map[string]string
+
+	// ExcludeDataKeys leaves out tasks that have any of these top-level keys in their data
+	ExcludeDataKeys []string
+
+	// Tags matches tasks that have every one of these tags, with the same values
+	Tags map[string]string
+
+	// ExcludeInternal leaves out the updater's behavior processor lock tasks
+	ExcludeInternal bool
+}
 
+// applyTaskFilter adds the WHERE clauses (and any joins they need) for the provided filters to a query
+func (t *DBTx) applyTaskFilter(query squirrel.SelectBuilder, filters TaskFilter) squirrel.SelectBuilder {
 	if len(filters.IDs) > 0 {
-		query = query.Where("id::text = ANY(?)", pq.Array(filters.IDs))
+		query = query.Where("async_tasks.id = ANY(?::uuid[])", pq.Array(filters.IDs))
 	}
 
 	if len(filters.Types) > 0 {
@@ -320,6 +805,19 @@ func (t *DBTx) GetTasksByFilter(ctx context.Context, filters TaskFilter, order s
 		query = query.Where("username = ANY(?)", pq.Array(filters.Usernames))
 	}
 
+	if len(filters.Sources) > 0 {
+		query = query.Where("source = ANY(?)", pq.Array(filters.Sources))
+	}
+
+	if filters.ExcludeInternal {
+		query = query.Where("type NOT LIKE ?", BehaviorProcessorTypePrefix+"%")
+	}
+
+	// a plain NOT ... = ANY would also drop tasks without a username, which aren't owned by any of the excluded users
+	if len(filters.ExcludeUsernames) > 0 {
+		query = query.Where("(username IS NULL OR NOT (username = ANY(?)))", pq.Array(filters.ExcludeUsernames))
+	}
+
 	if len(filters.StartDateSince) > 0 {
 		if len(filters.StartDateSince) > 1 {
 			t.log.Warn("More than one start_date_since filter is unsupported. Only the oldest date will be considered.")
@@ -352,43 +850,262 @@ func (t *DBTx) GetTasksByFilter(ctx context.Context, filters TaskFilter, order s
 		query = query.Where("end_date < ANY(?)", pq.Array(filters.EndDateBefore))
 	}
 
+	if filters.Completed != nil {
+		if *filters.Completed {
+			query = query.Where("end_date IS NOT NULL")
+		} else {
+			query = query.Where("end_date IS NULL")
+		}
+	}
+
+	if filters.Claimed != nil {
+		if *filters.Claimed {
+			query = query.Where(activeClaim)
+		} else {
+			query = query.Where("NOT " + activeClaim)
+		}
+	}
+
+	// a semi-join rather than a join on each task's latest status, so the planner can start from whichever side is
+	// more selective and a task whose latest statuses tie isn't returned twice
 	if len(filters.Statuses) > 0 {
-		query = query.Join("async_task_status ON (async_task_status.async_task_id = async_tasks.id AND async_task_status.created_date = (select max(created_date) FROM async_task_status WHERE async_task_id = async_tasks.id))").Where("status = ANY(?)", pq.Array(filters.Statuses))
+		query = query.Where("EXISTS (SELECT 1 FROM async_task_status s WHERE s.async_task_id = async_tasks.id AND s.status = ANY(?) AND NOT EXISTS (SELECT 1 FROM async_task_status later WHERE later.async_task_id = s.async_task_id AND (later.created_date, later.id) > (s.created_date, s.id)))", pq.Array(filters.Statuses))
 	}
 
-	if len(filters.BehaviorTypes) > 0 {
-		nested := psql.Select("async_task_id", "ARRAY_AGG(behavior_type) AS behavior_types").From("async_task_behavior").GroupBy("async_task_id")
-		nestedJoinSelect, _, _ := nested.ToSql()
-		query = query.Join("("+nestedJoinSelect+") AS behaviors ON (behaviors.async_task_id = async_tasks.id)").Where(`behavior_types && ?`, pq.Array(filters.BehaviorTypes))
+	if len(filters.EverStatuses) > 0 {
+		query = query.Where("EXISTS (SELECT 1 FROM async_task_status WHERE async_task_status.async_task_id = async_tasks.id AND async_task_status.status = ANY(?))", pq.Array(filters.EverStatuses))
 	}
 
-	rows, err := query.RunWith(t.tx).QueryContext(ctx)
-	if err != nil {
-		return nil, err
+	// unlike Statuses, this looks at every status the task has ever had, not just the latest
+	if len(filters.ExcludeStatuses) > 0 {
+		query = query.Where("NOT EXISTS (SELECT 1 FROM async_task_status WHERE async_task_status.async_task_id = async_tasks.id AND async_task_status.status = ANY(?))", pq.Array(filters.ExcludeStatuses))
 	}
-	defer rows.Close()
 
-	for rows.Next() {
-		var dbtask model.DBTask
-		if err := rows.Scan(&dbtask.ID, &dbtask.Type, &dbtask.Username, &dbtask.Data, &dbtask.StartDate, &dbtask.EndDate); err != nil {
-			return nil, err
+	if len(filters.BehaviorTypes) > 0 {
+		query = query.Where("EXISTS (SELECT 1 FROM async_task_behavior b WHERE b.async_task_id = async_tasks.id AND b.behavior_type = ANY(?))", pq.Array(filters.BehaviorTypes))
+	}
+
+	if len(filters.DataFilters) > 0 {
+		keys := make([]string, 0, len(filters.DataFilters))
+		for key := range filters.DataFilters {
+			keys = append(keys, key)
 		}
+		sort.Strings(keys) // keep the generated SQL stable
 
-		task, err := makeTask(dbtask)
-		if err != nil {
-			return nil, err
+		for _, key := range keys {
+			query = query.Where("data->>? = ?", key, filters.DataFilters[key])
 		}
+	}
 
-		tasks = append(tasks, *task)
+	for _, key := range filters.ExcludeDataKeys {
+		query = query.Where("data->? IS NULL", key)
+	}
+
+	// one containment check covers every tag and can use the GIN index on tags. A map of strings always marshals.
+	if len(filters.Tags) > 0 {
+		jsoned, _ := json.Marshal(filters.Tags)
+		query = query.Where("tags @> ?::jsonb", string(jsoned))
+	}
+
+	return query
+}
+
+// CountTasksByFilter counts the tasks matching a set of provided filters, ignoring any limit or offset
+func (t *DBTx) CountTasksByFilter(ctx context.Context, filters TaskFilter) (int64, error) {
+	var count int64
+
+	query := t.applyTaskFilter(psql.Select("COUNT(*)").From("async_tasks"), filters)
+
+	err := query.RunWith(t.tx).QueryRowContext(ctx).Scan(&count)
+	if err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
+
+// CountTasksByLatestStatus counts the tasks matching a set of provided filters, grouped by each task's latest status.
+// Tasks without any statuses aren't counted.
+func (t *DBTx) CountTasksByLatestStatus(ctx context.Context, filters TaskFilter) (map[string]int64, error) {
+	counts := make(map[string]int64)
+
+	query := psql.Select("latest.latest_status", "COUNT(*)").
+		From("async_tasks").
+		JoinClause("CROSS JOIN LATERAL (SELECT s.status AS latest_status FROM async_task_status s WHERE s.async_task_id = async_tasks.id ORDER BY s.created_date DESC, s.id DESC LIMIT 1) AS latest")
+	query = t.applyTaskFilter(query, filters).GroupBy("latest.latest_status")
+
+	rows, err := query.RunWith(t.tx).QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			status string
+			count  int64
+		)
+		if err := rows.Scan(&status, &count); err != nil {
+			return nil, err
+		}
+		counts[status] = count
 	}
 
 	if err = rows.Err(); err != nil {
 		return nil, err
 	}
 
+	return counts, nil
+}
+
+// GetTaskTypes fetches the distinct task types in the database, in alphabetical order, optionally restricted to the
+// tasks of a single user. The updater's internal behavior processor types are left out.
+func (t *DBTx) GetTaskTypes(ctx context.Context, username string) ([]string, error) {
+	types := make([]string, 0)
+
+	query := psql.Select("DISTINCT type").From("async_tasks").Where("type NOT LIKE ?", BehaviorProcessorTypePrefix+"%").OrderBy("type")
+	if username != "" {
+		query = query.Where("username = ?", username)
+	}
+
+	rows, err := query.RunWith(t.tx).QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var taskType string
+		if err := rows.Scan(&taskType); err != nil {
+			return nil, err
+		}
+		types = append(types, taskType)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return types, nil
+}
+
+// includedStatusesColumn aggregates a task's statuses into a JSON array, oldest first. Dates are rendered the same way
+// the other queries read them, as the wall-clock time in the database's time zone.
+const includedStatusesColumn = `COALESCE((SELECT json_agg(json_build_object(
+		'id', s.id::text,
+		'status', s.status,
+		'detail', s.detail,
+		'created_date', to_char(s.created_date at time zone (select current_setting('TIMEZONE')), 'YYYY-MM-DD"T"HH24:MI:SS.US"Z"')
+	) ORDER BY s.created_date ASC, s.id ASC) FROM async_task_status s WHERE s.async_task_id = async_tasks.id), '[]')`
+
+// includedBehaviorsColumn aggregates a task's behaviors into a JSON array. last_error_date has a time zone, unlike
+// the task's own dates, so it's rendered in UTC.
+const includedBehaviorsColumn = `COALESCE((SELECT json_agg(json_build_object(
+		'type', b.behavior_type,
+		'data', b.data,
+		'last_error', b.last_error,
+		'last_error_date', to_char(b.last_error_date at time zone 'UTC', 'YYYY-MM-DD"T"HH24:MI:SS.US"Z"'),
+		'state', b.state
+	) ORDER BY b.behavior_type ASC) FROM async_task_behavior b WHERE b.async_task_id = async_tasks.id), '[]')`
+
+// GetTasksByFilter fetches a set of tasks by a set of provided filters
+func (t *DBTx) GetTasksByFilter(ctx context.Context, filters TaskFilter, order string) ([]model.AsyncTask, error) {
+	var tasks []model.AsyncTask
+
+	err := t.EachTaskByFilter(ctx, filters, order, func(task *model.AsyncTask) error {
+		tasks = append(tasks, *task)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
 	return tasks, nil
 }
 
+// EachTaskByFilter calls fn for each task matching a set of provided filters as rows are read from the database,
+// stopping at the first error
+func (t *DBTx) EachTaskByFilter(ctx context.Context, filters TaskFilter, order string, fn func(*model.AsyncTask) error) error {
+	query := t.applyTaskFilter(baseTaskSelect, filters)
+
+	if filters.IncludeStatuses {
+		query = query.Column(includedStatusesColumn)
+	}
+
+	if filters.IncludeBehaviors {
+		query = query.Column(includedBehaviorsColumn)
+	}
+
+	if filters.AfterStartDate != nil {
+		if filters.AfterID != "" {
+			query = query.Where("(start_date, async_tasks.id) > (?, ?::uuid)", *filters.AfterStartDate, filters.AfterID)
+		} else {
+			query = query.Where("start_date > ?", *filters.AfterStartDate)
+		}
+	}
+
+	if order != "" {
+		query = query.OrderBy(order)
+	}
+
+	if filters.Limit > 0 {
+		query = query.Limit(filters.Limit)
+	}
+
+	if filters.Offset > 0 {
+		query = query.Offset(filters.Offset)
+	}
+
+	rows, err := query.RunWith(t.tx).QueryContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			dbtask              model.DBTask
+			statuses, behaviors []byte
+			dest                = []interface{}{&dbtask.ID, &dbtask.Type, &dbtask.Username, &dbtask.Source, &dbtask.Data, &dbtask.Tags, &dbtask.StartDate, &dbtask.EndDate, &dbtask.ClaimedBy, &dbtask.ClaimedUntil}
+		)
+		if filters.IncludeStatuses {
+			dest = append(dest, &statuses)
+		}
+		if filters.IncludeBehaviors {
+			dest = append(dest, &behaviors)
+		}
+
+		if err := rows.Scan(dest...); err != nil {
+			return err
+		}
+
+		task, err := makeTask(dbtask)
+		if err != nil {
+			return err
+		}
+
+		if filters.IncludeStatuses {
+			if err = json.Unmarshal(statuses, &task.Statuses); err != nil {
+				return err
+			}
+			task.StatusesLoaded = true
+		}
+
+		if filters.IncludeBehaviors {
+			if err = json.Unmarshal(behaviors, &task.Behaviors); err != nil {
+				return err
+			}
+			task.BehaviorsLoaded = true
+		}
+
+		if err = fn(task); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
 // InsertTask inserts a provided AsyncTask into the DB and returns the task's generated ID as a string
 func (t *DBTx) InsertTask(ctx context.Context, task model.AsyncTask) (string, error) {
 	if task.Type == "" {
@@ -408,6 +1125,11 @@ func (t *DBTx) InsertTask(ctx context.Context, task model.AsyncTask) (string, er
 		args = append(args, task.Username)
 	}
 
+	if task.Source != "" {
+		columns = append(columns, "source")
+		args = append(args, task.Source)
+	}
+
 	if len(task.Data) > 0 {
 		jsoned, err := json.Marshal(task.Data)
 		if err != nil {
@@ -418,6 +1140,16 @@ func (t *DBTx) InsertTask(ctx context.Context, task model.AsyncTask) (string, er
 		args = append(args, jsoned)
 	}
 
+	if len(task.Tags) > 0 {
+		jsoned, err := json.Marshal(task.Tags)
+		if err != nil {
+			return "", err
+		}
+
+		columns = append(columns, "tags")
+		args = append(args, jsoned)
+	}
+
 	if task.StartDate == nil || task.StartDate.IsZero() {
 		columns = append(columns, "start_date")
 		args = append(args, squirrel.Expr("now()"))
@@ -450,9 +1182,9 @@ func (t *DBTx) InsertTask(ctx context.Context, task model.AsyncTask) (string, er
 		return "", err
 	}
 
-	// This will only insert one status, we're assuming only one gets to this point (enforced in the route, not here)
-	if len(task.Statuses) > 0 {
-		err = t.InsertTaskStatus(ctx, task.Statuses[0], id)
+	// normal creates are limited to one status in the route, but imports seed a task's whole history, in order
+	for _, status := range task.Statuses {
+		err = t.InsertTaskStatus(ctx, status, id)
 		if err != nil {
 			return "", err
 		}
@@ -469,31 +1201,258 @@ func (t *DBTx) InsertTask(ctx context.Context, task model.AsyncTask) (string, er
 	return id, nil
 }
 
-// InsertTaskStatus inserts a provided AsyncTaskStatus into the DB for the provided async task ID
+// InsertTaskStatus inserts a provided AsyncTaskStatus into the DB for the provided async task ID, subject to the
+// status limit
 func (t *DBTx) InsertTaskStatus(ctx context.Context, status model.AsyncTaskStatus, taskID string) error {
+	return t.insertTaskStatus(ctx, status, taskID, false)
+}
+
+// InsertInternalTaskStatus inserts a status a behavior records on a task. It's never rejected by the status limit and
+// never pruned to make room for others.
+func (t *DBTx) InsertInternalTaskStatus(ctx context.Context, status model.AsyncTaskStatus, taskID string) error {
+	return t.insertTaskStatus(ctx, status, taskID, true)
+}
+
+func (t *DBTx) insertTaskStatus(ctx context.Context, status model.AsyncTaskStatus, taskID string, internal bool) error {
 	if status.Status == "" {
 		return errors.New("Status type must be provided")
 	}
 
-	query := psql.Insert("async_task_status").Columns("async_task_id", "status", "detail", "created_date")
+	if t.statusLimit.Max > 0 {
+		if err := t.makeRoomForStatus(ctx, taskID, internal); err != nil {
+			return err
+		}
+	}
 
+	query := psql.Insert("async_task_status").Columns("async_task_id", "status", "detail", "created_date", "internal")
+
+	// clock_timestamp() rather than now(), which is fixed for the whole transaction, so several statuses inserted
+	// together keep their order
 	if status.CreatedDate.IsZero() {
-		query = query.Values(taskID, status.Status, status.Detail, squirrel.Expr("now()"))
+		query = query.Values(taskID, status.Status, status.Detail, squirrel.Expr("clock_timestamp()"), internal)
 	} else {
-		query = query.Values(taskID, status.Status, status.Detail, squirrel.Expr("? AT TIME ZONE (select current_setting('TIMEZONE'))", status.CreatedDate))
+		query = query.Values(taskID, status.Status, status.Detail, squirrel.Expr("? AT TIME ZONE (select current_setting('TIMEZONE'))", status.CreatedDate), internal)
 	}
 
 	rows, err := query.RunWith(t.tx).QueryContext(ctx)
 	if err != nil {
-		return err
+		return translateError(err)
 	}
 	if err = rows.Err(); err != nil {
-		return err
+		return translateError(err)
 	}
 	if err = rows.Close(); err != nil {
+		return translateError(err)
+	}
+
+	return nil
+}
+
+// StatusChangeChannel is the Postgres notification channel a trigger on async_task_status sends a task's ID on when a
+// status that isn't internal is added to it. Notifications are only sent once the transaction commits.
+const StatusChangeChannel = "async_task_status_change"
+
+// makeRoomForStatus enforces the status limit before a status is added to a task, either refusing the new status or
+// deleting enough of the oldest prunable ones that the task is left with one fewer than the limit. An internal status
+// is let through even when there's no room for it.
+func (t *DBTx) makeRoomForStatus(ctx context.Context, taskID string, internal bool) error {
+	count, err := t.CountTaskStatuses(ctx, taskID)
+	if err != nil {
 		return err
 	}
 
+	if count < t.statusLimit.Max {
+		return nil
+	}
+
+	if !t.statusLimit.Prune {
+		if internal {
+			return nil
+		}
+		return ErrTooManyStatuses
+	}
+
+	excess := count - t.statusLimit.Max + 1
+	prunable := psql.Select("id").From("async_task_status").
+		Where("async_task_id = ?", taskID).
+		Where("NOT internal").
+		Where("id <> (SELECT id FROM async_task_status WHERE async_task_id = ? ORDER BY created_date DESC, id DESC LIMIT 1)", taskID).
+		OrderBy("created_date ASC", "id ASC").
+		Limit(uint64(excess))
+	if len(t.statusLimit.Keep) > 0 {
+		prunable = prunable.Where("NOT (status = ANY(?))", pq.Array(t.statusLimit.Keep))
+	}
+
+	query := psql.Delete("async_task_status").Where(squirrel.Expr("id IN (?)", prunable.PlaceholderFormat(squirrel.Question)))
+
+	result, err := query.RunWith(t.tx).ExecContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	pruned, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	t.log.Infof("Pruned the %d oldest statuses of task %s to stay within the limit of %d", pruned, taskID, t.statusLimit.Max)
+
+	// the statuses that are never pruned can fill the task up by themselves
+	if pruned < excess && !internal {
+		return ErrTooManyStatuses
+	}
+	return nil
+}
+
+// DeleteTaskStatus deletes a single status from a task by its ID, returning ErrNotFound if the task has no such status
+func (t *DBTx) DeleteTaskStatus(ctx context.Context, taskID string, statusID string) error {
+	query := psql.Delete("async_task_status").Where("async_task_id = ?", taskID).Where("id = ?", statusID)
+
+	result, err := query.RunWith(t.tx).ExecContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return fmt.Errorf("status %w", ErrNotFound)
+	}
+
+	return nil
+}
+
+// DeleteAllTaskStatuses clears a task's status history, returning how many statuses were deleted
+func (t *DBTx) DeleteAllTaskStatuses(ctx context.Context, taskID string) (int64, error) {
+	query := psql.Delete("async_task_status").Where("async_task_id = ?", taskID)
+
+	result, err := query.RunWith(t.tx).ExecContext(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+// ResetTaskStartDate sets a task's start date to now(), as if it had just been created
+func (t *DBTx) ResetTaskStartDate(ctx context.Context, id string) error {
+	query := psql.Update("async_tasks").Set("start_date", squirrel.Expr("now()")).Where("id = ?", id)
+
+	result, err := query.RunWith(t.tx).ExecContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+// UpsertTaskBehavior adds a behavior to a task, or replaces the data of the task's existing behavior of the same type.
+// Replacing it also clears its last error, which was most likely about the old data.
+func (t *DBTx) UpsertTaskBehavior(ctx context.Context, behavior model.AsyncTaskBehavior, taskID string) error {
+	if behavior.BehaviorType == "" {
+		return errors.New("Behavior type must be provided")
+	}
+
+	var data interface{}
+	if len(behavior.Data) > 0 {
+		jsoned, err := json.Marshal(behavior.Data)
+		if err != nil {
+			return err
+		}
+		data = jsoned
+	}
+
+	query := psql.Insert("async_task_behavior").
+		Columns("async_task_id", "behavior_type", "data").
+		Values(taskID, behavior.BehaviorType, data).
+		Suffix("ON CONFLICT (async_task_id, behavior_type) DO UPDATE SET data = EXCLUDED.data, last_error = NULL, last_error_date = NULL")
+
+	_, err := query.RunWith(t.tx).ExecContext(ctx)
+	if err != nil {
+		return translateError(err)
+	}
+
+	return nil
+}
+
+// maxBehaviorErrorLength caps the error kept on a behavior, since some, like a webhook's response, can be long
+const maxBehaviorErrorLength = 1000
+
+// SetBehaviorError records the error a task's behavior failed with, replacing any earlier one. A task or behavior
+// that's gone is ignored, since there's nothing left to report the error on.
+func (t *DBTx) SetBehaviorError(ctx context.Context, taskID string, behaviorType string, message string) error {
+	// cutting it short can split a character, which Postgres would reject
+	if len(message) > maxBehaviorErrorLength {
+		message = strings.ToValidUTF8(message[:maxBehaviorErrorLength], "")
+	}
+
+	query := psql.Update("async_task_behavior").
+		Set("last_error", message).
+		Set("last_error_date", squirrel.Expr("now()")).
+		Where("async_task_id = ?", taskID).
+		Where("behavior_type = ?", behaviorType)
+
+	_, err := query.RunWith(t.tx).ExecContext(ctx)
+	return err
+}
+
+// ClearBehaviorError forgets a task's behavior's last error, if it has one
+func (t *DBTx) ClearBehaviorError(ctx context.Context, taskID string, behaviorType string) error {
+	query := psql.Update("async_task_behavior").
+		Set("last_error", nil).
+		Set("last_error_date", nil).
+		Where("async_task_id = ?", taskID).
+		Where("behavior_type = ?", behaviorType).
+		Where("last_error IS NOT NULL")
+
+	_, err := query.RunWith(t.tx).ExecContext(ctx)
+	return err
+}
+
+// SetBehaviorState replaces what a task's behavior has recorded about its progress on the task. A task or behavior
+// that's gone is ignored.
+func (t *DBTx) SetBehaviorState(ctx context.Context, taskID string, behaviorType string, state map[string]interface{}) error {
+	jsoned, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	query := psql.Update("async_task_behavior").
+		Set("state", jsoned).
+		Where("async_task_id = ?", taskID).
+		Where("behavior_type = ?", behaviorType)
+
+	_, err = query.RunWith(t.tx).ExecContext(ctx)
+	return err
+}
+
+// DeleteTaskBehavior deletes a task's behavior of the given type, returning ErrNotFound if the task has no such behavior
+func (t *DBTx) DeleteTaskBehavior(ctx context.Context, taskID string, behaviorType string) error {
+	query := psql.Delete("async_task_behavior").Where("async_task_id = ?", taskID).Where("behavior_type = ?", behaviorType)
+
+	result, err := query.RunWith(t.tx).ExecContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return fmt.Errorf("behavior %w", ErrNotFound)
+	}
+
 	return nil
 }
 
@@ -517,14 +1476,127 @@ func (t *DBTx) InsertTaskBehavior(ctx context.Context, behavior model.AsyncTaskB
 
 	rows, err := query.RunWith(t.tx).QueryContext(ctx)
 	if err != nil {
-		return err
+		return translateError(err)
 	}
 	if err = rows.Err(); err != nil {
-		return err
+		return translateError(err)
 	}
 	if err = rows.Close(); err != nil {
-		return err
+		return translateError(err)
 	}
 
 	return nil
 }
+
+// OutboxMessage is a notification to an external system, written to the outbox in the same transaction as the task
+// change that calls for it and sent afterward by the outbox dispatcher
+type OutboxMessage struct {
+	ID       string
+	TaskID   string
+	Kind     string
+	Payload  []byte
+	Attempts int
+}
+
+// InsertOutboxMessage queues a message of a kind, such as webhook or amqp, for a task. A message with the same dedup
+// key as one already in the outbox is dropped, which is reported by returning false.
+func (t *DBTx) InsertOutboxMessage(ctx context.Context, taskID string, kind string, dedupKey string, payload []byte) (bool, error) {
+	query := psql.Insert("async_task_outbox").
+		Columns("async_task_id", "kind", "dedup_key", "payload").
+		Values(taskID, kind, dedupKey, payload).
+		Suffix("ON CONFLICT (dedup_key) DO NOTHING")
+
+	result, err := query.RunWith(t.tx).ExecContext(ctx)
+	if err != nil {
+		return false, translateError(err)
+	}
+
+	inserted, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return inserted > 0, nil
+}
+
+// ClaimOutboxMessages claims up to limit unsent messages that are due to be tried, oldest first, by putting their next
+// attempt off until leaseUntil. Once the transaction commits, other dispatchers leave them alone until then, so they can
+// be sent outside of it. Messages locked by another transaction are skipped, so several dispatchers can claim at once.
+func (t *DBTx) ClaimOutboxMessages(ctx context.Context, limit uint64, leaseUntil time.Time) ([]OutboxMessage, error) {
+	query := psql.Select("id::text", "async_task_id::text", "kind", "payload", "attempts").
+		From("async_task_outbox").
+		Where("sent_date IS NULL").
+		Where("next_attempt <= now()").
+		OrderBy("created_date ASC").
+		Limit(limit).
+		Suffix("FOR UPDATE SKIP LOCKED")
+
+	rows, err := query.RunWith(t.tx).QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var (
+		messages []OutboxMessage
+		ids      []string
+	)
+	for rows.Next() {
+		var message OutboxMessage
+		if err := rows.Scan(&message.ID, &message.TaskID, &message.Kind, &message.Payload, &message.Attempts); err != nil {
+			return nil, err
+		}
+		messages = append(messages, message)
+		ids = append(ids, message.ID)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(ids) == 0 {
+		return messages, nil
+	}
+
+	lease := psql.Update("async_task_outbox").Set("next_attempt", leaseUntil).Where(squirrel.Eq{"id": ids})
+
+	if _, err = lease.RunWith(t.tx).ExecContext(ctx); err != nil {
+		return nil, err
+	}
+
+	return messages, nil
+}
+
+// MarkOutboxMessageSent records that a message was delivered, so it isn't sent again
+func (t *DBTx) MarkOutboxMessageSent(ctx context.Context, id string) error {
+	query := psql.Update("async_task_outbox").Set("sent_date", squirrel.Expr("now()")).Where("id = ?", id)
+
+	_, err := query.RunWith(t.tx).ExecContext(ctx)
+	return err
+}
+
+// MarkOutboxMessageFailed records a failed attempt to send a message and when to try it next. A message that another
+// dispatcher has sent since its claim ran out is left alone.
+func (t *DBTx) MarkOutboxMessageFailed(ctx context.Context, id string, reason string, retryAt time.Time) error {
+	query := psql.Update("async_task_outbox").
+		Set("attempts", squirrel.Expr("attempts + 1")).
+		Set("last_error", reason).
+		Set("next_attempt", retryAt).
+		Where("id = ?", id).
+		Where("sent_date IS NULL")
+
+	_, err := query.RunWith(t.tx).ExecContext(ctx)
+	return err
+}
+
+// DeleteSentOutboxMessages clears out messages that were sent before a time, returning how many were deleted
+func (t *DBTx) DeleteSentOutboxMessages(ctx context.Context, before time.Time) (int64, error) {
+	query := psql.Delete("async_task_outbox").Where("sent_date < ?", before)
+
+	result, err := query.RunWith(t.tx).ExecContext(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
@@ -0,0 +1,133 @@
+package database_test
+
+import (
+	"context"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/cyverse-de/async-tasks/database"
+	"github.com/cyverse-de/async-tasks/database/dbtest"
+	"github.com/cyverse-de/async-tasks/model"
+)
+
+func TestGetTasksByFilter(t *testing.T) {
+	db := dbtest.New(t)
+	ctx := context.Background()
+
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	at := func(hours int) *time.Time {
+		date := start.Add(time.Duration(hours) * time.Hour)
+		return &date
+	}
+	status := func(name string, hours int) model.AsyncTaskStatus {
+		return model.AsyncTaskStatus{Status: name, CreatedDate: *at(hours)}
+	}
+
+	seeds := map[string]model.AsyncTask{
+		"running": {
+			Type: "analysis", Username: "alice", StartDate: at(0),
+			Data:     map[string]interface{}{"analysis_id": "a1"},
+			Statuses: []model.AsyncTaskStatus{status("submitted", 0), status("running", 1)},
+			Behaviors: []model.AsyncTaskBehavior{
+				{BehaviorType: "statuschangetimeout", Data: map[string]interface{}{"statuses": []interface{}{}}},
+			},
+		},
+		"failed": {
+			Type: "analysis", Username: "bob", StartDate: at(1), EndDate: at(3),
+			Data:     map[string]interface{}{"analysis_id": "a2", "forked": true},
+			Statuses: []model.AsyncTaskStatus{status("running", 2), status("failed", 3)},
+		},
+		"upload": {
+			Type: "upload", Username: "alice", StartDate: at(2),
+			Tags:     map[string]string{"project": "x"},
+			Statuses: []model.AsyncTaskStatus{status("running", 2)},
+		},
+	}
+
+	ids := make(map[string]string)
+	err := db.InTx(ctx, nil, func(tx *database.DBTx) error {
+		for name, task := range seeds {
+			id, err := tx.InsertTask(ctx, task)
+			if err != nil {
+				return err
+			}
+			ids[name] = id
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	completed := true
+	tests := []struct {
+		name   string
+		filter database.TaskFilter
+		want   []string
+	}{
+		{"no filters", database.TaskFilter{}, []string{"running", "failed", "upload"}},
+		{"type", database.TaskFilter{Types: []string{"analysis"}}, []string{"running", "failed"}},
+		{"username", database.TaskFilter{Usernames: []string{"alice"}}, []string{"running", "upload"}},
+		{"excluded username", database.TaskFilter{ExcludeUsernames: []string{"alice"}}, []string{"failed"}},
+		{"type and username", database.TaskFilter{Types: []string{"analysis"}, Usernames: []string{"alice"}}, []string{"running"}},
+		{"latest status", database.TaskFilter{Statuses: []string{"running"}}, []string{"running", "upload"}},
+		{"any status ever", database.TaskFilter{EverStatuses: []string{"running"}}, []string{"running", "failed", "upload"}},
+		{"never a status", database.TaskFilter{ExcludeStatuses: []string{"failed"}}, []string{"running", "upload"}},
+		{"completed", database.TaskFilter{Completed: &completed}, []string{"failed"}},
+		{"start date since", database.TaskFilter{StartDateSince: []time.Time{start.Add(30 * time.Minute)}}, []string{"failed", "upload"}},
+		{"data", database.TaskFilter{DataFilters: map[string]string{"analysis_id": "a1"}}, []string{"running"}},
+		{"excluded data key", database.TaskFilter{ExcludeDataKeys: []string{"forked"}}, []string{"running", "upload"}},
+		{"tags", database.TaskFilter{Tags: map[string]string{"project": "x"}}, []string{"upload"}},
+		{"behavior type", database.TaskFilter{BehaviorTypes: []string{"statuschangetimeout"}}, []string{"running"}},
+		{"limit and offset", database.TaskFilter{Limit: 1, Offset: 1}, []string{"failed"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var tasks []model.AsyncTask
+			err := db.InTx(ctx, nil, func(tx *database.DBTx) error {
+				var err error
+				tasks, err = tx.GetTasksByFilter(ctx, test.filter, "start_date ASC")
+				return err
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := make([]string, 0, len(tasks))
+			for _, task := range tasks {
+				got = append(got, task.ID)
+			}
+			want := make([]string, 0, len(test.want))
+			for _, name := range test.want {
+				want = append(want, ids[name])
+			}
+
+			if !sameStrings(got, want, test.filter.Limit > 0) {
+				t.Errorf("got tasks %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+// sameStrings reports whether two lists hold the same strings, in the same order if ordered is set
+func sameStrings(a, b []string, ordered bool) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	if !ordered {
+		a = append([]string(nil), a...)
+		b = append([]string(nil), b...)
+		sort.Strings(a)
+		sort.Strings(b)
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
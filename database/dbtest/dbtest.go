@@ -0,0 +1,94 @@
+// Package dbtest gives tests a migrated database of their own to run against. It needs a Postgres server, named by the
+// ASYNC_TASKS_TEST_DB_URI environment variable; tests that use it are skipped when that isn't set.
+package dbtest
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/cyverse-de/async-tasks/database"
+	_ "github.com/lib/pq"
+	"github.com/sirupsen/logrus"
+)
+
+// URIEnv names the environment variable holding the connection URI of the server test databases are made on
+const URIEnv = "ASYNC_TASKS_TEST_DB_URI"
+
+// New returns a connection to an empty, fully migrated schema that's dropped when the test finishes. Each call gets a
+// schema of its own, so tests may run in parallel against the same server.
+func New(tb testing.TB) *database.DBConnection {
+	tb.Helper()
+
+	uri := os.Getenv(URIEnv)
+	if uri == "" {
+		tb.Skipf("%s is not set", URIEnv)
+	}
+
+	suffix := make([]byte, 8)
+	if _, err := rand.Read(suffix); err != nil {
+		tb.Fatal(err)
+	}
+	schema := "async_tasks_test_" + hex.EncodeToString(suffix)
+
+	admin, err := sql.Open("postgres", uri)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { admin.Close() })
+
+	if _, err = admin.Exec("CREATE SCHEMA " + schema); err != nil {
+		tb.Fatalf("creating schema %s: %s", schema, err)
+	}
+	tb.Cleanup(func() {
+		if _, err := admin.Exec("DROP SCHEMA " + schema + " CASCADE"); err != nil {
+			tb.Errorf("dropping schema %s: %s", schema, err)
+		}
+	})
+
+	// public stays on the path for the uuid-ossp functions, which may already be installed there
+	schemaURI, err := withSearchPath(uri, schema+",public")
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	log := logrus.WithField("test", tb.Name())
+	pool := database.PoolConfig{MaxOpenConns: 5, MaxIdleConns: 5}
+
+	db, err := database.SetupDB(schemaURI, pool, log)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { db.Close() })
+
+	if _, err = db.Migrate(context.Background()); err != nil {
+		tb.Fatalf("migrating schema %s: %s", schema, err)
+	}
+
+	return db
+}
+
+// withSearchPath sets the search_path of the connections made with a URI, which may be either a postgres:// URL or a
+// list of key=value settings
+func withSearchPath(uri, searchPath string) (string, error) {
+	if !strings.HasPrefix(uri, "postgres://") && !strings.HasPrefix(uri, "postgresql://") {
+		return fmt.Sprintf("%s search_path=%s", uri, searchPath), nil
+	}
+
+	parsed, err := url.Parse(uri)
+	if err != nil {
+		return "", err
+	}
+
+	query := parsed.Query()
+	query.Set("search_path", searchPath)
+	parsed.RawQuery = query.Encode()
+
+	return parsed.String(), nil
+}
@@ -0,0 +1,279 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migrationsTable records which migrations have been applied to the database
+const migrationsTable = "async_tasks_schema_migrations"
+
+// migrationLockKey is the advisory lock that keeps replicas starting at the same time from migrating at once
+const migrationLockKey int64 = 0x6173796e635f6d // "async_m"
+
+// noTransactionDirective, as a migration's first line, has it run outside a transaction, one statement at a time. It's
+// for statements Postgres won't run in a transaction, such as CREATE INDEX CONCURRENTLY.
+const noTransactionDirective = "-- migrate:no-transaction"
+
+// Migration is one schema change, from a file in the migrations directory named <version>_<name>.sql
+type Migration struct {
+	Version       int
+	Name          string
+	SQL           string
+	NoTransaction bool
+}
+
+// statements splits a migration that runs outside a transaction into its statements, which Postgres would otherwise
+// run together in an implicit transaction. Its statements can't have semicolons in them anywhere but at their ends.
+func (m Migration) statements() []string {
+	var statements []string
+	for _, statement := range strings.Split(m.SQL, ";") {
+		if statement = strings.TrimSpace(statement); statement != "" {
+			statements = append(statements, statement)
+		}
+	}
+	return statements
+}
+
+// Migrations lists the embedded migrations in version order
+func Migrations() ([]Migration, error) {
+	entries, err := migrationFiles.ReadDir("migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	var migrations []Migration
+	for _, entry := range entries {
+		base := strings.TrimSuffix(entry.Name(), ".sql")
+		rawVersion, name, ok := strings.Cut(base, "_")
+		if !ok {
+			return nil, fmt.Errorf("migration %s must be named <version>_<name>.sql", entry.Name())
+		}
+		version, err := strconv.Atoi(rawVersion)
+		if err != nil {
+			return nil, fmt.Errorf("migration %s must be named <version>_<name>.sql", entry.Name())
+		}
+
+		contents, err := migrationFiles.ReadFile(path.Join("migrations", entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		migrations = append(migrations, Migration{
+			Version:       version,
+			Name:          name,
+			SQL:           string(contents),
+			NoTransaction: strings.HasPrefix(string(contents), noTransactionDirective),
+		})
+	}
+
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+
+	for i := 1; i < len(migrations); i++ {
+		if migrations[i].Version == migrations[i-1].Version {
+			return nil, fmt.Errorf("more than one migration has version %d", migrations[i].Version)
+		}
+	}
+
+	return migrations, nil
+}
+
+// Migrate applies the embedded migrations the database doesn't have yet, in version order, and returns the ones it
+// applied. Each migration runs in its own transaction along with the record of it, so a failed one leaves the schema as
+// it was before that migration, except for those marked to run outside a transaction. Those are recorded only after all
+// of their statements have succeeded, so they're run again next time, and have to be safe to run again.
+func (d *DBConnection) Migrate(ctx context.Context) ([]Migration, error) {
+	migrations, err := Migrations()
+	if err != nil {
+		return nil, err
+	}
+
+	// the advisory lock belongs to a session, so everything has to happen on the one connection
+	conn, err := d.db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	// other replicas wait here until this one's migrations are done, then find nothing left to do
+	if _, err = conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", migrationLockKey); err != nil {
+		return nil, err
+	}
+	defer func() {
+		// the context may be done by now, and the lock has to be released before the connection goes back to the pool
+		if _, err := conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", migrationLockKey); err != nil {
+			d.log.Errorf("failed releasing the migration lock: %s", err)
+		}
+	}()
+
+	_, err = conn.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS `+migrationsTable+` (
+		version integer NOT NULL PRIMARY KEY,
+		name text NOT NULL,
+		applied_date timestamp with time zone NOT NULL DEFAULT now()
+	)`)
+	if err != nil {
+		return nil, err
+	}
+
+	appliedVersions, err := d.appliedMigrationVersions(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+
+	var applied []Migration
+	for _, migration := range migrations {
+		if appliedVersions[migration.Version] {
+			continue
+		}
+
+		d.log.Infof("Applying migration %d, %s", migration.Version, migration.Name)
+		if migration.NoTransaction {
+			err = applyMigrationStatements(ctx, conn, migration)
+		} else {
+			err = applyMigrationInTx(ctx, conn, migration)
+		}
+		if err != nil {
+			return applied, fmt.Errorf("migration %d, %s: %w", migration.Version, migration.Name, err)
+		}
+
+		applied = append(applied, migration)
+	}
+
+	return applied, nil
+}
+
+// appliedMigrationVersions lists the versions of the migrations recorded as applied
+func (d *DBConnection) appliedMigrationVersions(ctx context.Context, conn *sql.Conn) (map[int]bool, error) {
+	query, args, err := psql.Select("version").From(migrationsTable).ToSql()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := conn.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	appliedVersions := make(map[int]bool)
+	for rows.Next() {
+		var version int
+		if err := rows.Scan(&version); err != nil {
+			return nil, err
+		}
+		appliedVersions[version] = true
+	}
+	return appliedVersions, rows.Err()
+}
+
+// execer is a connection or a transaction
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// recordMigration marks a migration as applied
+func recordMigration(ctx context.Context, db execer, migration Migration) error {
+	query, args, err := psql.Insert(migrationsTable).Columns("version", "name").Values(migration.Version, migration.Name).ToSql()
+	if err != nil {
+		return err
+	}
+
+	_, err = db.ExecContext(ctx, query, args...)
+	return err
+}
+
+// applyMigrationInTx runs a migration and records it in one transaction
+func applyMigrationInTx(ctx context.Context, conn *sql.Conn, migration Migration) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // nolint:errcheck
+
+	if _, err = tx.ExecContext(ctx, migration.SQL); err != nil {
+		return err
+	}
+
+	if err = recordMigration(ctx, tx, migration); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// applyMigrationStatements runs a migration's statements one at a time outside of a transaction, then records it
+func applyMigrationStatements(ctx context.Context, conn *sql.Conn, migration Migration) error {
+	for _, statement := range migration.statements() {
+		if _, err := conn.ExecContext(ctx, statement); err != nil {
+			return err
+		}
+	}
+
+	return recordMigration(ctx, conn, migration)
+}
+
+// SchemaVersion describes the migrations applied to the database, next to the ones this build knows about
+type SchemaVersion struct {
+	Version     int        `json:"version"`
+	Name        string     `json:"name,omitempty"`
+	AppliedDate *time.Time `json:"applied_date,omitempty"`
+	Latest      int        `json:"latest"`
+	Pending     []string   `json:"pending"`
+}
+
+// GetSchemaVersion reports the latest migration applied to the database and any embedded ones it doesn't have. A
+// database that has never been migrated is at version 0.
+func (d *DBConnection) GetSchemaVersion(ctx context.Context) (SchemaVersion, error) {
+	version := SchemaVersion{Pending: make([]string, 0)}
+
+	migrations, err := Migrations()
+	if err != nil {
+		return version, err
+	}
+
+	appliedVersions := make(map[int]bool)
+
+	var tracked bool
+	if err = d.db.QueryRowContext(ctx, "SELECT to_regclass($1) IS NOT NULL", migrationsTable).Scan(&tracked); err != nil {
+		return version, err
+	}
+
+	if tracked {
+		rows, err := psql.Select("version", "name", "applied_date").From(migrationsTable).OrderBy("version ASC").RunWith(d.db).QueryContext(ctx)
+		if err != nil {
+			return version, err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var appliedDate time.Time
+			if err := rows.Scan(&version.Version, &version.Name, &appliedDate); err != nil {
+				return version, err
+			}
+			version.AppliedDate = &appliedDate
+			appliedVersions[version.Version] = true
+		}
+		if err = rows.Err(); err != nil {
+			return version, err
+		}
+	}
+
+	for _, migration := range migrations {
+		version.Latest = migration.Version
+		if !appliedVersions[migration.Version] {
+			version.Pending = append(version.Pending, fmt.Sprintf("%d_%s", migration.Version, migration.Name))
+		}
+	}
+
+	return version, nil
+}
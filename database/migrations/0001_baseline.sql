@@ -0,0 +1,27 @@
+-- The tables as they were before this service managed its own schema. Databases that already have them are left
+-- alone.
+CREATE EXTENSION IF NOT EXISTS "uuid-ossp";
+
+CREATE TABLE IF NOT EXISTS async_tasks (
+    id uuid NOT NULL DEFAULT uuid_generate_v1() PRIMARY KEY,
+    type text NOT NULL,
+    username text,
+    data json,
+    start_date timestamp,
+    end_date timestamp
+);
+
+CREATE TABLE IF NOT EXISTS async_task_status (
+    id uuid NOT NULL DEFAULT uuid_generate_v1() PRIMARY KEY,
+    async_task_id uuid NOT NULL REFERENCES async_tasks (id) ON DELETE CASCADE,
+    status text NOT NULL,
+    detail text,
+    created_date timestamp NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS async_task_behavior (
+    async_task_id uuid NOT NULL REFERENCES async_tasks (id) ON DELETE CASCADE,
+    behavior_type text NOT NULL,
+    data json,
+    PRIMARY KEY (async_task_id, behavior_type)
+);
@@ -0,0 +1,3 @@
+-- The client that created each task
+ALTER TABLE async_tasks ADD COLUMN IF NOT EXISTS source text;
+CREATE INDEX IF NOT EXISTS async_tasks_source_idx ON async_tasks (source);
@@ -0,0 +1,15 @@
+-- Webhook and AMQP messages waiting to be sent by the outbox dispatcher
+CREATE TABLE IF NOT EXISTS async_task_outbox (
+    id uuid NOT NULL DEFAULT uuid_generate_v1() PRIMARY KEY,
+    async_task_id uuid NOT NULL,
+    kind text NOT NULL,
+    dedup_key text NOT NULL UNIQUE,
+    payload json NOT NULL,
+    attempts integer NOT NULL DEFAULT 0,
+    last_error text,
+    created_date timestamp with time zone NOT NULL DEFAULT now(),
+    next_attempt timestamp with time zone NOT NULL DEFAULT now(),
+    sent_date timestamp with time zone
+);
+
+CREATE INDEX IF NOT EXISTS async_task_outbox_pending_idx ON async_task_outbox (created_date) WHERE sent_date IS NULL;
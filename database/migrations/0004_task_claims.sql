@@ -0,0 +1,3 @@
+-- Which worker holds each task, and until when
+ALTER TABLE async_tasks ADD COLUMN IF NOT EXISTS claimed_by text;
+ALTER TABLE async_tasks ADD COLUMN IF NOT EXISTS claimed_until timestamp with time zone;
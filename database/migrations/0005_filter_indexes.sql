@@ -0,0 +1,12 @@
+-- migrate:no-transaction
+-- Indexes for the listing filters and orderings. They're built concurrently, so a large database can keep taking
+-- writes while they're built, which Postgres only allows outside a transaction.
+CREATE INDEX CONCURRENTLY IF NOT EXISTS async_tasks_type_idx ON async_tasks (type);
+CREATE INDEX CONCURRENTLY IF NOT EXISTS async_tasks_username_idx ON async_tasks (username);
+CREATE INDEX CONCURRENTLY IF NOT EXISTS async_tasks_start_date_idx ON async_tasks (start_date, id);
+CREATE INDEX CONCURRENTLY IF NOT EXISTS async_tasks_end_date_idx ON async_tasks (end_date);
+CREATE INDEX CONCURRENTLY IF NOT EXISTS async_task_status_task_created_idx ON async_task_status (async_task_id, created_date);
+CREATE INDEX CONCURRENTLY IF NOT EXISTS async_task_status_status_idx ON async_task_status (status);
+CREATE INDEX CONCURRENTLY IF NOT EXISTS async_task_status_created_idx ON async_task_status (created_date, id);
+CREATE INDEX CONCURRENTLY IF NOT EXISTS async_task_behavior_task_idx ON async_task_behavior (async_task_id);
+CREATE INDEX CONCURRENTLY IF NOT EXISTS async_task_behavior_type_idx ON async_task_behavior (behavior_type);
@@ -0,0 +1,3 @@
+-- Free-form key/value labels on each task, indexed for ?tag= containment lookups
+ALTER TABLE async_tasks ADD COLUMN IF NOT EXISTS tags jsonb;
+CREATE INDEX IF NOT EXISTS async_tasks_tags_idx ON async_tasks USING gin (tags jsonb_path_ops);
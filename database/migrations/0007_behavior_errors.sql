@@ -0,0 +1,3 @@
+-- The last error each behavior's processor ran into, so clients can see why a task's automation isn't working
+ALTER TABLE async_task_behavior ADD COLUMN IF NOT EXISTS last_error text;
+ALTER TABLE async_task_behavior ADD COLUMN IF NOT EXISTS last_error_date timestamp with time zone;
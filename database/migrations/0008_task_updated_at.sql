@@ -0,0 +1,48 @@
+-- When each task last changed, kept up to date by triggers so that every change to a task, its statuses, or its
+-- behaviors moves it forward, for the ETag and Last-Modified of GET /tasks/{id}
+ALTER TABLE async_tasks ADD COLUMN IF NOT EXISTS updated_at timestamp with time zone;
+
+UPDATE async_tasks SET updated_at = COALESCE(
+    GREATEST(start_date, end_date, (SELECT max(created_date) FROM async_task_status WHERE async_task_id = async_tasks.id))
+        AT TIME ZONE current_setting('TIMEZONE'),
+    now()
+) WHERE updated_at IS NULL;
+
+ALTER TABLE async_tasks ALTER COLUMN updated_at SET DEFAULT now();
+ALTER TABLE async_tasks ALTER COLUMN updated_at SET NOT NULL;
+
+-- updated_at only ever moves forward, even if the clock doesn't, so every change gets a new ETag
+CREATE OR REPLACE FUNCTION async_tasks_set_updated_at() RETURNS trigger AS $$
+BEGIN
+    NEW.updated_at := GREATEST(clock_timestamp(), OLD.updated_at + interval '1 microsecond');
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS async_tasks_updated_at ON async_tasks;
+CREATE TRIGGER async_tasks_updated_at BEFORE UPDATE ON async_tasks
+    FOR EACH ROW EXECUTE PROCEDURE async_tasks_set_updated_at();
+
+-- a change to one of a task's statuses or behaviors is a change to the task
+CREATE OR REPLACE FUNCTION async_tasks_touch_parent() RETURNS trigger AS $$
+DECLARE
+    task_id uuid;
+BEGIN
+    IF TG_OP = 'DELETE' THEN
+        task_id := OLD.async_task_id;
+    ELSE
+        task_id := NEW.async_task_id;
+    END IF;
+
+    UPDATE async_tasks SET updated_at = clock_timestamp() WHERE id = task_id;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS async_task_status_touch_task ON async_task_status;
+CREATE TRIGGER async_task_status_touch_task AFTER INSERT OR UPDATE OR DELETE ON async_task_status
+    FOR EACH ROW EXECUTE PROCEDURE async_tasks_touch_parent();
+
+DROP TRIGGER IF EXISTS async_task_behavior_touch_task ON async_task_behavior;
+CREATE TRIGGER async_task_behavior_touch_task AFTER INSERT OR UPDATE OR DELETE ON async_task_behavior
+    FOR EACH ROW EXECUTE PROCEDURE async_tasks_touch_parent();
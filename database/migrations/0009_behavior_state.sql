@@ -0,0 +1,3 @@
+-- What each behavior has already done for its task, such as the status it last escalated or sent a webhook for, kept
+-- out of the task's statuses so recording it doesn't change the task's latest status
+ALTER TABLE async_task_behavior ADD COLUMN IF NOT EXISTS state jsonb;
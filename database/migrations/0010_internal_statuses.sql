@@ -0,0 +1,3 @@
+-- Marks the statuses behaviors record, which the status limit never prunes, since behaviors look back for them to know
+-- what they've already done
+ALTER TABLE async_task_status ADD COLUMN IF NOT EXISTS internal boolean NOT NULL DEFAULT false;
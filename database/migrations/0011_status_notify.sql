@@ -0,0 +1,16 @@
+-- Sends the task's ID on the async_task_status_change channel whenever a client adds a status, so every way a status is
+-- added notifies the listener. Postgres holds the notification until the transaction commits, drops it if the
+-- transaction rolls back, and sends one per task however many statuses the transaction adds. Statuses behaviors add
+-- are internal and don't notify, so behaviors can't set each other off in a loop.
+CREATE OR REPLACE FUNCTION async_task_status_notify() RETURNS trigger AS $$
+BEGIN
+    IF NOT NEW.internal THEN
+        PERFORM pg_notify('async_task_status_change', NEW.async_task_id::text);
+    END IF;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS async_task_status_notify ON async_task_status;
+CREATE TRIGGER async_task_status_notify AFTER INSERT ON async_task_status
+    FOR EACH ROW EXECUTE PROCEDURE async_task_status_notify();
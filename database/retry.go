@@ -0,0 +1,143 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// RetryConfig controls how transient database errors, such as the dropped and refused connections of a failover, are
+// retried. Attempts start InitialBackoff apart and the wait doubles each time up to MaxBackoff. A MaxAttempts of 1 or
+// less turns retrying off.
+type RetryConfig struct {
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+// IsRetryable reports whether an error is a transient one that's worth trying again: a serialization failure, a
+// deadlock, the server shutting down or not yet accepting connections, or a connection that failed or was lost
+func IsRetryable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	// checked first, since the error it wraps may well look retryable
+	var notRetryable errNotRetryable
+	if errors.As(err, &notRetryable) {
+		return false
+	}
+
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch pqErr.Code {
+		case "40001", "40P01", "57P01", "57P02", "57P03":
+			return true
+		}
+		return pqErr.Code.Class() == "08"
+	}
+
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) {
+		return true
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// isRolledBack reports whether a failed commit is known to have been rolled back. A commit that failed because the
+// connection was lost may or may not have gone through, so it can't safely be run again.
+func isRolledBack(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && (pqErr.Code == "40001" || pqErr.Code == "40P01")
+}
+
+// backoff is how long to wait before the given retry, counting from 1
+func (c RetryConfig) backoff(retry int) time.Duration {
+	wait := c.InitialBackoff
+	for i := 1; i < retry && wait < c.MaxBackoff; i++ {
+		wait *= 2
+	}
+	if c.MaxBackoff > 0 && wait > c.MaxBackoff {
+		wait = c.MaxBackoff
+	}
+	return wait
+}
+
+// retry runs fn until it succeeds, fails with an error that isn't retryable, or runs out of attempts, waiting between
+// attempts unless the context is done first
+func (d *DBConnection) retry(ctx context.Context, what string, fn func() error) error {
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = fn()
+		if err == nil || !IsRetryable(err) || attempt >= d.retryConfig.MaxAttempts {
+			return err
+		}
+
+		wait := d.retryConfig.backoff(attempt)
+		d.log.Warnf("Retrying %s in %s after attempt %d of %d failed: %s", what, wait, attempt, d.retryConfig.MaxAttempts, err)
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+}
+
+// errNotRetryable wraps an error to keep retry from running its transaction again
+type errNotRetryable struct {
+	err error
+}
+
+func (e errNotRetryable) Error() string { return e.err.Error() }
+func (e errNotRetryable) Unwrap() error { return e.err }
+
+// NotRetryable keeps InTx from running a transaction again after fn returns the error, for when fn has done something
+// that can't be repeated, such as writing part of a response. A nil error stays nil.
+func NotRetryable(err error) error {
+	if err == nil {
+		return nil
+	}
+	return errNotRetryable{err}
+}
+
+// InTx runs fn in a transaction and commits it, running the whole transaction again if it fails with a retryable
+// error. fn may therefore be called more than once: any variables it sets for the caller have to be reset at its
+// start, so nothing is left over from a failed attempt, and once it has had an effect outside the transaction its
+// errors should be wrapped with NotRetryable. A commit whose outcome is unknown, because the connection was lost
+// during it, isn't retried.
+func (d *DBConnection) InTx(ctx context.Context, opts *sql.TxOptions, fn func(tx *DBTx) error) error {
+	err := d.retry(ctx, "a transaction", func() error {
+		tx, err := d.BeginTx(ctx, opts)
+		if err != nil {
+			return errNotRetryable{err} // BeginTx has already retried
+		}
+		defer tx.Rollback() // nolint:errcheck
+
+		if err = fn(tx); err != nil {
+			return err
+		}
+
+		if err = tx.Commit(); err != nil && !isRolledBack(err) {
+			return errNotRetryable{err}
+		}
+		return err
+	})
+
+	var notRetryable errNotRetryable
+	if errors.As(err, &notRetryable) {
+		return notRetryable.err
+	}
+	return err
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/cyverse-de/async-tasks/model"
+)
+
+// taskFields are the top-level task fields that may be requested with the fields query parameter
+var taskFields = map[string]bool{
+	"id":            true,
+	"type":          true,
+	"username":      true,
+	"source":        true,
+	"data":          true,
+	"tags":          true,
+	"start_date":    true,
+	"end_date":      true,
+	"claimed_by":    true,
+	"claimed_until": true,
+	"behaviors":     true,
+	"statuses":      true,
+	"latest_status": true,
+}
+
+// allowedTaskFields lists the fields that may be requested, for error messages
+func allowedTaskFields() string {
+	names := make([]string, 0, len(taskFields))
+	for name := range taskFields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// parseFields reads the comma-separated fields query parameter, which may be given more than once. It returns nil if
+// no fields were requested, meaning the whole task should be sent.
+func parseFields(v url.Values) (map[string]bool, error) {
+	var fields map[string]bool
+
+	for _, param := range v["fields"] {
+		for _, field := range strings.Split(param, ",") {
+			field = strings.TrimSpace(field)
+			if field == "" {
+				continue
+			}
+			if !taskFields[field] {
+				return nil, fmt.Errorf("fields may only list %s, got '%s'", allowedTaskFields(), field)
+			}
+			if fields == nil {
+				fields = make(map[string]bool)
+			}
+			fields[field] = true
+		}
+	}
+
+	return fields, nil
+}
+
+// selectTaskFields narrows a task down to the requested fields for serialization. Going through the task's own JSON
+// keeps the field names and formats the same as in full responses. A nil fields returns the task as-is.
+func selectTaskFields(task *model.AsyncTask, fields map[string]bool) (interface{}, error) {
+	if fields == nil {
+		return task, nil
+	}
+
+	jsoned, err := json.Marshal(task)
+	if err != nil {
+		return nil, err
+	}
+
+	var all map[string]json.RawMessage
+	if err = json.Unmarshal(jsoned, &all); err != nil {
+		return nil, err
+	}
+
+	for key := range all {
+		if !fields[key] {
+			delete(all, key)
+		}
+	}
+
+	return all, nil
+}
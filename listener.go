@@ -0,0 +1,48 @@
+package main
+
+import (
+	"time"
+
+	"github.com/cyverse-de/async-tasks/database"
+	"github.com/lib/pq"
+)
+
+const (
+	listenerMinReconnect = 10 * time.Second
+	listenerMaxReconnect = time.Minute
+
+	// listenerBuffer is how many task IDs can wait while the updater is busy with a periodic update
+	listenerBuffer = 100
+)
+
+// listenForStatusChanges listens for the notifications sent when a client adds a status to a task and passes along the
+// task IDs. Notifications sent while the connection is down are lost, which the periodic updates make up for.
+func listenForStatusChanges(dbURI string) (*pq.Listener, <-chan string, error) {
+	listener := pq.NewListener(dbURI, listenerMinReconnect, listenerMaxReconnect, func(event pq.ListenerEventType, err error) {
+		switch event {
+		case pq.ListenerEventConnectionAttemptFailed, pq.ListenerEventDisconnected:
+			log.Errorf("Status change listener lost its connection: %s", err)
+		case pq.ListenerEventReconnected:
+			log.Info("Status change listener reconnected")
+		}
+	})
+
+	if err := listener.Listen(database.StatusChangeChannel); err != nil {
+		listener.Close()
+		return nil, nil, err
+	}
+
+	taskIDs := make(chan string, listenerBuffer)
+	go func() {
+		defer close(taskIDs)
+		for notification := range listener.Notify {
+			// a nil notification only means the connection was re-established
+			if notification == nil {
+				continue
+			}
+			taskIDs <- notification.Extra
+		}
+	}()
+
+	return listener, taskIDs, nil
+}
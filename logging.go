@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/cyverse-de/configurate"
+	"github.com/sirupsen/logrus"
+)
+
+const defaultLogLevel = "info"
+
+// configureLogging sets the level and output format of the standard logrus logger. Every logger in the service,
+// including the per-request and per-behavior ones, is derived from it, so they all follow these settings.
+func configureLogging(level string, format string) error {
+	parsed, err := logrus.ParseLevel(level)
+	if err != nil {
+		return fmt.Errorf("logging.level must be one of trace, debug, info, warn, error, fatal, or panic: %w", err)
+	}
+
+	switch format {
+	case "json":
+		logrus.SetFormatter(&logrus.JSONFormatter{})
+	case "text":
+		logrus.SetFormatter(&logrus.TextFormatter{FullTimestamp: true})
+	default:
+		return fmt.Errorf("logging.format must be 'json' or 'text', got '%s'", format)
+	}
+
+	logrus.SetLevel(parsed)
+	return nil
+}
+
+// reloadLogLevelOnHangup re-reads the config file whenever the process gets a SIGHUP and applies its logging.level, so
+// debug output can be turned on and off without a restart. Bad values are logged and the current level is kept.
+func reloadLogLevelOnHangup(cfgPath string) {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+
+	go func() {
+		for range hangups {
+			cfg, err := configurate.Init(cfgPath)
+			if err != nil {
+				log.Errorf("Failed to re-read the config file on SIGHUP: %s", err)
+				continue
+			}
+			cfg.SetDefault("logging.level", defaultLogLevel)
+
+			level, err := logrus.ParseLevel(cfg.GetString("logging.level"))
+			if err != nil {
+				log.Errorf("Not changing the log level on SIGHUP: %s", err)
+				continue
+			}
+
+			logrus.SetLevel(level)
+			log.Infof("Log level set to %s", level)
+		}
+	}()
+}
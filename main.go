@@ -2,10 +2,15 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	_ "expvar"
 	"flag"
 	"fmt"
+	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
 	"net/http"
@@ -15,9 +20,18 @@ import (
 	"github.com/cyverse-de/async-tasks/database"
 	"github.com/cyverse-de/go-mod/otelutils"
 
+	"github.com/cyverse-de/async-tasks/behaviors/amqp"
+	"github.com/cyverse-de/async-tasks/behaviors/autocomplete"
+	"github.com/cyverse-de/async-tasks/behaviors/dependency"
+	"github.com/cyverse-de/async-tasks/behaviors/escalate"
+	"github.com/cyverse-de/async-tasks/behaviors/fork"
+	"github.com/cyverse-de/async-tasks/behaviors/retry"
 	"github.com/cyverse-de/async-tasks/behaviors/statuschangetimeout"
+	"github.com/cyverse-de/async-tasks/behaviors/ttl"
+	"github.com/cyverse-de/async-tasks/behaviors/webhook"
 
 	"github.com/cyverse-de/configurate"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 
@@ -37,15 +51,58 @@ func init() {
 	logrus.SetFormatter(&logrus.JSONFormatter{})
 }
 
-func makeRouter() *mux.Router {
-	router := mux.NewRouter()
-	router.Use(otelmux.Middleware("async-tasks"))
+// makeRouter returns the router the server handles requests with, and the router the service's routes are registered
+// on, which only differs when the service is mounted under a base path
+func makeRouter(basePath string) (*mux.Router, *mux.Router) {
+	root := mux.NewRouter()
+	root.Use(otelmux.Middleware("async-tasks"))
+	root.Use(gzipMiddleware)
+
+	router := root
+	if basePath != "" {
+		router = root.PathPrefix(basePath).Subrouter()
+	}
+
 	router.Handle("/debug/vars", http.DefaultServeMux)
+	router.Handle("/metrics", promhttp.Handler())
+	router.HandleFunc("/version", VersionRequest).Methods("GET")
 	router.HandleFunc("/", func(writer http.ResponseWriter, r *http.Request) {
 		fmt.Fprintf(writer, "Hello from async-tasks.\n")
 	}).Methods("GET")
 
-	return router
+	return root, router
+}
+
+// addBehaviorValidators registers the data validators of the built-in behaviors, so tasks with bad behavior data are
+// rejected when they're created rather than failing later in the updater
+func addBehaviorValidators(app *AsyncTasksApp) {
+	app.AddBehaviorValidator("statuschangetimeout", statuschangetimeout.ValidateData)
+	app.AddBehaviorValidator("webhook", webhook.ValidateData)
+	app.AddBehaviorValidator("retry", retry.ValidateData)
+	app.AddBehaviorValidator("dependency", dependency.ValidateData)
+	app.AddBehaviorValidator("ttl", ttl.ValidateData)
+	app.AddBehaviorValidator("escalate", escalate.ValidateData)
+	app.AddBehaviorValidator("autocomplete", autocomplete.ValidateData)
+	app.AddBehaviorValidator("fork", fork.ValidateData)
+	app.AddBehaviorValidator("amqp", amqp.ValidateData)
+}
+
+// normalizeBasePath turns the configured base path into the form routes are prefixed with: a leading slash and no
+// trailing one, or empty to mount the service at the root
+func normalizeBasePath(basePath string) (string, error) {
+	basePath = strings.TrimRight(basePath, "/")
+	if basePath == "" {
+		return "", nil
+	}
+
+	if !strings.HasPrefix(basePath, "/") {
+		return "", fmt.Errorf("http.base_path must start with a slash, got '%s'", basePath)
+	}
+	if strings.ContainsAny(basePath, "{}?#") {
+		return "", fmt.Errorf("http.base_path must be a plain path, got '%s'", basePath)
+	}
+
+	return basePath, nil
 }
 
 func fixAddr(addr string) string {
@@ -59,6 +116,7 @@ func main() {
 	var (
 		cfgPath = flag.String("config", "/etc/iplant/de/async-tasks.yml", "The path to the config file")
 		port    = flag.String("port", "60000", "The port number to listen on")
+		migrate = flag.Bool("migrate-only", false, "Apply any pending database migrations and exit")
 		err     error
 		cfg     *viper.Viper
 	)
@@ -78,12 +136,169 @@ func main() {
 		log.Fatal(err.Error())
 	}
 
+	cfg.SetDefault("logging.level", defaultLogLevel)
+	cfg.SetDefault("logging.format", "json")
+	cfg.SetDefault("db.read_uri", "")
+	cfg.SetDefault("db.migrate", true)
+	cfg.SetDefault("db.max_open_conns", 25)
+	cfg.SetDefault("db.max_idle_conns", 10)
+	cfg.SetDefault("db.conn_max_lifetime", "30m")
+	cfg.SetDefault("db.retry.max_attempts", 3)
+	cfg.SetDefault("db.retry.initial_backoff", "100ms")
+	cfg.SetDefault("db.retry.max_backoff", "2s")
+	cfg.SetDefault("async-tasks.filter.max_limit", 1000)
+	cfg.SetDefault("async-tasks.filter.strict", false)
+	cfg.SetDefault("async-tasks.http.request_timeout", "30s")
+	cfg.SetDefault("async-tasks.http.export_timeout", "10m")
+	cfg.SetDefault("async-tasks.http.max_body_bytes", 10485760)
+	cfg.SetDefault("async-tasks.schemas.dir", "")
+	cfg.SetDefault("async-tasks.templates.dir", "")
+	cfg.SetDefault("async-tasks.status.max_future_skew", "5m")
+	cfg.SetDefault("async-tasks.status.max_per_task", 0)
+	cfg.SetDefault("async-tasks.status.overflow", "reject")
+	cfg.SetDefault("async-tasks.status.keep", []string{})
+	cfg.SetDefault("amqp.uri", "")
+	cfg.SetDefault("amqp.exchange.name", "de")
+	cfg.SetDefault("amqp.exchange.type", "topic")
+	cfg.SetDefault("http.tls.cert", "")
+	cfg.SetDefault("http.tls.key", "")
+	cfg.SetDefault("http.tls.min_version", "1.2")
+	cfg.SetDefault("http.base_path", "")
+	cfg.SetDefault("cors.allowed_origins", []string{})
+	cfg.SetDefault("cors.allowed_methods", []string{"GET", "POST", "PUT", "PATCH", "DELETE"})
+	cfg.SetDefault("auth.mode", "none")
+	cfg.SetDefault("auth.token", "")
+	cfg.SetDefault("auth.jwt.secret", "")
+	cfg.SetDefault("auth.jwt.public_key_file", "")
+	cfg.SetDefault("auth.jwt.issuer", "")
+	cfg.SetDefault("auth.jwt.audience", "")
+	cfg.SetDefault("auth.jwt.username_claim", "preferred_username")
+	cfg.SetDefault("ratelimit.rate", 0)
+	cfg.SetDefault("ratelimit.burst", 20)
+	cfg.SetDefault("ratelimit.exempt", []string{})
+	cfg.SetDefault("ratelimit.trust_forwarded_for", false)
+	cfg.SetDefault("async-tasks.shutdown.grace_period", "30s")
+	cfg.SetDefault("async-tasks.updater.interval", "30s")
+	cfg.SetDefault("async-tasks.updater.jitter", 0.2)
+	cfg.SetDefault("async-tasks.updater.timeout", "10m")
+	cfg.SetDefault("async-tasks.updater.lock_padding", "2m")
+	cfg.SetDefault("async-tasks.updater.concurrency", 0)
+	cfg.SetDefault("async-tasks.updater.listen", false)
+	cfg.SetDefault("async-tasks.outbox.enabled", false)
+	cfg.SetDefault("async-tasks.outbox.interval", "5s")
+	cfg.SetDefault("async-tasks.outbox.batch_size", 100)
+	cfg.SetDefault("async-tasks.outbox.max_backoff", "1h")
+	cfg.SetDefault("async-tasks.outbox.lease", "5m")
+	cfg.SetDefault("async-tasks.outbox.retention", "24h")
+
+	if err = configureLogging(cfg.GetString("logging.level"), cfg.GetString("logging.format")); err != nil {
+		log.Fatal(err.Error())
+	}
+	reloadLogLevelOnHangup(*cfgPath)
+
+	gracePeriod := cfg.GetDuration("async-tasks.shutdown.grace_period")
+
+	// twice a minute by default means minutely updates behave basically decently
+	updaterInterval, err := time.ParseDuration(cfg.GetString("async-tasks.updater.interval"))
+	if err != nil {
+		log.Fatalf("async-tasks.updater.interval must be a duration such as \"30s\": %s", err)
+	}
+	if updaterInterval <= 0 {
+		log.Fatalf("async-tasks.updater.interval must be positive, got %s", updaterInterval)
+	}
+
+	updaterJitter := cfg.GetFloat64("async-tasks.updater.jitter")
+	if updaterJitter < 0 || updaterJitter >= 1 {
+		log.Fatalf("async-tasks.updater.jitter must be at least 0 and less than 1, got %g", updaterJitter)
+	}
+
+	requestTimeout, err := time.ParseDuration(cfg.GetString("async-tasks.http.request_timeout"))
+	if err != nil {
+		log.Fatalf("async-tasks.http.request_timeout must be a duration such as \"30s\": %s", err)
+	}
+
+	exportTimeout, err := time.ParseDuration(cfg.GetString("async-tasks.http.export_timeout"))
+	if err != nil {
+		log.Fatalf("async-tasks.http.export_timeout must be a duration such as \"10m\": %s", err)
+	}
+
+	maxStatusSkew, err := time.ParseDuration(cfg.GetString("async-tasks.status.max_future_skew"))
+	if err != nil {
+		log.Fatalf("async-tasks.status.max_future_skew must be a duration such as \"5m\": %s", err)
+	}
+
 	dburi := cfg.GetString("db.uri")
 
-	db, err := database.SetupDB(dburi, log)
+	connMaxLifetime, err := time.ParseDuration(cfg.GetString("db.conn_max_lifetime"))
+	if err != nil {
+		log.Fatalf("db.conn_max_lifetime must be a duration such as \"30m\": %s", err)
+	}
+
+	pool := database.PoolConfig{
+		MaxOpenConns:    cfg.GetInt("db.max_open_conns"),
+		MaxIdleConns:    cfg.GetInt("db.max_idle_conns"),
+		ConnMaxLifetime: connMaxLifetime,
+	}
+
+	retryInitialBackoff, err := time.ParseDuration(cfg.GetString("db.retry.initial_backoff"))
+	if err != nil {
+		log.Fatalf("db.retry.initial_backoff must be a duration such as \"100ms\": %s", err)
+	}
+
+	retryMaxBackoff, err := time.ParseDuration(cfg.GetString("db.retry.max_backoff"))
+	if err != nil {
+		log.Fatalf("db.retry.max_backoff must be a duration such as \"2s\": %s", err)
+	}
+
+	dbRetry := database.RetryConfig{
+		MaxAttempts:    cfg.GetInt("db.retry.max_attempts"),
+		InitialBackoff: retryInitialBackoff,
+		MaxBackoff:     retryMaxBackoff,
+	}
+
+	db, err := database.SetupDB(dburi, pool, log)
 	if err != nil {
 		log.Fatal(err.Error())
 	}
+	db.SetRetry(dbRetry)
+
+	if *migrate || cfg.GetBool("db.migrate") {
+		applied, err := db.Migrate(context.Background())
+		if err != nil {
+			log.Fatalf("Migrating the database failed: %s", err)
+		}
+		log.Infof("Applied %d database migrations", len(applied))
+	}
+	if *migrate {
+		return
+	}
+
+	// the replica gets a pool of its own the same size, since it takes the read traffic off the primary's
+	var readDB *database.DBConnection
+	if readURI := cfg.GetString("db.read_uri"); readURI != "" {
+		readDB, err = database.SetupDB(readURI, pool, log.WithField("db", "read_replica"))
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		readDB.SetRetry(dbRetry)
+		defer readDB.Close()
+	}
+
+	statusLimit := database.StatusLimit{
+		Max:  cfg.GetInt64("async-tasks.status.max_per_task"),
+		Keep: cfg.GetStringSlice("async-tasks.status.keep"),
+	}
+	switch overflow := cfg.GetString("async-tasks.status.overflow"); overflow {
+	case "reject":
+	case "prune":
+		statusLimit.Prune = true
+	default:
+		log.Fatalf("async-tasks.status.overflow must be 'reject' or 'prune', got '%s'", overflow)
+	}
+	if statusLimit.Max < 0 {
+		log.Fatalf("async-tasks.status.max_per_task must not be negative, got %d", statusLimit.Max)
+	}
+	db.SetStatusLimit(statusLimit)
 	defer db.Close()
 
 	count, err := db.GetCount(context.Background())
@@ -92,34 +307,307 @@ func main() {
 	}
 	log.Infof("There are %d async tasks in the database", count)
 
+	registerTaskCountGauge(db)
+
 	// Make periodic updater
-	updater := NewAsyncTasksUpdater(db)
+	updaterTimeout, err := time.ParseDuration(cfg.GetString("async-tasks.updater.timeout"))
+	if err != nil {
+		log.Fatalf("async-tasks.updater.timeout must be a duration such as \"10m\": %s", err)
+	}
+	lockPadding, err := time.ParseDuration(cfg.GetString("async-tasks.updater.lock_padding"))
+	if err != nil {
+		log.Fatalf("async-tasks.updater.lock_padding must be a duration such as \"2m\": %s", err)
+	}
+
+	// by default, no more processors run at once than there are connections for them
+	updaterConcurrency := cfg.GetInt("async-tasks.updater.concurrency")
+	if updaterConcurrency == 0 {
+		updaterConcurrency = cfg.GetInt("db.max_open_conns")
+	}
+
+	updater, err := NewAsyncTasksUpdater(db, updaterTimeout, lockPadding, updaterConcurrency)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
 	updater.AddBehavior("statuschangetimeout", statuschangetimeout.Processor)
+	updater.AddBehavior("webhook", webhook.Processor)
+	updater.AddBehavior("retry", retry.Processor)
+	updater.AddBehavior("dependency", dependency.Processor)
+	updater.AddBehavior("ttl", ttl.Processor)
+	updater.AddBehavior("escalate", escalate.Processor)
+	updater.AddBehavior("autocomplete", autocomplete.Processor)
+	updater.AddBehavior("fork", fork.Processor)
+	updater.AddTaskBehavior("statuschangetimeout", statuschangetimeout.ProcessTask)
+	updater.AddTaskBehavior("webhook", webhook.ProcessTask)
+	updater.AddTaskBehavior("retry", retry.ProcessTask)
+	updater.AddTaskBehavior("autocomplete", autocomplete.ProcessTask)
+	updater.AddTaskBehavior("fork", fork.ProcessTask)
+
+	// with the outbox, webhook and amqp behaviors only queue their messages and the dispatcher sends them
+	var dispatcher *OutboxDispatcher
+	if cfg.GetBool("async-tasks.outbox.enabled") {
+		outboxInterval, err := time.ParseDuration(cfg.GetString("async-tasks.outbox.interval"))
+		if err != nil {
+			log.Fatalf("async-tasks.outbox.interval must be a duration such as \"5s\": %s", err)
+		}
 
-	ticker := time.NewTicker(30 * time.Second) // twice a minute means minutely updates behave basically decently, if we need faster we can change this
+		outboxMaxBackoff, err := time.ParseDuration(cfg.GetString("async-tasks.outbox.max_backoff"))
+		if err != nil {
+			log.Fatalf("async-tasks.outbox.max_backoff must be a duration such as \"1h\": %s", err)
+		}
+
+		outboxLease, err := time.ParseDuration(cfg.GetString("async-tasks.outbox.lease"))
+		if err != nil {
+			log.Fatalf("async-tasks.outbox.lease must be a duration such as \"5m\": %s", err)
+		}
+
+		outboxRetention, err := time.ParseDuration(cfg.GetString("async-tasks.outbox.retention"))
+		if err != nil {
+			log.Fatalf("async-tasks.outbox.retention must be a duration such as \"24h\": %s", err)
+		}
+
+		dispatcher, err = NewOutboxDispatcher(db, OutboxConfig{
+			Interval:   outboxInterval,
+			BatchSize:  cfg.GetUint64("async-tasks.outbox.batch_size"),
+			MaxBackoff: outboxMaxBackoff,
+			Lease:      outboxLease,
+			Retention:  outboxRetention,
+		})
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+
+		webhook.QueueInOutbox()
+		dispatcher.AddSender(webhook.OutboxKind, webhook.SendOutboxMessage)
+	}
+
+	if amqpURI := cfg.GetString("amqp.uri"); amqpURI != "" {
+		publisher := amqp.NewPublisher(amqp.Config{
+			URI:          amqpURI,
+			ExchangeName: cfg.GetString("amqp.exchange.name"),
+			ExchangeType: cfg.GetString("amqp.exchange.type"),
+			UseOutbox:    dispatcher != nil,
+		})
+		updater.AddBehavior("amqp", publisher.Processor)
+		if dispatcher != nil {
+			dispatcher.AddSender(amqp.OutboxKind, publisher.SendOutboxMessage)
+		}
+	} else {
+		log.Info("amqp.uri is not set, so amqp behaviors will not be processed")
+	}
+
+	log.Infof("Running periodic updates every %s, give or take %g%%", updaterInterval, updaterJitter*100)
+	ticker := newJitteredTicker(updaterInterval, updaterJitter)
 	defer ticker.Stop()
 
+	// without the listener this stays nil, which never receives
+	var statusChanges <-chan string
+	if cfg.GetBool("async-tasks.updater.listen") {
+		listener, taskIDs, err := listenForStatusChanges(dburi)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		defer listener.Close()
+		statusChanges = taskIDs
+		log.Info("Processing the behaviors of tasks as soon as they get new statuses")
+	}
+
+	// stopUpdater ends the ticker loop between ticks, while cancelUpdater aborts an in-progress update
+	stopUpdater := make(chan struct{})
+	updaterDone := make(chan struct{})
+	updaterCtx, cancelUpdater := context.WithCancel(context.Background())
+	defer cancelUpdater()
+
 	go func() {
+		defer close(updaterDone)
 		for {
-			t := <-ticker.C
-			log.Infof("Got periodic timer tick: %s", t)
+			select {
+			case <-stopUpdater:
+				return
+			case t := <-ticker.C:
+				log.Infof("Got periodic timer tick: %s", t)
 
-			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute) // long timeout we can use to clear out totally stuck jobs
+				ctx, cancel := context.WithTimeout(updaterCtx, updater.Timeout()) // long timeout we can use to clear out totally stuck jobs
 
-			err := updater.DoPeriodicUpdate(ctx, t, db)
-			if err != nil {
-				log.Error(err)
+				err := updater.DoPeriodicUpdate(ctx, t, db)
+				if err != nil {
+					log.Error(err)
+				}
+				cancel()
+			case taskID, ok := <-statusChanges:
+				if !ok {
+					statusChanges = nil
+					continue
+				}
+
+				ctx, cancel := context.WithTimeout(updaterCtx, updater.Timeout())
+				updater.ProcessTask(ctx, taskID)
+				cancel()
 			}
-			cancel()
 		}
 	}()
 
+	outboxCtx, stopOutbox := context.WithCancel(context.Background())
+	defer stopOutbox()
+	outboxDone := make(chan struct{})
+	if dispatcher != nil {
+		log.Info("Sending webhook and amqp messages through the outbox")
+		go func() {
+			defer close(outboxDone)
+			dispatcher.Run(outboxCtx)
+		}()
+	} else {
+		close(outboxDone)
+	}
+
 	// Make HTTP listeners
-	router := makeRouter()
+	basePath, err := normalizeBasePath(cfg.GetString("http.base_path"))
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	if basePath != "" {
+		log.Infof("Serving under the base path %s", basePath)
+	}
+	auth, err := newAuthenticator(AuthConfig{
+		Mode:             cfg.GetString("auth.mode"),
+		Token:            cfg.GetString("auth.token"),
+		JWTSecret:        cfg.GetString("auth.jwt.secret"),
+		JWTPublicKeyFile: cfg.GetString("auth.jwt.public_key_file"),
+		JWTIssuer:        cfg.GetString("auth.jwt.issuer"),
+		JWTAudience:      cfg.GetString("auth.jwt.audience"),
+		UsernameClaim:    cfg.GetString("auth.jwt.username_claim"),
+	})
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	if auth == nil {
+		log.Info("API authentication is turned off; anyone who can reach the service can use it")
+	} else {
+		log.Infof("Requiring %s authentication on API requests", auth.config.Mode)
+	}
+
+	root, router := makeRouter(basePath)
+	router.HandleFunc("/debug/processors", updater.ProcessorsRequest).Methods("GET").Name("debugProcessors")
+
+	app := NewAsyncTasksApp(db, router, AppConfig{
+		MaxFilterLimit: cfg.GetUint64("async-tasks.filter.max_limit"),
+		RequestTimeout: requestTimeout,
+		ExportTimeout:  exportTimeout,
+		MaxStatusSkew:  maxStatusSkew,
+		MaxBodyBytes:   cfg.GetInt64("async-tasks.http.max_body_bytes"),
+		StrictParams:   cfg.GetBool("async-tasks.filter.strict"),
+		BasePath:       basePath,
+		Authenticator:  auth,
+	})
+	if readDB != nil {
+		log.Info("Sending task lookups, listings, counts, and stats to the read replica")
+		app.UseReadReplica(readDB)
+	}
+	addBehaviorValidators(app)
+
+	if schemaDir := cfg.GetString("async-tasks.schemas.dir"); schemaDir != "" {
+		schemas, err := loadTaskSchemas(schemaDir)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		for taskType, schema := range schemas {
+			app.AddTaskSchema(taskType, schema)
+		}
+		log.Infof("Loaded %d task data schemas from %s", len(schemas), schemaDir)
+	}
 
-	app := NewAsyncTasksApp(db, router)
+	if templateDir := cfg.GetString("async-tasks.templates.dir"); templateDir != "" {
+		templates, err := loadTaskTemplates(templateDir)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		for name, template := range templates {
+			if err = app.AddTaskTemplate(name, template); err != nil {
+				log.Fatal(err.Error())
+			}
+		}
+		log.Infof("Loaded %d task templates from %s", len(templates), templateDir)
+	}
 	log.Debug(app)
 
-	log.Infof("Starting to listen on port %s", *port)
-	log.Fatal(http.ListenAndServe(fixAddr(*port), router))
+	cors := CORSConfig{
+		AllowedOrigins: cfg.GetStringSlice("cors.allowed_origins"),
+		AllowedMethods: cfg.GetStringSlice("cors.allowed_methods"),
+	}
+	if len(cors.AllowedOrigins) > 0 {
+		log.Infof("Allowing cross-origin requests from %v", cors.AllowedOrigins)
+	}
+
+	limits := RateLimitConfig{
+		Rate:              cfg.GetFloat64("ratelimit.rate"),
+		Burst:             cfg.GetInt("ratelimit.burst"),
+		Exempt:            cfg.GetStringSlice("ratelimit.exempt"),
+		TrustForwardedFor: cfg.GetBool("ratelimit.trust_forwarded_for"),
+	}
+	rateLimit, err := rateLimitMiddleware(limits)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	if limits.Rate > 0 {
+		log.Infof("Limiting each client to %g requests per second with bursts of %d", limits.Rate, limits.Burst)
+	}
+
+	// serving TLS directly is only needed where nothing in front of the service terminates it
+	tlsCert, tlsKey := cfg.GetString("http.tls.cert"), cfg.GetString("http.tls.key")
+	if (tlsCert == "") != (tlsKey == "") {
+		log.Fatal("http.tls.cert and http.tls.key must be set together")
+	}
+	tlsMinVersion, err := parseTLSVersion(cfg.GetString("http.tls.min_version"))
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	server := &http.Server{
+		Addr:      fixAddr(*port),
+		Handler:   rateLimit(corsMiddleware(cors, basePath)(root)),
+		TLSConfig: &tls.Config{MinVersion: tlsMinVersion},
+	}
+
+	go func() {
+		var err error
+		if tlsCert != "" {
+			log.Infof("Starting to listen for HTTPS on port %s", *port)
+			err = server.ListenAndServeTLS(tlsCert, tlsKey)
+		} else {
+			log.Infof("Starting to listen on port %s", *port)
+			err = server.ListenAndServe()
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	sig := <-signals
+	log.Infof("Received %s, shutting down with a grace period of %s", sig, gracePeriod)
+
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), gracePeriod)
+	defer shutdownCancel()
+
+	ticker.Stop()
+	close(stopUpdater)
+
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Error(err)
+	}
+
+	select {
+	case <-updaterDone:
+		log.Info("Periodic updater stopped")
+	case <-shutdownCtx.Done():
+		log.Warn("Timed out waiting for the periodic updater, canceling the running update")
+		cancelUpdater()
+		<-updaterDone
+	}
+
+	// anything the dispatcher sent but hadn't marked yet is sent again when it next starts
+	stopOutbox()
+	<-outboxDone
 }
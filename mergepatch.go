@@ -0,0 +1,41 @@
+package main
+
+import (
+	"mime"
+	"net/http"
+)
+
+const mergePatchContentType = "application/merge-patch+json"
+
+// isMergePatch checks whether a request's body is a JSON Merge Patch
+func isMergePatch(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == mergePatchContentType
+}
+
+// mergePatch applies a JSON Merge Patch (RFC 7386) to a decoded JSON value, returning the patched value. Objects in
+// the patch are merged into objects in the target key by key, recursively, with null values removing keys; anything
+// else in the patch replaces the target outright. The target isn't modified.
+func mergePatch(target interface{}, patch interface{}) interface{} {
+	patchObject, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+
+	merged := make(map[string]interface{})
+	if targetObject, ok := target.(map[string]interface{}); ok {
+		for key, value := range targetObject {
+			merged[key] = value
+		}
+	}
+
+	for key, value := range patchObject {
+		if value == nil {
+			delete(merged, key)
+			continue
+		}
+		merged[key] = mergePatch(merged[key], value)
+	}
+
+	return merged
+}
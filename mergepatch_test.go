@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func decodeJSON(t *testing.T, s string) interface{} {
+	t.Helper()
+
+	var value interface{}
+	if err := json.Unmarshal([]byte(s), &value); err != nil {
+		t.Fatalf("decoding %s: %s", s, err)
+	}
+	return value
+}
+
+// the cases are the examples from appendix A of RFC 7386, followed by a few more for nested objects
+func TestMergePatch(t *testing.T) {
+	tests := []struct {
+		target string
+		patch  string
+		want   string
+	}{
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{`{"a":"b"}`, `{"a":null}`, `{}`},
+		{`{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+		{`{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"c"}`, `{"a":["b"]}`, `{"a":["b"]}`},
+		{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{`{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+		{`["a","b"]`, `["c","d"]`, `["c","d"]`},
+		{`{"a":"b"}`, `["c"]`, `["c"]`},
+		{`{"a":"foo"}`, `null`, `null`},
+		{`{"a":"foo"}`, `"bar"`, `"bar"`},
+		{`{"e":null}`, `{"a":1}`, `{"e":null,"a":1}`},
+		{`[1,2]`, `{"a":"b","c":null}`, `{"a":"b"}`},
+		{`{}`, `{"a":{"bb":{"ccc":null}}}`, `{"a":{"bb":{}}}`},
+
+		{`{"a":{"b":{"c":1,"d":2}}}`, `{"a":{"b":{"c":3}}}`, `{"a":{"b":{"c":3,"d":2}}}`},
+		{`{"a":{"b":{"c":1}},"e":1}`, `{"a":{"b":null}}`, `{"a":{},"e":1}`},
+		{`{"a":"b"}`, `{"missing":null}`, `{"a":"b"}`},
+		{`{"a":"b"}`, `{}`, `{"a":"b"}`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.target+" "+test.patch, func(t *testing.T) {
+			got := mergePatch(decodeJSON(t, test.target), decodeJSON(t, test.patch))
+			if want := decodeJSON(t, test.want); !reflect.DeepEqual(got, want) {
+				t.Errorf("got %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestMergePatchLeavesTargetAlone(t *testing.T) {
+	target := decodeJSON(t, `{"a":{"b":"c"},"d":"e"}`)
+
+	mergePatch(target, decodeJSON(t, `{"a":{"b":null},"d":null}`))
+
+	if want := decodeJSON(t, `{"a":{"b":"c"},"d":"e"}`); !reflect.DeepEqual(target, want) {
+		t.Errorf("the target was changed to %v", target)
+	}
+}
+
+func TestIsMergePatch(t *testing.T) {
+	tests := []struct {
+		contentType string
+		want        bool
+	}{
+		{"application/merge-patch+json", true},
+		{"application/merge-patch+json; charset=utf-8", true},
+		{"application/json", false},
+		{"", false},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest("PATCH", "/tasks", nil)
+		r.Header.Set("Content-Type", test.contentType)
+		if got := isMergePatch(r); got != test.want {
+			t.Errorf("isMergePatch with Content-Type '%s' is %t, want %t", test.contentType, got, test.want)
+		}
+	}
+}
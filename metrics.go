@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"math"
+	"time"
+
+	"github.com/cyverse-de/async-tasks/behaviors"
+	"github.com/cyverse-de/async-tasks/database"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const metricsNamespace = "async_tasks"
+
+const taskCountTimeout = 5 * time.Second
+
+var (
+	taskEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "task_events_total",
+		Help:      "The number of tasks created, completed, or deleted through the API.",
+	}, []string{"event"})
+
+	periodicUpdateDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "periodic_update_duration_seconds",
+		Help:      "How long each periodic update took to run all behavior processors.",
+		Buckets:   []float64{0.1, 0.5, 1, 5, 10, 30, 60, 120, 300, 600},
+	})
+
+	behaviorProcessorErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "behavior_processor_errors_total",
+		Help:      "The number of errors returned by behavior processors.",
+	}, []string{"behavior_type"})
+
+	behaviorProcessorTasks = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "behavior_processor_tasks_total",
+		Help:      "The number of tasks behavior processors evaluated, by outcome: updated, not_ready, or errored.",
+	}, []string{"behavior_type", "outcome"})
+
+	outboxMessages = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "outbox_messages_total",
+		Help:      "The number of outbox messages the dispatcher tried to send, by kind and outcome: sent or failed.",
+	}, []string{"kind", "outcome"})
+)
+
+// recordBehaviorResult adds one behavior processor run's task outcomes to the metrics
+func recordBehaviorResult(behaviorType string, result behaviors.Result) {
+	behaviorProcessorTasks.WithLabelValues(behaviorType, "updated").Add(float64(result.Updated))
+	behaviorProcessorTasks.WithLabelValues(behaviorType, "not_ready").Add(float64(result.NotReady))
+	behaviorProcessorTasks.WithLabelValues(behaviorType, "errored").Add(float64(result.Errored))
+}
+
+// registerTaskCountGauge exposes the total number of tasks in the database, queried at scrape time
+func registerTaskCountGauge(db *database.DBConnection) {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "tasks",
+		Help:      "The total number of async tasks in the database.",
+	}, func() float64 {
+		ctx, cancel := context.WithTimeout(context.Background(), taskCountTimeout)
+		defer cancel()
+
+		count, err := db.GetCount(ctx)
+		if err != nil {
+			log.Error(err)
+			return math.NaN()
+		}
+		return float64(count)
+	})
+}
@@ -2,6 +2,7 @@ package model
 
 import (
 	"database/sql"
+	"encoding/json"
 	"time"
 
 	"github.com/lib/pq"
@@ -9,39 +10,84 @@ import (
 
 // AsyncTaskBehavior describes a single behavior from the database
 type AsyncTaskBehavior struct {
-	BehaviorType string                 `json:"type"`
-	Data         map[string]interface{} `json:"data"`
+	BehaviorType  string                 `json:"type"`
+	Data          map[string]interface{} `json:"data"`
+	LastError     string                 `json:"last_error,omitempty"`
+	LastErrorDate *time.Time             `json:"last_error_date,omitempty"`
+	State         map[string]interface{} `json:"state,omitempty"`
 }
 
 // AsyncTaskStatus describes a single status update from the database
 type AsyncTaskStatus struct {
+	ID          string    `json:"id"`
 	Status      string    `json:"status"`
 	Detail      string    `json:"detail,omitempty"`
 	CreatedDate time.Time `json:"created_date"`
 }
 
+// AsyncTaskStatusChange is a status update along with the ID of the task it belongs to, for listing statuses across
+// tasks
+type AsyncTaskStatusChange struct {
+	AsyncTaskStatus
+	TaskID string `json:"async_task_id"`
+}
+
 // AsyncTask describes an async task from the DB, including behaviors and statuses if available
 type AsyncTask struct {
 	ID              string                 `json:"id"`
 	Type            string                 `json:"type"`
 	Username        string                 `json:"username"`
+	Source          string                 `json:"source,omitempty"`
 	Data            map[string]interface{} `json:"data"`
+	Tags            map[string]string      `json:"tags,omitempty"`
 	StartDate       *time.Time             `json:"start_date"`
 	EndDate         *time.Time             `json:"end_date"`
+	ClaimedBy       string                 `json:"claimed_by,omitempty"`
+	ClaimedUntil    *time.Time             `json:"claimed_until,omitempty"`
 	Behaviors       []AsyncTaskBehavior    `json:"behaviors,omitempty"`
 	BehaviorsLoaded bool                   `json:"-"`
 	Statuses        []AsyncTaskStatus      `json:"statuses,omitempty"`
 	StatusesLoaded  bool                   `json:"-"`
 }
 
+// LatestStatus finds the status with the most recent created date, if any. When several share that date the last one
+// listed wins, which matches the database's tiebreak by ID since statuses are loaded in created date and ID order.
+func (t AsyncTask) LatestStatus() *AsyncTaskStatus {
+	var latest *AsyncTaskStatus
+	for i, status := range t.Statuses {
+		if latest == nil || !status.CreatedDate.Before(latest.CreatedDate) {
+			latest = &t.Statuses[i]
+		}
+	}
+	return latest
+}
+
+// MarshalJSON adds the computed latest_status field to the task's JSON, so clients don't have to sort the statuses
+// themselves
+func (t AsyncTask) MarshalJSON() ([]byte, error) {
+	// plain has the same fields but not this method, so marshaling it doesn't recurse
+	type plain AsyncTask
+	return json.Marshal(struct {
+		plain
+		LatestStatus *AsyncTaskStatus `json:"latest_status,omitempty"`
+	}{
+		plain:        plain(t),
+		LatestStatus: t.LatestStatus(),
+	})
+}
+
 // DBTaskBehavior is a special type for selecting from the DB
 type DBTaskBehavior struct {
-	BehaviorType string
-	Data         sql.NullString
+	BehaviorType  string
+	Data          sql.NullString
+	LastError     sql.NullString
+	LastErrorDate pq.NullTime
+	State         sql.NullString
 }
 
 // DBTaskStatus is a special type for selectiong from the DB
 type DBTaskStatus struct {
+	ID          string
 	Status      string
 	Detail      sql.NullString
 	CreatedDate time.Time
@@ -52,7 +98,12 @@ type DBTask struct {
 	ID        string
 	Type      string
 	Username  sql.NullString
+	Source    sql.NullString
 	Data      sql.NullString
+	Tags      sql.NullString
 	StartDate pq.NullTime
 	EndDate   pq.NullTime
+
+	ClaimedBy    sql.NullString
+	ClaimedUntil pq.NullTime
 }
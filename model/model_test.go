@@ -0,0 +1,34 @@
+package model
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLatestStatus(t *testing.T) {
+	early := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	late := early.Add(time.Second)
+
+	tests := []struct {
+		name     string
+		statuses []AsyncTaskStatus
+		want     string
+	}{
+		{"none", nil, ""},
+		{"one", []AsyncTaskStatus{{ID: "1", CreatedDate: early}}, "1"},
+		{"most recent", []AsyncTaskStatus{{ID: "1", CreatedDate: late}, {ID: "2", CreatedDate: early}}, "1"},
+		{"tie goes to the last listed", []AsyncTaskStatus{{ID: "1", CreatedDate: early}, {ID: "2", CreatedDate: late}, {ID: "3", CreatedDate: late}}, "3"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var got string
+			if latest := (AsyncTask{Statuses: test.statuses}).LatestStatus(); latest != nil {
+				got = latest.ID
+			}
+			if got != test.want {
+				t.Errorf("got '%s', want '%s'", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/cyverse-de/async-tasks/database"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// OutboxSender delivers one outbox message. Delivery is at least once: a message is sent again if the dispatcher stops
+// after sending it but before recording that it was sent, so senders pass the message ID along for receivers to
+// deduplicate with.
+type OutboxSender func(ctx context.Context, message database.OutboxMessage) error
+
+// OutboxConfig controls how the outbox dispatcher works through pending messages
+type OutboxConfig struct {
+	// Interval is how often to look for messages to send, and BatchSize is how many are claimed at a time
+	Interval  time.Duration
+	BatchSize uint64
+
+	// MaxBackoff caps how long a message that keeps failing waits between attempts
+	MaxBackoff time.Duration
+
+	// Lease is how long a claimed message is left to the dispatcher that claimed it before another may claim it, so it
+	// should be longer than a batch takes to send
+	Lease time.Duration
+
+	// Retention is how long sent messages are kept before they're deleted
+	Retention time.Duration
+}
+
+// OutboxDispatcher sends the messages behaviors queue in the outbox. Behaviors write them in the same transaction as the
+// status that records them, so a message is never sent for a change that was rolled back, and never lost for one that
+// was committed. Messages are sent outside of any transaction, so a slow receiver doesn't hold locks or a connection.
+type OutboxDispatcher struct {
+	db      *database.DBConnection
+	config  OutboxConfig
+	senders map[string]OutboxSender
+}
+
+func NewOutboxDispatcher(db *database.DBConnection, config OutboxConfig) (*OutboxDispatcher, error) {
+	if config.Interval <= 0 {
+		return nil, fmt.Errorf("the outbox interval must be positive, got %s", config.Interval)
+	}
+
+	if config.BatchSize == 0 {
+		return nil, errors.New("the outbox batch size must be positive")
+	}
+
+	if config.MaxBackoff <= 0 {
+		return nil, fmt.Errorf("the outbox max backoff must be positive, got %s", config.MaxBackoff)
+	}
+
+	if config.Lease <= 0 {
+		return nil, fmt.Errorf("the outbox lease must be positive, got %s", config.Lease)
+	}
+
+	if config.Retention < 0 {
+		return nil, fmt.Errorf("the outbox retention must not be negative, got %s", config.Retention)
+	}
+
+	return &OutboxDispatcher{
+		db:      db,
+		config:  config,
+		senders: make(map[string]OutboxSender),
+	}, nil
+}
+
+// AddSender registers the sender for messages of a kind, which is the type of the behavior that queues them
+func (d *OutboxDispatcher) AddSender(kind string, sender OutboxSender) {
+	d.senders[kind] = sender
+}
+
+// outboxBackoff is how long to wait before trying a message again after it has failed attempts times, doubling from
+// a second up to the maximum
+func outboxBackoff(attempts int, max time.Duration) time.Duration {
+	if attempts >= 30 {
+		return max
+	}
+
+	backoff := time.Second << attempts
+	if backoff > max {
+		return max
+	}
+	return backoff
+}
+
+func (d *OutboxDispatcher) send(ctx context.Context, message database.OutboxMessage) error {
+	sender, ok := d.senders[message.Kind]
+	if !ok {
+		return fmt.Errorf("no sender is registered for outbox messages of kind %s", message.Kind)
+	}
+	return sender(ctx, message)
+}
+
+// dispatchBatch claims a batch of pending messages, sends them, and records how each went, returning how many were
+// claimed. The claim is committed before anything is sent, and each result is recorded in its own transaction, so a
+// failure to record one doesn't undo the others. A failed message is put off rather than holding up the rest of the
+// batch, and one whose result couldn't be recorded is sent again once its claim runs out.
+func (d *OutboxDispatcher) dispatchBatch(ctx context.Context) (int, error) {
+	var messages []database.OutboxMessage
+	err := d.db.InTx(ctx, nil, func(tx *database.DBTx) error {
+		var err error
+		messages, err = tx.ClaimOutboxMessages(ctx, d.config.BatchSize, time.Now().Add(d.config.Lease))
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	for _, message := range messages {
+		messageLog := log.WithFields(logrus.Fields{"outbox_id": message.ID, "task_id": message.TaskID, "kind": message.Kind})
+
+		if sendErr := d.send(ctx, message); sendErr != nil {
+			retryAt := time.Now().Add(outboxBackoff(message.Attempts, d.config.MaxBackoff))
+			messageLog.Errorf("Failed sending outbox message on attempt %d, trying again at %s: %s", message.Attempts+1, retryAt, sendErr)
+			outboxMessages.WithLabelValues(message.Kind, "failed").Inc()
+
+			err = d.db.InTx(ctx, nil, func(tx *database.DBTx) error {
+				return tx.MarkOutboxMessageFailed(ctx, message.ID, sendErr.Error(), retryAt)
+			})
+			if err != nil {
+				messageLog.Error(errors.Wrap(err, "failed recording outbox message as failed"))
+			}
+			continue
+		}
+
+		outboxMessages.WithLabelValues(message.Kind, "sent").Inc()
+		err = d.db.InTx(ctx, nil, func(tx *database.DBTx) error {
+			return tx.MarkOutboxMessageSent(ctx, message.ID)
+		})
+		if err != nil {
+			messageLog.Error(errors.Wrap(err, "failed recording outbox message as sent"))
+			continue
+		}
+		messageLog.Debug("Sent outbox message")
+	}
+
+	return len(messages), nil
+}
+
+// deleteSent clears out the messages sent longer ago than the retention period
+func (d *OutboxDispatcher) deleteSent(ctx context.Context) error {
+	var deleted int64
+	err := d.db.InTx(ctx, nil, func(tx *database.DBTx) error {
+		var err error
+		deleted, err = tx.DeleteSentOutboxMessages(ctx, time.Now().Add(-d.config.Retention))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if deleted > 0 {
+		log.Infof("Deleted %d sent outbox messages", deleted)
+	}
+	return nil
+}
+
+// Run sends pending messages every interval until the context is canceled. Each pass keeps claiming batches until one
+// comes back short, so a backlog is worked through without waiting for more ticks.
+func (d *OutboxDispatcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(d.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		for ctx.Err() == nil {
+			claimed, err := d.dispatchBatch(ctx)
+			if err != nil {
+				log.Error(errors.Wrap(err, "failed dispatching outbox messages"))
+				break
+			}
+			if claimed < int(d.config.BatchSize) {
+				break
+			}
+		}
+
+		if err := d.deleteSent(ctx); err != nil {
+			log.Error(errors.Wrap(err, "failed deleting sent outbox messages"))
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// taskFilterParams are the query parameters parseTaskFilter reads, besides the data.<key> ones
+var taskFilterParams = []string{
+	"id", "type", "status", "ever_status", "behavior_types", "username", "exclude_username", "source",
+	"start_date_since", "start_date_before", "end_date_since", "end_date_before", "started_between", "ended_between",
+	"include_null_end", "completed", "claimed", "exclude_internal", "tag",
+}
+
+// listingParams are the query parameters GET /tasks reads on top of the filters
+var listingParams = []string{"sort", "order", "limit", "offset", "after", "after_id", "include", "fields", "envelope"}
+
+// unknownParams lists, in alphabetical order, the query parameters that are neither task filters, strict, nor one of
+// the extra parameters an endpoint reads
+func unknownParams(v url.Values, extra []string) []string {
+	known := map[string]bool{"strict": true}
+	for _, param := range taskFilterParams {
+		known[param] = true
+	}
+	for _, param := range extra {
+		known[param] = true
+	}
+
+	var unknown []string
+	for param := range v {
+		if key, ok := strings.CutPrefix(param, "data."); ok && key != "" {
+			continue
+		}
+		if !known[param] {
+			unknown = append(unknown, param)
+		}
+	}
+	sort.Strings(unknown)
+
+	return unknown
+}
+
+// checkParams rejects query parameters an endpoint doesn't read, so a misspelled filter doesn't silently match more
+// tasks than intended. It only does so when the request passes strict=true or the app is configured to be strict, and
+// strict=false lets a request opt out of the configured default. Any error returned is the client's fault.
+func (a *AsyncTasksApp) checkParams(v url.Values, extra ...string) error {
+	strict := a.config.StrictParams
+	if value := v.Get("strict"); value != "" {
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("strict must be a boolean, got '%s'", value)
+		}
+		strict = parsed
+	}
+
+	if !strict {
+		return nil
+	}
+
+	if unknown := unknownParams(v, extra); len(unknown) > 0 {
+		return fmt.Errorf("unknown query parameters: %s", strings.Join(unknown, ", "))
+	}
+
+	return nil
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// rateLimiterIdleTTL is how long a client's limiter is kept after its last request. By then its bucket has refilled,
+// so forgetting it doesn't change anything for the client.
+const rateLimiterIdleTTL = 10 * time.Minute
+
+// RateLimitConfig controls per-client request rate limiting. A zero Rate turns rate limiting off.
+type RateLimitConfig struct {
+	// Rate is the number of requests per second each client may make on average, and Burst is how many it may make
+	// at once
+	Rate  float64
+	Burst int
+
+	// Exempt lists IP addresses and CIDR ranges of trusted callers that are never limited
+	Exempt []string
+
+	// TrustForwardedFor identifies clients by the first address in X-Forwarded-For rather than the connection's
+	// address. Only turn it on behind a proxy that sets the header, since clients can otherwise send their own.
+	TrustForwardedFor bool
+}
+
+type clientLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+type rateLimiter struct {
+	config RateLimitConfig
+	exempt []*net.IPNet
+
+	mu        sync.Mutex
+	clients   map[string]*clientLimiter
+	lastSweep time.Time
+}
+
+// parseExempt turns the exempt addresses and ranges into networks, treating a bare address as a network of one
+func parseExempt(exempt []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+
+	for _, entry := range exempt {
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("ratelimit.exempt entries must be IP addresses or CIDR ranges, got '%s'", entry)
+			}
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 32
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("ratelimit.exempt entries must be IP addresses or CIDR ranges, got '%s'", entry)
+		}
+		networks = append(networks, network)
+	}
+
+	return networks, nil
+}
+
+// clientIP finds the address a request is limited by
+func (l *rateLimiter) clientIP(r *http.Request) string {
+	if l.config.TrustForwardedFor {
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			first, _, _ := strings.Cut(forwarded, ",")
+			return strings.TrimSpace(first)
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func (l *rateLimiter) isExempt(client string) bool {
+	ip := net.ParseIP(client)
+	if ip == nil {
+		return false
+	}
+
+	for _, network := range l.exempt {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// limiterFor returns a client's limiter, creating it on first use and occasionally dropping idle ones so the map
+// doesn't grow forever
+func (l *rateLimiter) limiterFor(client string) *rate.Limiter {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(l.lastSweep) > rateLimiterIdleTTL {
+		for key, entry := range l.clients {
+			if now.Sub(entry.lastSeen) > rateLimiterIdleTTL {
+				delete(l.clients, key)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	entry, ok := l.clients[client]
+	if !ok {
+		entry = &clientLimiter{limiter: rate.NewLimiter(rate.Limit(l.config.Rate), l.config.Burst)}
+		l.clients[client] = entry
+	}
+	entry.lastSeen = now
+
+	return entry.limiter
+}
+
+// rateLimitMiddleware answers clients that send requests faster than the configured rate with a 429 and a
+// Retry-After header. It wraps the whole router, so rejected requests never reach a handler or the database.
+func rateLimitMiddleware(config RateLimitConfig) (func(http.Handler) http.Handler, error) {
+	if config.Rate < 0 {
+		return nil, fmt.Errorf("ratelimit.rate must not be negative, got %g", config.Rate)
+	}
+
+	if config.Rate > 0 && config.Burst < 1 {
+		return nil, fmt.Errorf("ratelimit.burst must be at least 1, got %d", config.Burst)
+	}
+
+	exempt, err := parseExempt(config.Exempt)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &rateLimiter{
+		config:    config,
+		exempt:    exempt,
+		clients:   make(map[string]*clientLimiter),
+		lastSweep: time.Now(),
+	}
+
+	return func(next http.Handler) http.Handler {
+		if config.Rate == 0 {
+			return next
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			client := l.clientIP(r)
+			if l.isExempt(client) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			reservation := l.limiterFor(client).Reserve()
+			if delay := reservation.Delay(); delay > 0 {
+				// don't hold on to tokens for a request that isn't going to be served
+				reservation.Cancel()
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+				tooManyRequests(w, r, fmt.Sprintf("too many requests from %s", client))
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}, nil
+}
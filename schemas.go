@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// loadTaskSchemas compiles the JSON Schemas in a directory, keyed by task type. Each schema lives in a file named after
+// the type it applies to, such as data-transfer.json for tasks of type data-transfer.
+func loadTaskSchemas(dir string) (map[string]*jsonschema.Schema, error) {
+	schemas := make(map[string]*jsonschema.Schema)
+
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	compiler := jsonschema.NewCompiler()
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		err = compiler.AddResource(path, f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("reading schema %s: %w", path, err)
+		}
+
+		schema, err := compiler.Compile(path)
+		if err != nil {
+			return nil, fmt.Errorf("compiling schema %s: %w", path, err)
+		}
+
+		schemas[strings.TrimSuffix(filepath.Base(path), ".json")] = schema
+	}
+
+	return schemas, nil
+}
+
+// schemaErrorMessages flattens a schema validation error into one message per failed constraint
+func schemaErrorMessages(err error) []string {
+	var verr *jsonschema.ValidationError
+	if !errors.As(err, &verr) {
+		return []string{err.Error()}
+	}
+
+	var messages []string
+	var walk func(*jsonschema.ValidationError)
+	walk = func(e *jsonschema.ValidationError) {
+		if len(e.Causes) == 0 {
+			location := e.InstanceLocation
+			if location == "" {
+				location = "/"
+			}
+			messages = append(messages, fmt.Sprintf("%s: %s", location, e.Message))
+			return
+		}
+		for _, cause := range e.Causes {
+			walk(cause)
+		}
+	}
+	walk(verr)
+
+	return messages
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// wantsCSV reports whether a task listing should be streamed as CSV
+func wantsCSV(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), csvContentType)
+}
+
+// wantsNDJSON reports whether a task listing should be streamed as newline-delimited JSON
+func wantsNDJSON(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), ndjsonContentType)
+}
+
+// isStreamedListing reports whether a request is for a task listing streamed as CSV or NDJSON. It only knows once the
+// router has matched the request.
+func isStreamedListing(r *http.Request) bool {
+	route := mux.CurrentRoute(r)
+	return route != nil && route.GetName() == "getByFilter" && (wantsCSV(r) || wantsNDJSON(r))
+}
+
+// streamWriter holds back a streamed response's status and headers until the first byte of its body is written, so an
+// error that comes before then can still be answered with an error status. Once it has started, an error can only be
+// signaled by aborting the response.
+type streamWriter struct {
+	w       http.ResponseWriter
+	header  http.Header
+	started bool
+}
+
+func newStreamWriter(w http.ResponseWriter, contentType string) *streamWriter {
+	header := make(http.Header)
+	header.Set("Content-Type", contentType)
+	return &streamWriter{w: w, header: header}
+}
+
+// start sends the status and headers, if they haven't been already. A stream with no body still has to be started.
+func (s *streamWriter) start() {
+	if s.started {
+		return
+	}
+	s.started = true
+
+	for key, values := range s.header {
+		s.w.Header()[key] = values
+	}
+	s.w.WriteHeader(http.StatusOK)
+}
+
+func (s *streamWriter) Write(p []byte) (int, error) {
+	s.start()
+	return s.w.Write(p)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestStreamWriterHoldsHeadersUntilWritten(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	stream := newStreamWriter(recorder, ndjsonContentType)
+
+	// an error before anything is written can still get its own status
+	if stream.started || recorder.Header().Get("Content-Type") != "" {
+		t.Fatal("the stream started before anything was written")
+	}
+	errored(recorder, httptest.NewRequest(http.MethodGet, "/tasks", nil), "query failed")
+	if recorder.Code != http.StatusInternalServerError {
+		t.Errorf("got status %d, want %d", recorder.Code, http.StatusInternalServerError)
+	}
+
+	recorder = httptest.NewRecorder()
+	stream = newStreamWriter(recorder, ndjsonContentType)
+	if _, err := stream.Write([]byte("{}\n")); err != nil {
+		t.Fatal(err)
+	}
+	if !stream.started || recorder.Code != http.StatusOK || recorder.Header().Get("Content-Type") != ndjsonContentType {
+		t.Errorf("got status %d and content type '%s' after a write, want %d and '%s'", recorder.Code, recorder.Header().Get("Content-Type"), http.StatusOK, ndjsonContentType)
+	}
+}
+
+func TestStreamWriterStartsEmpty(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	stream := newStreamWriter(recorder, ndjsonContentType)
+	stream.start()
+
+	if recorder.Code != http.StatusOK || recorder.Header().Get("Content-Type") != ndjsonContentType || recorder.Body.Len() != 0 {
+		t.Errorf("got status %d, content type '%s', and %d bytes, want an empty %s response", recorder.Code, recorder.Header().Get("Content-Type"), recorder.Body.Len(), ndjsonContentType)
+	}
+}
+
+func TestTimeoutMiddlewareGivesExportsTheirOwnTimeout(t *testing.T) {
+	app := &AsyncTasksApp{config: AppConfig{RequestTimeout: time.Minute, ExportTimeout: time.Hour}}
+
+	var remaining time.Duration
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		deadline, _ := r.Context().Deadline()
+		remaining = time.Until(deadline)
+	}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/tasks", handler).Name("getByFilter")
+	router.HandleFunc("/tasks/count", handler).Name("countByFilter")
+	router.Use(app.timeoutMiddleware)
+
+	tests := []struct {
+		path   string
+		accept string
+		want   time.Duration
+	}{
+		{"/tasks", "application/json", time.Minute},
+		{"/tasks", csvContentType, time.Hour},
+		{"/tasks", ndjsonContentType, time.Hour},
+		{"/tasks/count", csvContentType, time.Minute},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodGet, test.path, nil)
+		r.Header.Set("Accept", test.accept)
+		router.ServeHTTP(httptest.NewRecorder(), r)
+
+		if remaining > test.want || remaining < test.want-time.Minute/2 {
+			t.Errorf("%s with Accept '%s' got a deadline %s away, want %s", test.path, test.accept, remaining, test.want)
+		}
+	}
+}
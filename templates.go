@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/cyverse-de/async-tasks/model"
+)
+
+// loadTaskTemplates reads the task templates in a directory, keyed by name. Each template is a task in the same JSON
+// form POST /tasks accepts, usually with just a type, data defaults, and behaviors, in a file named after the template,
+// such as standard-transfer.json for the standard-transfer template.
+func loadTaskTemplates(dir string) (map[string]model.AsyncTask, error) {
+	templates := make(map[string]model.AsyncTask)
+
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, path := range paths {
+		contents, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		var template model.AsyncTask
+		if err = json.Unmarshal(contents, &template); err != nil {
+			return nil, fmt.Errorf("reading template %s: %w", path, err)
+		}
+
+		templates[strings.TrimSuffix(filepath.Base(path), ".json")] = template
+	}
+
+	return templates, nil
+}
+
+// applyTemplate fills in a new task from a template. The task's own type is kept if it has one, its data is merged
+// shallowly over the template's data, its tags are likewise merged over the template's tags, and its behaviors replace
+// the template's behaviors of the same type.
+func applyTemplate(template model.AsyncTask, task model.AsyncTask) model.AsyncTask {
+	if task.Type == "" {
+		task.Type = template.Type
+	}
+
+	if len(template.Data) > 0 {
+		data := make(map[string]interface{})
+		for key, value := range template.Data {
+			data[key] = value
+		}
+		for key, value := range task.Data {
+			data[key] = value
+		}
+		task.Data = data
+	}
+
+	if len(template.Tags) > 0 {
+		tags := make(map[string]string)
+		for key, value := range template.Tags {
+			tags[key] = value
+		}
+		for key, value := range task.Tags {
+			tags[key] = value
+		}
+		task.Tags = tags
+	}
+
+	overridden := make(map[string]bool)
+	for _, behavior := range task.Behaviors {
+		overridden[behavior.BehaviorType] = true
+	}
+
+	var behaviors []model.AsyncTaskBehavior
+	for _, behavior := range template.Behaviors {
+		if !overridden[behavior.BehaviorType] {
+			behaviors = append(behaviors, behavior)
+		}
+	}
+	task.Behaviors = append(behaviors, task.Behaviors...)
+
+	return task
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/cyverse-de/async-tasks/database"
+	"github.com/cyverse-de/async-tasks/database/dbtest"
+)
+
+// newTestServer serves the API from a migrated database of the test's own, with the same routes and behavior
+// validators the service runs with. The test is skipped when there's no database server to make one on.
+func newTestServer(t *testing.T) (*httptest.Server, *database.DBConnection) {
+	t.Helper()
+
+	db := dbtest.New(t)
+
+	root, router := makeRouter("")
+	app := NewAsyncTasksApp(db, router, AppConfig{
+		MaxFilterLimit: 1000,
+		RequestTimeout: 30 * time.Second,
+	})
+	addBehaviorValidators(app)
+
+	server := httptest.NewServer(root)
+	t.Cleanup(server.Close)
+
+	return server, db
+}
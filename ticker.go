@@ -0,0 +1,72 @@
+package main
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// jitteredTicker delivers ticks like a time.Ticker, but spaces them randomly so that replicas started together don't
+// all run their periodic updates, and compete for the behavior processor locks, at the same moment. The first tick
+// comes at a random point within the first interval, and each one after that comes after the interval give or take
+// the jitter fraction of it.
+type jitteredTicker struct {
+	C <-chan time.Time
+
+	interval time.Duration
+	jitter   float64
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// newJitteredTicker starts a ticker. A jitter of 0 ticks at exactly the interval, starting one interval from now.
+func newJitteredTicker(interval time.Duration, jitter float64) *jitteredTicker {
+	c := make(chan time.Time, 1)
+	t := &jitteredTicker{
+		C:        c,
+		interval: interval,
+		jitter:   jitter,
+		stop:     make(chan struct{}),
+	}
+
+	first := interval
+	if jitter > 0 {
+		first = time.Duration(rand.Int63n(int64(interval)))
+	}
+
+	go func() {
+		timer := time.NewTimer(first)
+		defer timer.Stop()
+
+		for {
+			select {
+			case <-t.stop:
+				return
+			case now := <-timer.C:
+				// like time.Ticker, drop ticks a slow receiver isn't ready for rather than queueing them up
+				select {
+				case c <- now:
+				default:
+				}
+				timer.Reset(t.next())
+			}
+		}
+	}()
+
+	return t
+}
+
+// next picks the time until the following tick
+func (t *jitteredTicker) next() time.Duration {
+	if t.jitter == 0 {
+		return t.interval
+	}
+	return time.Duration(float64(t.interval) * (1 + t.jitter*(2*rand.Float64()-1)))
+}
+
+// Stop turns off the ticker. No more ticks are sent after it returns, though one may already be waiting in C.
+func (t *jitteredTicker) Stop() {
+	t.stopOnce.Do(func() {
+		close(t.stop)
+	})
+}
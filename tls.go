@@ -0,0 +1,22 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// parseTLSVersion turns a TLS version such as "1.2" into its crypto/tls constant
+func parseTLSVersion(version string) (uint16, error) {
+	parsed, ok := tlsVersions[version]
+	if !ok {
+		return 0, fmt.Errorf("http.tls.min_version must be one of 1.0, 1.1, 1.2, or 1.3, got '%s'", version)
+	}
+	return parsed, nil
+}
@@ -2,51 +2,90 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"net/http"
+	"sort"
 	"sync"
 	"time"
 
+	"github.com/cyverse-de/async-tasks/behaviors"
 	"github.com/cyverse-de/async-tasks/database"
 	"github.com/cyverse-de/async-tasks/model"
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
 	"go.opentelemetry.io/otel"
-	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/attribute"
 )
 
-type BehaviorProcessor func(ctx context.Context, log *logrus.Entry, tickerTime time.Time, db *database.DBConnection) error
+// BehaviorProcessor runs one behavior type over the tasks that have it, reporting how it went for those tasks
+type BehaviorProcessor func(ctx context.Context, log *logrus.Entry, tickerTime time.Time, db *database.DBConnection) (behaviors.Result, error)
+
+// TaskProcessor runs one behavior type for a single task, reporting whether it changed the task
+type TaskProcessor func(ctx context.Context, log *logrus.Entry, db *database.DBConnection, taskID string) (bool, error)
 
 type AsyncTasksUpdater struct {
 	db                 *database.DBConnection
 	behaviorProcessors map[string]BehaviorProcessor
+	taskProcessors     map[string]TaskProcessor
+
+	// timeout bounds a single periodic update, and lockPadding is extra time on top of it that a behavior processor
+	// task is still treated as holding the lock for its behavior type
+	timeout     time.Duration
+	lockPadding time.Duration
+
+	// concurrency is the most behavior processors run at once in a periodic update, or 0 for no limit
+	concurrency int
 }
 
-func NewAsyncTasksUpdater(db *database.DBConnection) *AsyncTasksUpdater {
+func NewAsyncTasksUpdater(db *database.DBConnection, timeout time.Duration, lockPadding time.Duration, concurrency int) (*AsyncTasksUpdater, error) {
+	if timeout <= 0 {
+		return nil, fmt.Errorf("the updater timeout must be positive, got %s", timeout)
+	}
+
+	if lockPadding < 0 {
+		return nil, fmt.Errorf("the updater lock padding must not be negative, got %s", lockPadding)
+	}
+
+	if concurrency < 0 {
+		return nil, fmt.Errorf("the updater concurrency must not be negative, got %d", concurrency)
+	}
+
 	processors := make(map[string]BehaviorProcessor)
 
 	updater := &AsyncTasksUpdater{
 		db:                 db,
 		behaviorProcessors: processors,
+		taskProcessors:     make(map[string]TaskProcessor),
+		timeout:            timeout,
+		lockPadding:        lockPadding,
+		concurrency:        concurrency,
 	}
 
-	return updater
+	return updater, nil
 }
 
-func createBehaviorProcessorTask(ctx context.Context, behaviorType string, db *database.DBConnection) (string, error) {
-	tx, err := db.BeginTx(ctx, nil)
-	if err != nil {
-		return "", err
-	}
-	defer tx.Rollback() // nolint:errcheck
+// Timeout returns how long a single periodic update may run
+func (u *AsyncTasksUpdater) Timeout() time.Duration {
+	return u.timeout
+}
 
-	task := model.AsyncTask{Type: fmt.Sprintf("behaviorprocessor-%s", behaviorType)}
+// lockLookback is how far back to look for behavior processor tasks that may still be running. It has to cover the
+// whole update timeout, or a slow processor's lock would be ignored while it's still working.
+func (u *AsyncTasksUpdater) lockLookback() time.Duration {
+	return u.timeout + u.lockPadding
+}
 
-	id, err := tx.InsertTask(ctx, task)
-	if err != nil {
-		return "", err
-	}
+func createBehaviorProcessorTask(ctx context.Context, behaviorType string, db *database.DBConnection) (string, error) {
+	task := model.AsyncTask{Type: database.BehaviorProcessorTypePrefix + behaviorType}
 
-	err = tx.Commit()
+	var id string
+	err := db.InTx(ctx, nil, func(tx *database.DBTx) error {
+		var err error
+		id, err = tx.InsertTask(ctx, task)
+		return err
+	})
 	if err != nil {
 		return "", err
 	}
@@ -54,72 +93,83 @@ func createBehaviorProcessorTask(ctx context.Context, behaviorType string, db *d
 	return id, nil
 }
 
-func checkOldest(ctx context.Context, behaviorType string, db *database.DBConnection, taskID string) error {
-	tx, err := db.BeginTx(ctx, nil)
-	if err != nil {
-		return err
-	}
-	defer tx.Rollback() // nolint:errcheck
-
-	filter := database.TaskFilter{
-		Types:          []string{fmt.Sprintf("behaviorprocessor-%s", behaviorType)},
-		StartDateSince: []time.Time{time.Now().Add(time.Minute * -12)}, // the timeout is 10 minutes, but add some padding
-		EndDateSince:   []time.Time{time.Now().AddDate(1, 0, 0)},       // arbitrary point in the future a ways
+// lockFilter finds the behavior processor tasks for a behavior type that may still hold its lock
+func lockFilter(behaviorType string, lookback time.Duration) database.TaskFilter {
+	return database.TaskFilter{
+		Types:          []string{database.BehaviorProcessorTypePrefix + behaviorType},
+		StartDateSince: []time.Time{time.Now().Add(-lookback)},
+		EndDateSince:   []time.Time{time.Now().AddDate(1, 0, 0)}, // arbitrary point in the future a ways
 		IncludeNullEnd: true,
 	}
+}
 
-	tasks, err := tx.GetTasksByFilter(ctx, filter, "start_date ASC")
+func checkOldest(ctx context.Context, behaviorType string, db *database.DBConnection, taskID string, lookback time.Duration) error {
+	var tasks []model.AsyncTask
+	err := db.InTx(ctx, nil, func(tx *database.DBTx) error {
+		var err error
+		tasks, err = tx.GetTasksByFilter(ctx, lockFilter(behaviorType, lookback), "start_date ASC, async_tasks.id ASC")
+		return err
+	})
 	if err != nil {
 		return err
 	}
 
-	var t = time.Now()
-	var oldestTime = &t
-	var isOldest = true
-	for _, task := range tasks {
-		if oldestTime == nil || oldestTime.IsZero() || task.StartDate.Before(*oldestTime) {
-			oldestTime = task.StartDate
-			isOldest = (task.ID == taskID)
-			if !isOldest {
-				break
-			}
-		}
-	}
-
-	if !isOldest {
+	if oldest := oldestTask(tasks); oldest != nil && oldest.ID != taskID {
 		return errors.New("The provided ID is not the oldest task of its type")
 	}
 
 	return nil
 }
 
-func checkAlone(ctx context.Context, behaviorType string, db *database.DBConnection) (string, error) {
+// oldestTask picks the task that started first, or nil if none of them have a start date. Tasks started on the same
+// busy tick can share a start date, so ties go to the lowest ID, and every instance picks the same one whatever order
+// the tasks come in.
+func oldestTask(tasks []model.AsyncTask) *model.AsyncTask {
+	var oldest *model.AsyncTask
+	for i := range tasks {
+		task := &tasks[i]
+		if task.StartDate == nil {
+			continue
+		}
+		if oldest == nil || task.StartDate.Before(*oldest.StartDate) || (task.StartDate.Equal(*oldest.StartDate) && task.ID < oldest.ID) {
+			oldest = task
+		}
+	}
+	return oldest
+}
+
+func checkAlone(ctx context.Context, behaviorType string, db *database.DBConnection, lookback time.Duration) (string, error) {
 	// make a task
 	id, err := createBehaviorProcessorTask(ctx, behaviorType, db)
 	if err != nil {
 		return id, err
 	}
 	// check that we're the right task to continue
-	return id, checkOldest(ctx, behaviorType, db, id)
+	return id, checkOldest(ctx, behaviorType, db, id, lookback)
 }
 
-func finishTask(ctx context.Context, taskID string, db *database.DBConnection, processorLog *logrus.Entry) error {
-	tx, err := db.BeginTx(ctx, nil)
-	if err != nil {
-		return err
-	}
-	defer tx.Rollback() // nolint:errcheck
+// cleanupTimeout bounds the queries that complete or delete a behavior processor task once the processor is done. They
+// run even when the update was canceled, so the lock is handed back, but mustn't hold up a shutdown for long; a lock
+// task that can't be finished in time is ignored once it's older than the lock lookback anyway.
+const cleanupTimeout = 10 * time.Second
 
-	processorLog.Infof("Completing task %s", taskID)
-	err = tx.CompleteTask(ctx, taskID)
-	if err != nil {
-		return err
-	}
+// cleanupContext is a context for the queries that release a behavior processor's lock. It keeps the values of ctx,
+// such as its trace span, but not its cancellation, so an already-canceled update can still clean up after itself.
+func cleanupContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.WithoutCancel(ctx), cleanupTimeout)
+}
 
-	return tx.Commit()
+func finishTask(ctx context.Context, taskID string, db *database.DBConnection, processorLog *logrus.Entry) error {
+	processorLog.Infof("Completing task %s", taskID)
+	return db.InTx(ctx, nil, func(tx *database.DBTx) error {
+		return tx.CompleteTask(ctx, taskID)
+	})
 }
 
 func finishTaskLogError(ctx context.Context, taskID string, db *database.DBConnection, processorLog *logrus.Entry) {
+	ctx, cancel := cleanupContext(ctx)
+	defer cancel()
+
 	err := finishTask(ctx, taskID, db, processorLog)
 	if err != nil {
 		processorLog.Error(err.Error())
@@ -127,19 +177,10 @@ func finishTaskLogError(ctx context.Context, taskID string, db *database.DBConne
 }
 
 func deleteTask(ctx context.Context, taskID string, db *database.DBConnection, processorLog *logrus.Entry) error {
-	tx, err := db.BeginTx(ctx, nil)
-	if err != nil {
-		return err
-	}
-	defer tx.Rollback() // nolint:errcheck
-
 	processorLog.Infof("Deleting task %s", taskID)
-	err = tx.DeleteTask(ctx, taskID)
-	if err != nil {
-		return err
-	}
-
-	return tx.Commit()
+	return db.InTx(ctx, nil, func(tx *database.DBTx) error {
+		return tx.DeleteTask(ctx, taskID)
+	})
 }
 
 func (u *AsyncTasksUpdater) DoPeriodicUpdate(ctx context.Context, tickerTime time.Time, db *database.DBConnection) error {
@@ -147,8 +188,17 @@ func (u *AsyncTasksUpdater) DoPeriodicUpdate(ctx context.Context, tickerTime tim
 	ctx, span := otel.Tracer(otelName).Start(ctx, "DoPeriodicUpdate")
 	defer span.End()
 
+	timer := prometheus.NewTimer(periodicUpdateDuration)
+	defer timer.ObserveDuration()
+
 	var wg sync.WaitGroup
 
+	// each running processor holds a database connection or two, so bound how many run at once
+	var slots chan struct{}
+	if u.concurrency > 0 {
+		slots = make(chan struct{}, u.concurrency)
+	}
+
 	wg.Add(1) // add this so there's always at least one thing in the work group
 	for behaviorType, processor := range u.behaviorProcessors {
 		wg.Add(1)
@@ -159,12 +209,29 @@ func (u *AsyncTasksUpdater) DoPeriodicUpdate(ctx context.Context, tickerTime tim
 			processorLog := log.WithFields(logrus.Fields{
 				"behavior_type": behaviorType,
 			})
+			// wait for a slot before taking the lock, so waiting doesn't count against the lock's lookback
+			if slots != nil {
+				select {
+				case slots <- struct{}{}:
+					defer func() { <-slots }()
+				case <-ctx.Done():
+					processorLog.Infof("Not processing behavior type %s, since the update was canceled while it waited to run", behaviorType)
+					return
+				}
+			}
+			// an update canceled before this processor got going shouldn't start any transactions
+			if ctx.Err() != nil {
+				processorLog.Infof("Not processing behavior type %s, since the update was canceled before it started", behaviorType)
+				return
+			}
 			// check if alone
-			taskID, err := checkAlone(ctx, behaviorType, db)
+			taskID, err := checkAlone(ctx, behaviorType, db, u.lockLookback())
 			if err != nil {
 				processorLog.Error(errors.Wrap(err, "We are not the oldest process for this behavior type"))
 				if taskID != "" {
-					err = deleteTask(ctx, taskID, db, processorLog)
+					cleanupCtx, cancel := cleanupContext(ctx)
+					err = deleteTask(cleanupCtx, taskID, db, processorLog)
+					cancel()
 					if err != nil {
 						processorLog.Error(errors.Wrap(err, "Failed to delete task"))
 					}
@@ -175,17 +242,23 @@ func (u *AsyncTasksUpdater) DoPeriodicUpdate(ctx context.Context, tickerTime tim
 				processorLog = log.WithFields(logrus.Fields{
 					"async_task_id": taskID,
 				})
-				separatedSpanContext := trace.SpanContextFromContext(ctx)
-				outerCtx := trace.ContextWithSpanContext(context.Background(), separatedSpanContext)
-				defer finishTaskLogError(outerCtx, taskID, db, processorLog) // This uses a second context so an already-canceled one will still end the behavior processor async-task
+				defer finishTaskLogError(ctx, taskID, db, processorLog)
 			}
 
 			processorLog.Infof("Processing behavior type %s for time %s (task ID %s)", behaviorType, tickerTime, taskID)
-			err = processor(ctx, processorLog, tickerTime, db)
+			result, err := processor(ctx, processorLog, tickerTime, db)
 			if err != nil {
 				processorLog.Error(err)
+				behaviorProcessorErrors.WithLabelValues(behaviorType).Inc()
 			}
-			processorLog.Infof("Done processing behavior type %s for time %s", behaviorType, tickerTime)
+			recordBehaviorResult(behaviorType, result)
+			span.SetAttributes(
+				attribute.Int("tasks.evaluated", result.Evaluated),
+				attribute.Int("tasks.updated", result.Updated),
+				attribute.Int("tasks.not_ready", result.NotReady),
+				attribute.Int("tasks.errored", result.Errored),
+			)
+			processorLog.Infof("Done processing behavior type %s for time %s: %d tasks evaluated, %d updated, %d not ready, %d errored", behaviorType, tickerTime, result.Evaluated, result.Updated, result.NotReady, result.Errored)
 			// release "lock"
 		}(ctx, behaviorType, processor, tickerTime, db, &wg)
 	}
@@ -198,3 +271,131 @@ func (u *AsyncTasksUpdater) DoPeriodicUpdate(ctx context.Context, tickerTime tim
 func (u *AsyncTasksUpdater) AddBehavior(behaviorType string, processor BehaviorProcessor) {
 	u.behaviorProcessors[behaviorType] = processor
 }
+
+// AddTaskBehavior registers a processor for a behavior type that can be run for a single task when it gets a new
+// status, alongside the periodic processor for the same type
+func (u *AsyncTasksUpdater) AddTaskBehavior(behaviorType string, processor TaskProcessor) {
+	u.taskProcessors[behaviorType] = processor
+}
+
+// ProcessTask runs the task processors for the behaviors a single task has. Unlike DoPeriodicUpdate it doesn't take
+// the behavior type locks; the processors lock the task itself, which is enough to keep them from acting on it twice.
+func (u *AsyncTasksUpdater) ProcessTask(ctx context.Context, taskID string) {
+	ctx, span := otel.Tracer(otelName).Start(ctx, "ProcessTask")
+	defer span.End()
+
+	taskLog := log.WithFields(logrus.Fields{
+		"async_task_id": taskID,
+	})
+
+	var taskBehaviors []model.AsyncTaskBehavior
+	err := u.db.InTx(ctx, nil, func(tx *database.DBTx) error {
+		var err error
+		taskBehaviors, err = tx.GetTaskBehaviors(ctx, taskID)
+		return err
+	})
+	if err != nil {
+		taskLog.Error(errors.Wrap(err, "failed getting task behaviors"))
+		return
+	}
+
+	for _, behavior := range taskBehaviors {
+		processor, ok := u.taskProcessors[behavior.BehaviorType]
+		if !ok {
+			continue
+		}
+
+		if ctx.Err() != nil {
+			taskLog.Info("Not processing the rest of the task's behaviors due to a canceled context.")
+			return
+		}
+
+		processorLog := taskLog.WithFields(logrus.Fields{
+			"behavior_type": behavior.BehaviorType,
+		})
+
+		var result behaviors.Result
+		updated, err := processor(ctx, processorLog, u.db, taskID)
+		result.Record(updated, err)
+		recordBehaviorResult(behavior.BehaviorType, result)
+		behaviors.RecordOutcome(ctx, processorLog, u.db, taskID, behavior.BehaviorType, updated, err)
+		if err != nil {
+			processorLog.Error(errors.Wrap(err, "failed processing a task"))
+			continue
+		}
+
+		processorLog.Infof("Processed behavior type %s for task %s after a status change, updated: %t", behavior.BehaviorType, taskID, updated)
+	}
+}
+
+// ProcessorStatus describes whether a behavior processor is running right now, and if so for how long
+type ProcessorStatus struct {
+	BehaviorType   string     `json:"behavior_type"`
+	Active         bool       `json:"active"`
+	TaskID         string     `json:"task_id,omitempty"`
+	StartDate      *time.Time `json:"start_date,omitempty"`
+	RunningSeconds float64    `json:"running_seconds,omitempty"`
+}
+
+// ProcessorStatuses reports, for each registered behavior type, the behavior processor task that currently holds its
+// lock, using the same lookup as checkOldest
+func (u *AsyncTasksUpdater) ProcessorStatuses(ctx context.Context) ([]ProcessorStatus, error) {
+	behaviorTypes := make([]string, 0, len(u.behaviorProcessors))
+	for behaviorType := range u.behaviorProcessors {
+		behaviorTypes = append(behaviorTypes, behaviorType)
+	}
+	sort.Strings(behaviorTypes)
+
+	var statuses []ProcessorStatus
+	err := u.db.InTx(ctx, nil, func(tx *database.DBTx) error {
+		statuses = make([]ProcessorStatus, 0, len(behaviorTypes))
+		for _, behaviorType := range behaviorTypes {
+			tasks, err := tx.GetTasksByFilter(ctx, lockFilter(behaviorType, u.lockLookback()), "start_date ASC")
+			if err != nil {
+				return err
+			}
+
+			status := ProcessorStatus{BehaviorType: behaviorType}
+			for _, task := range tasks {
+				if task.EndDate != nil {
+					continue
+				}
+				status.Active = true
+				status.TaskID = task.ID
+				status.StartDate = task.StartDate
+				if task.StartDate != nil {
+					status.RunningSeconds = time.Since(*task.StartDate).Seconds()
+				}
+				break
+			}
+			statuses = append(statuses, status)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return statuses, nil
+}
+
+// ProcessorsRequest lists the behavior processors and which of them are running, to help diagnose stuck updates
+func (u *AsyncTasksUpdater) ProcessorsRequest(writer http.ResponseWriter, r *http.Request) {
+	statuses, err := u.ProcessorStatuses(r.Context())
+	if err != nil {
+		errored(writer, r, err.Error())
+		return
+	}
+
+	jsoned, err := json.Marshal(statuses)
+	if err != nil {
+		errored(writer, r, err.Error())
+		return
+	}
+
+	_, err = writer.Write(jsoned)
+	if err != nil {
+		requestLog(r).Error(err.Error())
+	}
+}
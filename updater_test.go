@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/cyverse-de/async-tasks/database"
+	"github.com/cyverse-de/async-tasks/database/dbtest"
+	"github.com/cyverse-de/async-tasks/model"
+)
+
+func TestOldestTask(t *testing.T) {
+	early := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	late := early.Add(time.Second)
+	task := func(id string, start *time.Time) model.AsyncTask {
+		return model.AsyncTask{ID: id, StartDate: start}
+	}
+
+	tests := []struct {
+		name  string
+		tasks []model.AsyncTask
+		want  string
+	}{
+		{"none", nil, ""},
+		{"no start dates", []model.AsyncTask{task("a", nil)}, ""},
+		{"earliest start", []model.AsyncTask{task("a", &late), task("b", &early)}, "b"},
+		{"tie in ID order", []model.AsyncTask{task("a", &early), task("b", &early)}, "a"},
+		{"tie out of ID order", []model.AsyncTask{task("b", &early), task("a", &early)}, "a"},
+		{"earlier start beats lower ID", []model.AsyncTask{task("a", &late), task("c", &early), task("b", &early)}, "b"},
+		{"missing start skipped", []model.AsyncTask{task("a", nil), task("b", &late)}, "b"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var got string
+			if oldest := oldestTask(test.tasks); oldest != nil {
+				got = oldest.ID
+			}
+			if got != test.want {
+				t.Errorf("got '%s', want '%s'", got, test.want)
+			}
+		})
+	}
+}
+
+func TestCheckOldestWithTiedStartDates(t *testing.T) {
+	db := dbtest.New(t)
+	ctx := context.Background()
+
+	const behaviorType = "statuschangetimeout"
+	start := time.Now().Add(-time.Minute).UTC().Truncate(time.Microsecond)
+
+	var ids []string
+	err := db.InTx(ctx, nil, func(tx *database.DBTx) error {
+		for i := 0; i < 2; i++ {
+			id, err := tx.InsertTask(ctx, model.AsyncTask{Type: database.BehaviorProcessorTypePrefix + behaviorType, StartDate: &start})
+			if err != nil {
+				return err
+			}
+			ids = append(ids, id)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	passed := 0
+	for _, id := range ids {
+		if checkOldest(ctx, behaviorType, db, id, time.Hour) == nil {
+			passed++
+		}
+	}
+
+	if passed != 1 {
+		t.Errorf("%d of the tied behavior processor tasks passed checkOldest, want exactly 1", passed)
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+)
+
+// These are set at build time with -ldflags, for example
+// -ldflags "-X main.gitCommit=$(git rev-parse HEAD) -X main.buildTime=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+var (
+	version   = "unknown"
+	gitCommit = "unknown"
+	buildTime = "unknown"
+)
+
+// VersionResp is the response body for GET /version
+type VersionResp struct {
+	Service   string `json:"service"`
+	Version   string `json:"version"`
+	GitCommit string `json:"git_commit"`
+	BuildTime string `json:"build_time"`
+	GoVersion string `json:"go_version"`
+}
+
+// VersionRequest reports which build of the service is running
+func VersionRequest(writer http.ResponseWriter, r *http.Request) {
+	jsoned, err := json.Marshal(VersionResp{
+		Service:   serviceName,
+		Version:   version,
+		GitCommit: gitCommit,
+		BuildTime: buildTime,
+		GoVersion: runtime.Version(),
+	})
+	if err != nil {
+		errored(writer, r, err.Error())
+		return
+	}
+
+	_, err = writer.Write(jsoned)
+	if err != nil {
+		requestLog(r).Error(err.Error())
+	}
+}